@@ -9,6 +9,8 @@ require (
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/orcaman/concurrent-map v0.0.0-20190826125027-8c72a8bb44f6
 	github.com/shabbyrobe/gocovmerge v0.0.0-20190829150210-3e036491d500 // indirect
-	golang.org/x/sys v0.0.0-20201026173827-119d4633e4d1 // indirect
+	golang.org/x/sys v0.0.0-20201026173827-119d4633e4d1
+	golang.org/x/text v0.3.3
 	golang.org/x/tools v0.0.0-20201103190053-ac612affd56b // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"swb/s3-synchronizer/synchronizer"
+)
+
+// The interval at which the hydrate command checks whether the synchronizer processed its markers
+const hydratePollInterval = 1 * time.Second
+
+// Runs the "hydrate" command, i.e., "s3-synchronizer hydrate [-timeout seconds] <path>...". The command asks the running
+// synchronizer to hydrate the given placeholders of mounts in cache mode and waits until it did.
+func hydrateMain(args []string) {
+	paths, timeout, err := readHydrateConfigFromArgs(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := hydrateImpl(paths, time.Duration(timeout)*time.Second, hydratePollInterval); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Read configuration information of the "hydrate" command from the given arguments (excluding the command name)
+func readHydrateConfigFromArgs(args []string) ([]string, int, error) {
+	flags := flag.NewFlagSet("hydrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: s3-synchronizer hydrate [-timeout seconds] <path>...")
+		flags.PrintDefaults()
+	}
+	timeoutPtr := flags.Int("timeout", 300, "The number of seconds to wait for the synchronizer to hydrate the files. ZERO or Negative value means wait indefinitely.")
+	if err := flags.Parse(args); err != nil {
+		return nil, 0, err
+	}
+	if flags.NArg() == 0 {
+		return nil, 0, fmt.Errorf("no files to hydrate specified")
+	}
+	return flags.Args(), *timeoutPtr, nil
+}
+
+// Asks the synchronizer to hydrate the given placeholders by creating a hydration marker next to each of them, then
+// waits until the synchronizer deleted the markers, i.e., until the next sync of their mounts hydrated them. Returns
+// an error naming the files that were not hydrated within the given timeout (ZERO or Negative means no timeout).
+func hydrateImpl(paths []string, timeout time.Duration, pollInterval time.Duration) error {
+	markers := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("cannot hydrate '%v': %v", path, err)
+		}
+		marker := path + synchronizer.HydrationMarkerSuffix
+		file, err := os.OpenFile(marker, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error requesting the hydration of '%v': %v", path, err)
+		}
+		file.Close()
+		markers = append(markers, marker)
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		pending := make([]string, 0, len(markers))
+		for _, marker := range markers {
+			if _, err := os.Stat(marker); err == nil {
+				pending = append(pending, marker)
+			}
+		}
+		markers = pending
+		if len(markers) == 0 {
+			break
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			pendingPaths := make([]string, 0, len(markers))
+			for _, marker := range markers {
+				pendingPaths = append(pendingPaths, strings.TrimSuffix(marker, synchronizer.HydrationMarkerSuffix))
+			}
+			return fmt.Errorf("timed out waiting for the synchronizer to hydrate %v", strings.Join(pendingPaths, ", "))
+		}
+		time.Sleep(pollInterval)
+	}
+
+	// The synchronizer deletes the markers of the files it could not hydrate as well, e.g., when they do not fit in
+	// the cache, so report the files that are still empty
+	var empty []string
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.Size() == 0 {
+			empty = append(empty, path)
+		}
+	}
+	if len(empty) > 0 {
+		log.Printf("The following files are still empty, either they are empty in S3 or they could not be hydrated (see the synchronizer's log): %v", strings.Join(empty, ", "))
+	}
+	return nil
+}
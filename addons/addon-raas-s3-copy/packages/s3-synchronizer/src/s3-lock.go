@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"swb/s3-synchronizer/synchronizer"
+)
+
+// Runs the "lock" command, i.e., "s3-synchronizer lock [flags] -mountId id -lockfile path". The command writes a
+// lockfile of the versions of the files downloaded for the given mount, see synchronizer.WriteLockfile.
+func lockMain(args []string) {
+	defaultS3Mounts, mountsFile, region, profile, destinationBase, mountId, lockfile, debug, err := readLockConfigFromArgs(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sess := makeSession(profile, region)
+	if err := lockImpl(sess, debug, defaultS3Mounts, mountsFile, destinationBase, mountId, lockfile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Read configuration information of the "lock" command from the given arguments (excluding the command name)
+func readLockConfigFromArgs(args []string) (string, string, string, string, string, string, string, bool, error) {
+	flags := flag.NewFlagSet("lock", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: s3-synchronizer lock [-defaultS3Mounts mounts | -mountsFile path] [-destination dir] -mountId id -lockfile path")
+		flags.PrintDefaults()
+	}
+	defaultS3MountsPtr := flags.String("defaultS3Mounts", "", "A JSON string containing information about the S3 mounts, the same as for the synchronizer")
+	mountsFilePtr := flags.String("mountsFile", "", "Path to a JSON or YAML file containing information about the S3 mounts, the same as for the synchronizer")
+	regionPtr := flags.String("region", "us-east-1", "The aws region to use for the session")
+	profilePtr := flags.String("profile", "", "AWS Credentials profile. Default is no profile.")
+	destinationBasePtr := flags.String("destination", "./", "The directory the mounts are downloaded to")
+	mountIdPtr := flags.String("mountId", "", "The id of the mount to write the lockfile of")
+	lockfilePtr := flags.String("lockfile", "", "The path of the lockfile to write")
+	debugPtr := flags.Bool("debug", false, "Whether to print debug information")
+	if err := flags.Parse(args); err != nil {
+		return "", "", "", "", "", "", "", false, err
+	}
+	if *mountIdPtr == "" || *lockfilePtr == "" {
+		return "", "", "", "", "", "", "", false, fmt.Errorf("the mountId and the lockfile are required")
+	}
+	return *defaultS3MountsPtr, *mountsFilePtr, *regionPtr, *profilePtr, *destinationBasePtr, *mountIdPtr, *lockfilePtr, *debugPtr, nil
+}
+
+// Writes the lockfile of the mount with the given id to the given path. The mounts are read from defaultS3Mounts or
+// mountsFile and the synchronizer state is the one of the synchronizer (i.e., the program without a command).
+func lockImpl(sess *session.Session, debug bool, defaultS3Mounts string, mountsFile string, destinationBase string, mountId string, lockfile string) error {
+	var s3MountsPtr *[]synchronizer.Mount
+	var err error
+	if defaultS3Mounts != "" {
+		s3MountsPtr, err = synchronizer.GetDefaultMounts(defaultS3Mounts)
+	} else if mountsFile != "" {
+		s3MountsPtr, err = synchronizer.GetMountsFromFile(mountsFile)
+	} else {
+		return fmt.Errorf("either defaultS3Mounts or mountsFile is required")
+	}
+	if err != nil {
+		return err
+	}
+
+	s, err := synchronizer.New(synchronizer.Options{
+		Session:     sess,
+		Mounts:      *s3MountsPtr,
+		Destination: destinationBase,
+		Debug:       debug,
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.WriteLockfile(mountId, lockfile); err != nil {
+		return fmt.Errorf("error writing the lockfile of mount %q: %v", mountId, err)
+	}
+	log.Printf("Wrote the lockfile of mount %q to %s", mountId, lockfile)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"swb/s3-synchronizer/synchronizer"
+)
+
+// The duration to wait after the last change event in the directory of the mounts file before reloading it.
+// Editors usually generate several events (truncate, write, chmod, rename) for a single save,
+// this makes sure we only reload the file once it has settled down.
+const mountsFileReloadDelay = 1 * time.Second
+
+// Watches the given "mountsFile" for changes and calls "onChange" with the re-loaded mounts every time the file changes.
+// The parent directory of the file is watched instead of the file itself because most editors replace the file instead
+// of modifying it in place, which would silently drop a watch on the file itself. Any event in the directory triggers a
+// reload as the file may be a symlink whose target is swapped without an event for the file itself (e.g., Kubernetes
+// config maps swap the "..data" symlink the file links through), the mounts are only applied when the content of the
+// file changed.
+// The function blocks until "stopAfter" seconds have elapsed or ctx is cancelled. ZERO or Negative value means watch
+// until ctx is cancelled.
+func watchMountsFile(ctx context.Context, mountsFile string, stopAfter int, onChange func(mounts []synchronizer.Mount), debug bool) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	mountsFilePath := filepath.Clean(mountsFile)
+	err = watcher.Add(filepath.Dir(mountsFilePath))
+	if err != nil {
+		return err
+	}
+
+	var timeoutCh <-chan time.Time
+	if stopAfter > 0 {
+		timeoutCh = time.After(time.Duration(stopAfter) * time.Second)
+	}
+
+	// The reload timer is only armed after a change in the directory of the mounts file is detected
+	var reloadCh <-chan time.Time
+	// The content of the mounts file as last loaded, the mounts are loaded from the file by the caller initially
+	content, _ := ioutil.ReadFile(mountsFilePath)
+
+	for {
+		select {
+		case <-timeoutCh:
+			if debug {
+				log.Println("Stopping mounts file watcher for", mountsFilePath)
+			}
+			return nil
+		case <-ctx.Done():
+			if debug {
+				log.Println("Stopping mounts file watcher for", mountsFilePath)
+			}
+			return nil
+		case event := <-watcher.Events:
+			if debug {
+				log.Println("mounts file directory event:", event)
+			}
+			reloadCh = time.After(mountsFileReloadDelay)
+		case <-reloadCh:
+			reloadCh = nil
+			newContent, err := ioutil.ReadFile(mountsFilePath)
+			if err == nil && bytes.Equal(newContent, content) {
+				continue
+			}
+			mountsPtr, err := synchronizer.GetMountsFromFile(mountsFilePath)
+			if err != nil {
+				// Keep the current mounts if the file is missing or invalid, the next valid change will be picked up
+				log.Printf("Error reloading mounts file '%s', keeping current mounts: %v\n", mountsFilePath, err)
+				continue
+			}
+			content = newContent
+			if debug {
+				log.Printf("Reloaded %d mount(s) from mounts file '%s'\n", len(*mountsPtr), mountsFilePath)
+			}
+			onChange(*mountsPtr)
+		case err := <-watcher.Errors:
+			log.Println("mounts file watcher error:", err)
+		}
+	}
+}
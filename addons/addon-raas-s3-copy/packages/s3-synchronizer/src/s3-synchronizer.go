@@ -1,77 +1,94 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"log"
-	"path/filepath"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
+	"swb/s3-synchronizer/synchronizer"
 )
 
 func main() {
-	defaultS3Mounts, region, profile, destinationBase, concurrency, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, debug, err := readConfigFromArgs()
+	if len(os.Args) > 1 && os.Args[1] == "hydrate" {
+		hydrateMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lock" {
+		lockMain(os.Args[2:])
+		return
+	}
+
+	config, err := readConfigFromArgs()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sess := makeSession(profile, region)
+	config.options.Session = makeSession(config.profile, config.region)
 
-	// Passing stopUploadWatchersAfter as -1 to let file watchers continue indefinitely if mount is writeable
-	stopUploadWatchersAfter := -1
-
-	mainImpl(sess, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, stopUploadWatchersAfter, concurrency, defaultS3Mounts, destinationBase)
+	err = mainImpl(newSignalContext(), config)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func mainImpl(sess *session.Session, debug bool, recurringDownloads bool, stopRecurringDownloadsAfter int, downloadInterval int, stopUploadWatchersAfter int, concurrency int, defaultS3Mounts string, destinationBase string) error {
-	// Use a map to emulate a set to keep track of existing mounts
-	currentMounts := make(map[string]struct{}, 0)
-	mountsCh := make(chan *mountConfiguration, 50)
-
-	// Create wait group to keep track of go routines being spawned
-	// so the main go routine can wait for them to completes
-	var wg sync.WaitGroup
-
-	// In another thread, get the next mount configuration from the buffered channel
-	// and download the files. If the share is marked as writeable then start the
-	// file watchers in another thread (because the setup function won't return)
+// Returns a context that is cancelled when the program receives SIGINT or SIGTERM
+func newSignalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		for {
-			mountConfig := <-mountsCh
-			if debug {
-				log.Printf("Received mount configuration from channel: %+v\n", mountConfig)
-			}
-			if recurringDownloads {
-				// Trigger recurring download
-				setupRecurringDownloads(&wg, sess, mountConfig, concurrency, debug, downloadInterval, stopRecurringDownloadsAfter)
-			} else {
-				downloadFiles(sess, mountConfig, concurrency, debug)
-			}
-			if mountConfig.writeable {
-				go func() {
-					err := setupUploadWatcher(&wg, sess, mountConfig, stopUploadWatchersAfter, debug)
-					if err != nil {
-						log.Printf("Error setting up file watcher: " + err.Error())
-					}
-				}()
-			}
-			if debug {
-				log.Printf("Decrement wg counter")
-			}
-			wg.Done() // Decrement wait group counter everytime we receive config from the mount channel and complete processing it
-		}
+		sig := <-signalCh
+		log.Printf("Received %v signal", sig)
+		cancel()
 	}()
+	return ctx
+}
 
+// The configuration of the program, see readConfigFromArgs
+type programConfig struct {
+	// The options of the synchronizer, the mounts are loaded from defaultS3Mounts or mountsFile by mainImpl
+	options synchronizer.Options
+	// The default S3 mounts as a JSON string, see GetDefaultMounts
+	defaultS3Mounts string
+	// The path of the JSON or YAML file of the S3 mounts, watched for changes with recurring downloads
+	mountsFile string
+	// The region and the credentials profile of the AWS session
+	region  string
+	profile string
+	// The time given to the in-flight downloads and uploads to complete on shutdown. ZERO or Negative value means wait
+	// indefinitely.
+	shutdownTimeout time.Duration
+}
+
+// Runs the synchronizer until all mounts complete or ctx is cancelled. When ctx is cancelled, the in-flight downloads
+// and uploads are given "shutdownTimeout" to complete before they are aborted.
+func mainImpl(ctx context.Context, config programConfig) error {
+	debug := config.options.Debug
+	defaultS3Mounts, mountsFile := config.defaultS3Mounts, config.mountsFile
 	if debug {
 		log.Println("Fetching environment info")
 	}
 
-	var s3MountsPtr *[]s3Mount
+	if defaultS3Mounts != "" && mountsFile != "" {
+		err := fmt.Errorf("only one of defaultS3Mounts or mountsFile can be specified")
+		log.Print("Error getting environment info: " + err.Error())
+		return err
+	}
+
+	var s3MountsPtr *[]synchronizer.Mount
 	var err error
 	if defaultS3Mounts != "" {
-		s3MountsPtr, err = getDefaultMounts(defaultS3Mounts)
+		s3MountsPtr, err = synchronizer.GetDefaultMounts(defaultS3Mounts)
+	} else if mountsFile != "" {
+		s3MountsPtr, err = synchronizer.GetMountsFromFile(mountsFile)
 	}
 
 	if err != nil {
@@ -79,57 +96,90 @@ func mainImpl(sess *session.Session, debug bool, recurringDownloads bool, stopRe
 		return err
 	}
 
-	var s3Mounts []s3Mount
+	var s3Mounts []synchronizer.Mount
 	if s3MountsPtr != nil {
 		s3Mounts = *s3MountsPtr
 	}
 
-	if debug {
-		log.Println("Parsing mounts...")
+	options := config.options
+	options.Mounts = s3Mounts
+	s, err := synchronizer.New(options)
+	if err != nil {
+		log.Print("Error creating the synchronizer: " + err.Error())
+		return err
 	}
-	for _, mount := range s3Mounts {
-		s := mountToString(&mount)
-		_, exists := currentMounts[s]
+	s.Start()
 
-		if debug {
-			log.Printf("Mount: %v, Adding to mount queue: %t\n", *mount.Id, !exists)
-		}
+	// Create wait group to keep track of the mounts file watcher
+	// so the main go routine can wait for it to complete
+	var wg sync.WaitGroup
 
-		if !exists {
-			destination := filepath.Join(destinationBase, *mount.Id)
-			config := newMountConfiguration(
-				*mount.Bucket,
-				*mount.Prefix,
-				destination,
-				*mount.Writeable,
-				*mount.KmsKeyId,
-			)
-			wg.Add(1) // Increment wait group counter everytime we push config to the mount channel
-			if debug {
-				log.Printf("Increment wg counter")
+	// Mounts can only be added or removed at runtime when the files are downloaded periodically
+	if mountsFile != "" && options.RecurringDownloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := watchMountsFile(ctx, mountsFile, int(options.StopRecurringDownloadsAfter/time.Second), func(mounts []synchronizer.Mount) {
+				if err := s.SetMounts(mounts); err != nil {
+					log.Printf("Error applying mounts from mounts file '%s', keeping current mounts: %v\n", mountsFile, err)
+				}
+			}, debug)
+			if err != nil {
+				log.Printf("Error setting up mounts file watcher: %v\n", err)
 			}
-			mountsCh <- config
-		}
-
-		// Add to the currentMounts
-		currentMounts[s] = struct{}{}
+		}()
 	}
 
-	wg.Wait() // Wait until all spawned go routines complete before existing the program
+	doneCh := make(chan struct{})
+	go func() {
+		// Wait for the mounts file watcher first as it may add more mounts to the synchronizer until it stops
+		wg.Wait()
+		s.Wait() // Wait until all mounts complete before existing the program
+		close(doneCh)
+	}()
 
-	return nil
+	select {
+	case <-doneCh:
+		// Nothing is running anymore, this just saves the synchronizer state
+		return s.Shutdown(context.Background())
+	case <-ctx.Done():
+		log.Printf("Shutting down, waiting for in-flight transfers to complete (shutdownTimeout: %v)", config.shutdownTimeout)
+		shutdownCtx := context.Background()
+		if config.shutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			shutdownCtx, cancel = context.WithTimeout(shutdownCtx, config.shutdownTimeout)
+			defer cancel()
+		}
+		err := s.Shutdown(shutdownCtx)
+		<-doneCh
+		if err != nil {
+			return fmt.Errorf("error shutting down: %v", err)
+		}
+		log.Println("Shut down cleanly")
+		return nil
+	}
 }
 
 // Read configuration information fro the program arguments
-func readConfigFromArgs() (string, string, string, string, int, bool, int, int, bool, error) {
+func readConfigFromArgs() (programConfig, error) {
 	defaultS3MountsPtr := flag.String("defaultS3Mounts", "", `A JSON string containing information about the default S3 mounts E.g., [{"id":"some-id","bucket":"some-s3-bucket-name","prefix":"some/s3/prefix/path","writeable":false,"kmsKeyId":"some-kms-key-arn"}]`)
+	mountsFilePtr := flag.String("mountsFile", "", "Path to a JSON or YAML file containing information about the S3 mounts in the same format as defaultS3Mounts. When recurringDownloads is true, the file is watched and mounts are added or removed as the file changes. Cannot be used together with defaultS3Mounts")
+	deleteRemovedMountsPtr := flag.Bool("deleteRemovedMounts", false, "Whether to delete the local files of a mount when it is removed from the mountsFile. The local files are kept by default")
 	regionPtr := flag.String("region", "us-east-1", "The aws region to use for the session")
 	profilePtr := flag.String("profile", "", "AWS Credentials profile. Default is no profile. The code will look for credentials in the following order: ENV variables, default credentials profile, EC2 instance metadata")
 	destinationBasePtr := flag.String("destination", "./", "The directory to download to")
-	concurrencyPtr := flag.Int("concurrency", 20, "The number of concurrent parts to download")
+	concurrencyPtr := flag.Int("concurrency", 20, "The number of concurrent parts to download per object")
+	objectConcurrencyPtr := flag.Int("objectConcurrency", 10, "The number of objects to download concurrently per mount")
+	maxConcurrentObjectsPtr := flag.Int("maxConcurrentObjects", 20, "The maximum number of objects to download concurrently across all mounts")
+	listingConcurrencyPtr := flag.Int("listingConcurrency", 1, "The number of concurrent listings per mount. When greater than 1, the prefix of a mount is partitioned into its sub-prefixes (as delimited by \"/\") which are listed concurrently")
+	downloadRateLimitPtr := flag.Int64("downloadRateLimit", 0, "The maximum download rate across all mounts in bytes per second. ZERO means unlimited. Individual mounts can be limited further using the downloadRateLimit attribute of the mount")
+	uploadRateLimitPtr := flag.Int64("uploadRateLimit", 0, "The maximum upload rate across all mounts in bytes per second. ZERO means unlimited. Individual mounts can be limited further using the uploadRateLimit attribute of the mount")
+	minFreeDiskSpacePtr := flag.Int64("minFreeDiskSpace", 0, "The low-disk watermark in bytes. Downloads pause rather than leave less free space than this on the disk of the destination and resume once space is freed up, for at most 30 minutes per sync. ZERO means the downloads pause when the disk is full")
+	unicodeNormalizationPtr := flag.String("unicodeNormalization", "", "The Unicode normalization form (NFC or NFD) of the local paths and of the S3 keys compared with them. Empty means the keys are mapped to local paths as they are")
 	recurringDownloadsPtr := flag.Bool("recurringDownloads", false, "Whether to periodically download changes from S3")
 	stopRecurringDownloadsAfterPtr := flag.Int("stopRecurringDownloadsAfter", -1, "Stop recurring downloads after certain number of seconds. ZERO or Negative value means continue indefinitely.")
 	downloadIntervalPtr := flag.Int("downloadInterval", 60, "The interval at which to re-download changes from S3 in seconds. This is only applicable when recurringDownloads is true")
+	shutdownTimeoutPtr := flag.Int("shutdownTimeout", 30, "The number of seconds to wait for in-flight downloads and uploads to complete when the program receives SIGINT or SIGTERM before aborting them. ZERO or Negative value means wait indefinitely.")
 	debugPtr := flag.Bool("debug", false, "Whether to print debug information")
 
 	flag.Parse()
@@ -137,6 +187,12 @@ func readConfigFromArgs() (string, string, string, string, int, bool, int, int,
 	defaultS3Mounts := *defaultS3MountsPtr
 	log.Print("defaultS3Mounts: " + defaultS3Mounts)
 
+	mountsFile := *mountsFilePtr
+	log.Print("mountsFile: " + mountsFile)
+
+	deleteRemovedMounts := *deleteRemovedMountsPtr
+	log.Printf("deleteRemovedMounts: %v", deleteRemovedMounts)
+
 	region := *regionPtr
 	log.Print("region: " + region)
 
@@ -149,6 +205,27 @@ func readConfigFromArgs() (string, string, string, string, int, bool, int, int,
 	concurrency := *concurrencyPtr
 	log.Printf("concurrency: %v", concurrency)
 
+	objectConcurrency := *objectConcurrencyPtr
+	log.Printf("objectConcurrency: %v", objectConcurrency)
+
+	maxConcurrentObjects := *maxConcurrentObjectsPtr
+	log.Printf("maxConcurrentObjects: %v", maxConcurrentObjects)
+
+	listingConcurrency := *listingConcurrencyPtr
+	log.Printf("listingConcurrency: %v", listingConcurrency)
+
+	downloadRateLimit := *downloadRateLimitPtr
+	log.Printf("downloadRateLimit: %v", downloadRateLimit)
+
+	uploadRateLimit := *uploadRateLimitPtr
+	log.Printf("uploadRateLimit: %v", uploadRateLimit)
+
+	minFreeDiskSpace := *minFreeDiskSpacePtr
+	log.Printf("minFreeDiskSpace: %v", minFreeDiskSpace)
+
+	unicodeNormalization := *unicodeNormalizationPtr
+	log.Print("unicodeNormalization: " + unicodeNormalization)
+
 	recurringDownloads := *recurringDownloadsPtr
 	log.Printf("recurringDownloads: %v", recurringDownloads)
 
@@ -158,13 +235,39 @@ func readConfigFromArgs() (string, string, string, string, int, bool, int, int,
 	downloadInterval := *downloadIntervalPtr
 	log.Printf("downloadInterval: %v", downloadInterval)
 	if downloadInterval <= 0 {
-		return "", "", "", "", 0, false, -1, 0, false, fmt.Errorf("incorrect downloadInterval %v specified; the downloadInterval must be a positive integer", downloadInterval)
+		return programConfig{}, fmt.Errorf("incorrect downloadInterval %v specified; the downloadInterval must be a positive integer", downloadInterval)
 	}
 
+	shutdownTimeout := *shutdownTimeoutPtr
+	log.Printf("shutdownTimeout: %v", shutdownTimeout)
+
 	debug := *debugPtr
 	log.Printf("debug: %v", debug)
 
-	return defaultS3Mounts, region, profile, destinationBase, concurrency, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, debug, nil
+	return programConfig{
+		options: synchronizer.Options{
+			Destination:                 destinationBase,
+			Debug:                       debug,
+			Concurrency:                 concurrency,
+			ObjectConcurrency:           objectConcurrency,
+			MaxConcurrentObjects:        maxConcurrentObjects,
+			ListingConcurrency:          listingConcurrency,
+			DownloadRateLimit:           downloadRateLimit,
+			UploadRateLimit:             uploadRateLimit,
+			MinFreeDiskSpace:            minFreeDiskSpace,
+			UnicodeNormalization:        unicodeNormalization,
+			RecurringDownloads:          recurringDownloads,
+			DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+			StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+			DeleteRemovedMounts:         deleteRemovedMounts,
+			// StopUploadWatchersAfter is left at ZERO to let file watchers continue indefinitely if mount is writeable
+		},
+		defaultS3Mounts: defaultS3Mounts,
+		mountsFile:      mountsFile,
+		region:          region,
+		profile:         profile,
+		shutdownTimeout: time.Duration(shutdownTimeout) * time.Second,
+	}, nil
 }
 
 func makeSession(profile string, region string) *session.Session {
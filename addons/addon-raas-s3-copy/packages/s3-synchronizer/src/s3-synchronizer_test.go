@@ -2,14 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/johannesboyne/gofakes3"
-	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"io/ioutil"
 	"net/http/httptest"
 	"os"
@@ -18,6 +13,16 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"gopkg.in/yaml.v2"
+
+	"swb/s3-synchronizer/synchronizer"
 )
 
 var testAwsSession *session.Session
@@ -25,6 +30,10 @@ var testAwsSession *session.Session
 const testRegion = "us-east-1"
 const debug = true
 
+// The object level concurrency used by all tests, the number of concurrent parts is set per test
+const objectConcurrency = 4
+const maxConcurrentObjects = 6
+
 // A test destination directory path. The test creates this directory and populates it with simulated downloads
 // This directory is cleaned up at the end of the test.
 // WARNING: Since this directory gets automatically cleaned up at the end of the test,
@@ -47,7 +56,7 @@ func TestMainImplForInitialDownloadSingleMount(t *testing.T) {
 
 	// ---- Data setup ----
 	noOfMounts := 1
-	testMounts := make([]s3Mount, noOfMounts)
+	testMounts := make([]synchronizer.Mount, noOfMounts)
 	testMountId := "TestMainImplForInitialDownloadSingleMount"
 	noOfFilesInMount := 5
 	testMounts[0] = *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
@@ -65,7 +74,17 @@ func TestMainImplForInitialDownloadSingleMount(t *testing.T) {
 	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
 
 	// ---- Run code under test ----
-	err = mainImpl(testAwsSession, debug, false, -1, 60, -1, concurrency, testMountsJson, destinationBase)
+	err = mainImpl(context.Background(), programConfig{
+		options: synchronizer.Options{
+			Session:              testAwsSession,
+			Destination:          destinationBase,
+			Debug:                debug,
+			Concurrency:          concurrency,
+			ObjectConcurrency:    objectConcurrency,
+			MaxConcurrentObjects: maxConcurrentObjects,
+		},
+		defaultS3Mounts: testMountsJson,
+	})
 	if err != nil {
 		// Fail test in case of any errors
 		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -80,7 +99,7 @@ func TestMainImplForInitialDownloadSingleMount(t *testing.T) {
 func TestMainImplForInitialDownloadMultipleMounts(t *testing.T) {
 	// ---- Data setup ----
 	noOfMounts := 3
-	testMounts := make([]s3Mount, noOfMounts)
+	testMounts := make([]synchronizer.Mount, noOfMounts)
 	testBucketName := "test-bucket"
 
 	testMountId1 := "TestMainImplForInitialDownloadMultipleMounts1"
@@ -109,7 +128,17 @@ func TestMainImplForInitialDownloadMultipleMounts(t *testing.T) {
 	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
 
 	// ---- Run code under test ----
-	err = mainImpl(testAwsSession, debug, false, -1, 60, -1, concurrency, testMountsJson, destinationBase)
+	err = mainImpl(context.Background(), programConfig{
+		options: synchronizer.Options{
+			Session:              testAwsSession,
+			Destination:          destinationBase,
+			Debug:                debug,
+			Concurrency:          concurrency,
+			ObjectConcurrency:    objectConcurrency,
+			MaxConcurrentObjects: maxConcurrentObjects,
+		},
+		defaultS3Mounts: testMountsJson,
+	})
 	if err != nil {
 		// Fail test in case of any errors
 		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -125,7 +154,7 @@ func TestMainImplForInitialDownloadMultipleMounts(t *testing.T) {
 // Test for s3Mounts json being empty array
 func TestMainImplForInitialDownloadEmptyMounts(t *testing.T) {
 	// ---- Data setup ----
-	var testMounts []s3Mount
+	var testMounts []synchronizer.Mount
 
 	testMountsJsonBytes, err := json.Marshal(testMounts)
 	testMountsJson := string(testMountsJsonBytes)
@@ -141,7 +170,17 @@ func TestMainImplForInitialDownloadEmptyMounts(t *testing.T) {
 	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
 
 	// ---- Run code under test ----
-	err = mainImpl(testAwsSession, debug, false, -1, 60, -1, concurrency, testMountsJson, destinationBase)
+	err = mainImpl(context.Background(), programConfig{
+		options: synchronizer.Options{
+			Session:              testAwsSession,
+			Destination:          destinationBase,
+			Debug:                debug,
+			Concurrency:          concurrency,
+			ObjectConcurrency:    objectConcurrency,
+			MaxConcurrentObjects: maxConcurrentObjects,
+		},
+		defaultS3Mounts: testMountsJson,
+	})
 	if err != nil {
 		// Fail test in case of any errors
 		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -158,7 +197,17 @@ func TestMainImplForInitialDownloadInvalidMounts(t *testing.T) {
 	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
 
 	// ---- Run code under test ----
-	err := mainImpl(testAwsSession, debug, false, -1, 60, -1, concurrency, testMountsJson, destinationBase)
+	err := mainImpl(context.Background(), programConfig{
+		options: synchronizer.Options{
+			Session:              testAwsSession,
+			Destination:          destinationBase,
+			Debug:                debug,
+			Concurrency:          concurrency,
+			ObjectConcurrency:    objectConcurrency,
+			MaxConcurrentObjects: maxConcurrentObjects,
+		},
+		defaultS3Mounts: testMountsJson,
+	})
 	if err == nil {
 		// Fail test in case of no errors since we are expecting errors when passing invalid json for mounting
 		t.Logf("Expecting error when running the main s3-synchronizer with invalid testMountsJson but it ran fine")
@@ -174,7 +223,7 @@ func TestMainImplForInitialDownloadInvalidMounts(t *testing.T) {
 func TestMainImplForSyncSingleMount(t *testing.T) {
 	// ---- Data setup ----
 	noOfMounts := 1
-	testMounts := make([]s3Mount, noOfMounts)
+	testMounts := make([]synchronizer.Mount, noOfMounts)
 	testMountId := "TestMainImplForSyncSingleMount"
 	noOfFilesInMount := 5
 	testMounts[0] = *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
@@ -200,7 +249,20 @@ func TestMainImplForSyncSingleMount(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		// ---- Run code under test ----
-		err = mainImpl(testAwsSession, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, -1, concurrency, testMountsJson, destinationBase)
+		err = mainImpl(context.Background(), programConfig{
+			options: synchronizer.Options{
+				Session:                     testAwsSession,
+				Destination:                 destinationBase,
+				Debug:                       debug,
+				Concurrency:                 concurrency,
+				ObjectConcurrency:           objectConcurrency,
+				MaxConcurrentObjects:        maxConcurrentObjects,
+				RecurringDownloads:          recurringDownloads,
+				DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+				StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+			},
+			defaultS3Mounts: testMountsJson,
+		})
 		if err != nil {
 			// Fail test in case of any errors
 			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -271,7 +333,7 @@ func TestMainImplForSyncSingleMount(t *testing.T) {
 func TestMainImplForSyncMultipleMounts(t *testing.T) {
 	// ---- Data setup ----
 	noOfMounts := 3
-	testMounts := make([]s3Mount, noOfMounts)
+	testMounts := make([]synchronizer.Mount, noOfMounts)
 	testBucketName := "test-bucket"
 
 	testMountId1 := "TestMainImplForSyncMultipleMounts1"
@@ -307,7 +369,20 @@ func TestMainImplForSyncMultipleMounts(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		// ---- Run code under test ----
-		err = mainImpl(testAwsSession, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, -1, concurrency, testMountsJson, destinationBase)
+		err = mainImpl(context.Background(), programConfig{
+			options: synchronizer.Options{
+				Session:                     testAwsSession,
+				Destination:                 destinationBase,
+				Debug:                       debug,
+				Concurrency:                 concurrency,
+				ObjectConcurrency:           objectConcurrency,
+				MaxConcurrentObjects:        maxConcurrentObjects,
+				RecurringDownloads:          recurringDownloads,
+				DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+				StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+			},
+			defaultS3Mounts: testMountsJson,
+		})
 		if err != nil {
 			// Fail test in case of any errors
 			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -385,7 +460,7 @@ func TestMainImplForSyncMultipleMounts(t *testing.T) {
 // Test for s3Mounts json being empty array for recurring downloads
 func TestMainImplForRecurringDownloadEmptyMounts(t *testing.T) {
 	// ---- Data setup ----
-	var testMounts []s3Mount
+	var testMounts []synchronizer.Mount
 
 	testMountsJsonBytes, err := json.Marshal(testMounts)
 	testMountsJson := string(testMountsJsonBytes)
@@ -401,7 +476,20 @@ func TestMainImplForRecurringDownloadEmptyMounts(t *testing.T) {
 	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
 
 	// ---- Run code under test ----
-	err = mainImpl(testAwsSession, debug, true, 5, 1, -1, concurrency, testMountsJson, destinationBase)
+	err = mainImpl(context.Background(), programConfig{
+		options: synchronizer.Options{
+			Session:                     testAwsSession,
+			Destination:                 destinationBase,
+			Debug:                       debug,
+			Concurrency:                 concurrency,
+			ObjectConcurrency:           objectConcurrency,
+			MaxConcurrentObjects:        maxConcurrentObjects,
+			RecurringDownloads:          true,
+			DownloadInterval:            1 * time.Second,
+			StopRecurringDownloadsAfter: 5 * time.Second,
+		},
+		defaultS3Mounts: testMountsJson,
+	})
 	if err != nil {
 		// Fail test in case of any errors
 		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -418,30 +506,378 @@ func TestMainImplForRecurringDownloadInvalidMounts(t *testing.T) {
 	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
 
 	// ---- Run code under test ----
-	err := mainImpl(testAwsSession, debug, true, 5, 1, -1, concurrency, testMountsJson, destinationBase)
+	err := mainImpl(context.Background(), programConfig{
+		options: synchronizer.Options{
+			Session:                     testAwsSession,
+			Destination:                 destinationBase,
+			Debug:                       debug,
+			Concurrency:                 concurrency,
+			ObjectConcurrency:           objectConcurrency,
+			MaxConcurrentObjects:        maxConcurrentObjects,
+			RecurringDownloads:          true,
+			DownloadInterval:            1 * time.Second,
+			StopRecurringDownloadsAfter: 5 * time.Second,
+		},
+		defaultS3Mounts: testMountsJson,
+	})
 	if err == nil {
 		// Fail test in case of no errors since we are expecting errors when passing invalid json for mounting
 		t.Logf("Expecting error when running the main s3-synchronizer with invalid testMountsJson but it ran fine")
 	}
 }
 
+// ######### Tests for Shutdown #########
+
+// Test for shutting down when the program is asked to stop (e.g., on SIGTERM) while recurring downloads and
+// file watchers are set to continue indefinitely
+// - Make sure the program returns without error once the context is cancelled
+// - Make sure local changes detected before the shutdown are uploaded
+func TestMainImplForShutdownOnCancel(t *testing.T) {
+	// ---- Data setup ----
+	noOfMounts := 1
+	testMounts := make([]synchronizer.Mount, noOfMounts)
+	testMountId := "TestMainImplForShutdownOnCancel"
+	noOfFilesInMount := 2
+	testMounts[0] = *putWriteableTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+	testMountsJsonBytes, err := json.Marshal(testMounts)
+	testMountsJson := string(testMountsJsonBytes)
+
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error creating test mount setup data %s", err)
+	}
+
+	// ---- Inputs ----
+	concurrency := 2
+	recurringDownloads := true
+	stopRecurringDownloadsAfter := -1
+	downloadInterval := 1
+	stopUploadWatchersAfter := -1
+	shutdownTimeout := 30
+
+	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	// Trigger recurring download in a separate thread and increment the wait group counter
+	wg.Add(1)
+	go func() {
+		// ---- Run code under test ----
+		err := mainImpl(ctx, programConfig{
+			options: synchronizer.Options{
+				Session:                     testAwsSession,
+				Destination:                 destinationBase,
+				Debug:                       debug,
+				Concurrency:                 concurrency,
+				ObjectConcurrency:           objectConcurrency,
+				MaxConcurrentObjects:        maxConcurrentObjects,
+				RecurringDownloads:          recurringDownloads,
+				DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+				StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+				StopUploadWatchersAfter:     time.Duration(stopUploadWatchersAfter) * time.Second,
+			},
+			defaultS3Mounts: testMountsJson,
+			shutdownTimeout: time.Duration(shutdownTimeout) * time.Second,
+		})
+		if err != nil {
+			// Fail test in case of any errors
+			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
+			t.Errorf("Error: %v", err)
+		}
+
+		// Decrement wait group counter to allow this test case to exit
+		wg.Done()
+	}()
+
+	// Sleep for some time to allow for initial download and file watchers to start
+	time.Sleep(3 * time.Second)
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId, noOfFilesInMount)
+
+	// ---- Data setup ----
+	// Create new files locally and ask the program to stop shortly after
+	noOfLocalFiles := 4
+	createTestFilesLocally(t, testMountId, noOfLocalFiles)
+	time.Sleep(500 * time.Millisecond)
+
+	// ---- Run code under test ----
+	cancel()
+
+	// Wait for the program to shut down
+	shutdownCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(shutdownCh)
+	}()
+	select {
+	case <-shutdownCh:
+	case <-time.After(time.Duration(shutdownTimeout) * time.Second):
+		t.Fatalf("ASSERT_FAILURE: Expected: Program to shut down within %d seconds | Actual: Program is still running", shutdownTimeout)
+	}
+
+	// ---- Assertions ----
+	// The files created locally before the shutdown should have been uploaded
+	assertFilesUploaded(t, testFakeBucketName, testMountId, noOfLocalFiles)
+}
+
+// ######### Tests for Mounts Validation #########
+
+// Negative test: Test for s3Mounts json with a mount missing required attributes
+func TestMainImplForInitialDownloadMountMissingAttributes(t *testing.T) {
+	// ---- Inputs ----
+	concurrency := 2
+
+	testMountsJson := `[{"id":"some-id","prefix":"some/s3/prefix/path"}]`
+	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+
+	// ---- Run code under test ----
+	err := mainImpl(context.Background(), programConfig{
+		options: synchronizer.Options{
+			Session:              testAwsSession,
+			Destination:          destinationBase,
+			Debug:                debug,
+			Concurrency:          concurrency,
+			ObjectConcurrency:    objectConcurrency,
+			MaxConcurrentObjects: maxConcurrentObjects,
+		},
+		defaultS3Mounts: testMountsJson,
+	})
+	if _, ok := err.(*synchronizer.MountValidationError); !ok {
+		// Fail test in case of no validation errors since the mount is missing the bucket
+		t.Errorf("Expecting validation error when running the main s3-synchronizer with testMountsJson missing bucket but got: %v", err)
+	}
+}
+
+// ######### Tests for Mounts File #########
+
+// Test for S3Mounts loaded from a YAML mounts file with recurring downloads
+// - Make sure mounts added to the mounts file are synced automatically
+// - Make sure mounts removed from the mounts file are no longer synced
+func TestMainImplForMountsFileReload(t *testing.T) {
+	// ---- Data setup ----
+	testMountId1 := "TestMainImplForMountsFileReload1"
+	noOfFilesInMount1 := 2
+	testMount1 := *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId1, noOfFilesInMount1)
+
+	testMountId2 := "TestMainImplForMountsFileReload2"
+	noOfFilesInMount2 := 3
+	testMount2 := *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId2, noOfFilesInMount2)
+
+	mountsFile := destinationBase + "/TestMainImplForMountsFileReload.yaml"
+	writeTestMountsFile(t, mountsFile, []synchronizer.Mount{testMount1})
+
+	// ---- Inputs ----
+	concurrency := 5
+	recurringDownloads := true
+	stopRecurringDownloadsAfter := 15
+	downloadInterval := 1
+	reloadWait := mountsFileReloadDelay + time.Duration(2*downloadInterval)*time.Second
+
+	var wg sync.WaitGroup
+
+	// Trigger recurring download in a separate thread and increment the wait group counter
+	wg.Add(1)
+	go func() {
+		// ---- Run code under test ----
+		err := mainImpl(context.Background(), programConfig{
+			options: synchronizer.Options{
+				Session:                     testAwsSession,
+				Destination:                 destinationBase,
+				Debug:                       debug,
+				Concurrency:                 concurrency,
+				ObjectConcurrency:           objectConcurrency,
+				MaxConcurrentObjects:        maxConcurrentObjects,
+				RecurringDownloads:          recurringDownloads,
+				DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+				StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+			},
+			mountsFile: mountsFile,
+		})
+		if err != nil {
+			// Fail test in case of any errors
+			t.Logf("Error running the main s3-synchronizer with mountsFile %s", mountsFile)
+			t.Errorf("Error: %v", err)
+		}
+
+		// Decrement wait group counter to allow this test case to exit
+		wg.Done()
+	}()
+
+	time.Sleep(time.Duration(2*downloadInterval) * time.Second)
+
+	// ---- Assertions ----
+	// Verify that the mount from the initial mounts file is downloaded
+	assertFilesDownloaded(t, testMountId1, noOfFilesInMount1)
+
+	// TEST FOR ADD -- NEW MOUNT IN MOUNTS FILE --> LOCAL FILE SYSTEM SYNC
+	// ---------------------------------------------------------------------
+	writeTestMountsFile(t, mountsFile, []synchronizer.Mount{testMount1, testMount2})
+
+	// Sleep for the reload delay and the download interval plus some more buffer time
+	time.Sleep(reloadWait)
+
+	// ---- Assertions ----
+	// Verify that the newly added mount is downloaded without restarting
+	assertFilesDownloaded(t, testMountId2, noOfFilesInMount2)
+
+	// TEST FOR REMOVE -- MOUNT REMOVED FROM MOUNTS FILE --> NO MORE SYNC
+	// ---------------------------------------------------------------------
+	writeTestMountsFile(t, mountsFile, []synchronizer.Mount{testMount2})
+	time.Sleep(reloadWait)
+
+	// Upload more files to the removed mount, they should no longer be downloaded
+	putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId1, 2*noOfFilesInMount1)
+	time.Sleep(time.Duration(2*downloadInterval) * time.Second)
+
+	// ---- Assertions ----
+	// Verify that the files added to the removed mount are not downloaded
+	assertFileDeleted(t, testMountId1, noOfFilesInMount1)
+
+	wg.Wait() // Wait until all spawned go routines complete before existing the test case
+}
+
+// Test for a writeable S3Mount removed from the mounts file with deleteRemovedMounts
+// - Make sure the files created locally before the mount is removed are uploaded
+// - Make sure the local files of the removed mount are deleted
+func TestMainImplForMountsFileRemoveWriteableMount(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestMainImplForMountsFileRemoveWriteableMount"
+	noOfFilesInMount := 2
+	testMount := *putWriteableTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+
+	mountsFile := destinationBase + "/TestMainImplForMountsFileRemoveWriteableMount.json"
+	writeTestMountsFile(t, mountsFile, []synchronizer.Mount{testMount})
+
+	// ---- Inputs ----
+	concurrency := 5
+	recurringDownloads := true
+	stopRecurringDownloadsAfter := 10
+	downloadInterval := 1
+	stopUploadWatchersAfter := 10
+	deleteRemovedMounts := true
+
+	var wg sync.WaitGroup
+
+	// Trigger recurring download in a separate thread and increment the wait group counter
+	wg.Add(1)
+	go func() {
+		// ---- Run code under test ----
+		err := mainImpl(context.Background(), programConfig{
+			options: synchronizer.Options{
+				Session:                     testAwsSession,
+				Destination:                 destinationBase,
+				Debug:                       debug,
+				Concurrency:                 concurrency,
+				ObjectConcurrency:           objectConcurrency,
+				MaxConcurrentObjects:        maxConcurrentObjects,
+				RecurringDownloads:          recurringDownloads,
+				DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+				StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+				StopUploadWatchersAfter:     time.Duration(stopUploadWatchersAfter) * time.Second,
+				DeleteRemovedMounts:         deleteRemovedMounts,
+			},
+			mountsFile: mountsFile,
+		})
+		if err != nil {
+			// Fail test in case of any errors
+			t.Logf("Error running the main s3-synchronizer with mountsFile %s", mountsFile)
+			t.Errorf("Error: %v", err)
+		}
+
+		// Decrement wait group counter to allow this test case to exit
+		wg.Done()
+	}()
+
+	time.Sleep(time.Duration(2*downloadInterval) * time.Second)
+	assertFilesDownloaded(t, testMountId, noOfFilesInMount)
+
+	// TEST FOR REMOVE -- LOCAL CHANGES ARE UPLOADED AND LOCAL FILES ARE DELETED
+	// ---------------------------------------------------------------------------
+	createTestFilesLocally(t, testMountId, noOfFilesInMount)
+	writeTestMountsFile(t, mountsFile, []synchronizer.Mount{})
+
+	// Sleep for the reload delay and the download interval plus some more buffer time
+	time.Sleep(mountsFileReloadDelay + time.Duration(2*downloadInterval)*time.Second)
+
+	// ---- Assertions ----
+	// Verify that the files created locally were uploaded before the mount was torn down
+	assertFilesUploaded(t, testFakeBucketName, testMountId, noOfFilesInMount)
+
+	// Verify that the local files of the mount are deleted
+	mountDir := fmt.Sprintf("%s/%s", destinationBase, testMountId)
+	if _, err := os.Stat(mountDir); !os.IsNotExist(err) {
+		t.Errorf(`ASSERT_FAILURE: Expected: Directory "%v" to NOT exist after the mount is removed | Actual: The directory exists`, mountDir)
+	}
+
+	wg.Wait() // Wait until all spawned go routines complete before existing the test case
+}
+
 // ######### Tests for Bi-directional Sync #########
 
-//Test for single writeable S3Mount with recurring downloads (i.e., bi-directional sync)
-//- Make sure S3 --> Local sync works correctly
-//	 - Make sure S3 ADDs are synced to local automatically
-//	 - Make sure S3 UPDATEs are synced to local automatically
-//	 - Make sure S3 DELETEs are synced to local automatically
+// Test that the mounts are reloaded when the mounts file links through a symlink that is swapped atomically, the way
+// Kubernetes updates the files of config maps, without any event for the mounts file itself
+func TestWatchMountsFileForSymlinkSwap(t *testing.T) {
+	// ---- Data setup ----
+	configDir := destinationBase + "/TestWatchMountsFileForSymlinkSwap"
+	testMount := synchronizer.Mount{Id: synchronizer.String("first"), Bucket: synchronizer.String(testFakeBucketName), Prefix: synchronizer.String("first")}
+	writeTestMountsFile(t, configDir+"/..first/mounts.json", []synchronizer.Mount{testMount})
+	testMount.Id = synchronizer.String("second")
+	writeTestMountsFile(t, configDir+"/..second/mounts.json", []synchronizer.Mount{testMount})
+	if err := os.Symlink("..first", configDir+"/..data"); err != nil {
+		t.Fatalf("Could not create symlink for testing: %v", err)
+	}
+	mountsFile := configDir + "/mounts.json"
+	if err := os.Symlink("..data/mounts.json", mountsFile); err != nil {
+		t.Fatalf("Could not create symlink for testing: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloadedCh := make(chan []synchronizer.Mount, 1)
+
+	// ---- Run code under test ----
+	go watchMountsFile(ctx, mountsFile, -1, func(mounts []synchronizer.Mount) {
+		reloadedCh <- mounts
+	}, debug)
+	// Give the watcher time to start watching the directory
+	time.Sleep(500 * time.Millisecond)
+	if err := os.Symlink("..second", configDir+"/..data_tmp"); err != nil {
+		t.Fatalf("Could not create symlink for testing: %v", err)
+	}
+	if err := os.Rename(configDir+"/..data_tmp", configDir+"/..data"); err != nil {
+		t.Fatalf("Could not swap symlink for testing: %v", err)
+	}
+
+	// ---- Assertions ----
+	select {
+	case mounts := <-reloadedCh:
+		if len(mounts) != 1 || *mounts[0].Id != "second" {
+			t.Errorf("ASSERT_FAILURE: Expected: The mounts of the swapped file | Actual: %v", mounts)
+		}
+	case <-time.After(mountsFileReloadDelay + 5*time.Second):
+		t.Errorf("ASSERT_FAILURE: Expected: The mounts to be reloaded | Actual: Not reloaded")
+	}
+}
+
+// Test for single writeable S3Mount with recurring downloads (i.e., bi-directional sync)
+// - Make sure S3 --> Local sync works correctly
+//   - Make sure S3 ADDs are synced to local automatically
+//   - Make sure S3 UPDATEs are synced to local automatically
+//   - Make sure S3 DELETEs are synced to local automatically
 //
-//- Make sure Local --> S3 sync works correctly
-//  - Make sure local ADDs are synced to S3 automatically
-//	 - Make sure local UPDATEs are synced to S3 automatically
-//	 - Make sure local DELETEs are synced to S3 automatically
-//	 - Make sure local RENAMEs are synced to S3 automatically
+// - Make sure Local --> S3 sync works correctly
+//   - Make sure local ADDs are synced to S3 automatically
+//   - Make sure local UPDATEs are synced to S3 automatically
+//   - Make sure local DELETEs are synced to S3 automatically
+//   - Make sure local RENAMEs are synced to S3 automatically
 func TestMainImplForBiDirectionalSyncSingleMount(t *testing.T) {
 	// ---- Data setup ----
 	noOfMounts := 1
-	testMounts := make([]s3Mount, noOfMounts)
+	testMounts := make([]synchronizer.Mount, noOfMounts)
 	testMountId := "TestMainImplForBiDirectionalSyncSingleMount"
 	noOfFilesInMount := 5
 	testMounts[0] = *putWriteableTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
@@ -469,7 +905,21 @@ func TestMainImplForBiDirectionalSyncSingleMount(t *testing.T) {
 	go func() {
 
 		// ---- Run code under test ----
-		err = mainImpl(testAwsSession, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, stopUploadWatchersAfter, concurrency, testMountsJson, destinationBase)
+		err = mainImpl(context.Background(), programConfig{
+			options: synchronizer.Options{
+				Session:                     testAwsSession,
+				Destination:                 destinationBase,
+				Debug:                       debug,
+				Concurrency:                 concurrency,
+				ObjectConcurrency:           objectConcurrency,
+				MaxConcurrentObjects:        maxConcurrentObjects,
+				RecurringDownloads:          recurringDownloads,
+				DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+				StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+				StopUploadWatchersAfter:     time.Duration(stopUploadWatchersAfter) * time.Second,
+			},
+			defaultS3Mounts: testMountsJson,
+		})
 		if err != nil {
 			// Fail test in case of any errors
 			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -650,21 +1100,21 @@ func TestMainImplForBiDirectionalSyncSingleMount(t *testing.T) {
 	wg.Wait() // Wait until all spawned go routines complete before existing the test case
 }
 
-//Test for multiple writeable S3Mounts with recurring downloads (i.e., bi-directional sync)
-//- Make sure S3 --> Local sync works correctly
-//	 - Make sure S3 ADDs are synced to local automatically
-//	 - Make sure S3 UPDATEs are synced to local automatically
-//	 - Make sure S3 DELETEs are synced to local automatically
+// Test for multiple writeable S3Mounts with recurring downloads (i.e., bi-directional sync)
+// - Make sure S3 --> Local sync works correctly
+//   - Make sure S3 ADDs are synced to local automatically
+//   - Make sure S3 UPDATEs are synced to local automatically
+//   - Make sure S3 DELETEs are synced to local automatically
 //
-//- Make sure Local --> S3 sync works correctly
-//  - Make sure local ADDs are synced to S3 automatically
-//	 - Make sure local UPDATEs are synced to S3 automatically
-//	 - Make sure local DELETEs are synced to S3 automatically
-//	 - Make sure local RENAMEs are synced to S3 automatically
+// - Make sure Local --> S3 sync works correctly
+//   - Make sure local ADDs are synced to S3 automatically
+//   - Make sure local UPDATEs are synced to S3 automatically
+//   - Make sure local DELETEs are synced to S3 automatically
+//   - Make sure local RENAMEs are synced to S3 automatically
 func TestMainImplForBiDirectionalSyncMultipleMounts(t *testing.T) {
 	// ---- Data setup ----
 	noOfMounts := 3
-	testMounts := make([]s3Mount, noOfMounts)
+	testMounts := make([]synchronizer.Mount, noOfMounts)
 
 	testMountId1 := "TestMainImplForBiDirectionalSyncMultipleMounts1"
 	noOfFilesInMount1 := 5
@@ -702,7 +1152,21 @@ func TestMainImplForBiDirectionalSyncMultipleMounts(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		// ---- Run code under test ----
-		err = mainImpl(testAwsSession, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, stopUploadWatchersAfter, concurrency, testMountsJson, destinationBase)
+		err = mainImpl(context.Background(), programConfig{
+			options: synchronizer.Options{
+				Session:                     testAwsSession,
+				Destination:                 destinationBase,
+				Debug:                       debug,
+				Concurrency:                 concurrency,
+				ObjectConcurrency:           objectConcurrency,
+				MaxConcurrentObjects:        maxConcurrentObjects,
+				RecurringDownloads:          recurringDownloads,
+				DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+				StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+				StopUploadWatchersAfter:     time.Duration(stopUploadWatchersAfter) * time.Second,
+			},
+			defaultS3Mounts: testMountsJson,
+		})
 		if err != nil {
 			// Fail test in case of any errors
 			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -916,6 +1380,116 @@ func TestMainImplForBiDirectionalSyncMultipleMounts(t *testing.T) {
 	wg.Wait() // Wait until all spawned go routines complete before existing the test case
 }
 
+// ######### Tests for the hydrate command #########
+
+// Test for a mount in cache mode
+// - Make sure the files that do not fit in the cache are left as empty placeholders
+// - Make sure the hydrate command downloads a placeholder and waits until it is downloaded
+func TestHydrateImpl(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestHydrateImpl"
+	noOfFilesInMount := 5
+	testMount := *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+	// Each test file has 30 bytes, so only 2 files fit in the cache
+	cacheBytes := int64(70)
+	testMount.CacheBytes = &cacheBytes
+	testMountsJsonBytes, err := json.Marshal([]synchronizer.Mount{testMount})
+	if err != nil {
+		t.Fatalf("Error creating test mount setup data %s", err)
+	}
+	testMountsJson := string(testMountsJsonBytes)
+
+	// ---- Inputs ----
+	concurrency := 2
+	recurringDownloads := true
+	stopRecurringDownloadsAfter := 10
+	downloadInterval := 1
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// ---- Run code under test ----
+		err := mainImpl(context.Background(), programConfig{
+			options: synchronizer.Options{
+				Session:                     testAwsSession,
+				Destination:                 destinationBase,
+				Debug:                       debug,
+				Concurrency:                 concurrency,
+				ObjectConcurrency:           objectConcurrency,
+				MaxConcurrentObjects:        maxConcurrentObjects,
+				RecurringDownloads:          recurringDownloads,
+				DownloadInterval:            time.Duration(downloadInterval) * time.Second,
+				StopRecurringDownloadsAfter: time.Duration(stopRecurringDownloadsAfter) * time.Second,
+			},
+			defaultS3Mounts: testMountsJson,
+		})
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}()
+
+	// Wait for the initial download
+	time.Sleep(3 * time.Second)
+
+	var placeholders []string
+	for i := 0; i < noOfFilesInMount; i++ {
+		file := fmt.Sprintf("%s/%s/test%d.txt", destinationBase, testMountId, i)
+		if info, err := os.Stat(file); err == nil && info.Size() == 0 {
+			placeholders = append(placeholders, file)
+		}
+	}
+
+	// ---- Assertions ----
+	if len(placeholders) != noOfFilesInMount-2 {
+		t.Errorf("ASSERT_FAILURE: Expected: %v placeholders | Actual: %v placeholders", noOfFilesInMount-2, len(placeholders))
+	}
+	if len(placeholders) > 0 {
+		// ---- Run code under test ----
+		err := hydrateImpl(placeholders[:1], 5*time.Second, 100*time.Millisecond)
+
+		// ---- Assertions ----
+		if err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: The placeholder to be hydrated | Actual: %v", err)
+		}
+		if info, err := os.Stat(placeholders[0]); err != nil || info.Size() == 0 {
+			t.Errorf("ASSERT_FAILURE: Expected: %v to be downloaded | Actual: The file is still empty", placeholders[0])
+		}
+		if _, err := os.Stat(placeholders[0] + synchronizer.HydrationMarkerSuffix); !os.IsNotExist(err) {
+			t.Errorf("ASSERT_FAILURE: Expected: The hydration marker to be deleted | Actual: The marker still exists")
+		}
+	}
+
+	// The command fails when the synchronizer does not process the marker in time
+	wg.Wait()
+	if len(placeholders) > 1 {
+		err := hydrateImpl(placeholders[1:2], 500*time.Millisecond, 100*time.Millisecond)
+		if err == nil {
+			t.Errorf("ASSERT_FAILURE: Expected: The hydrate command to time out without a running synchronizer | Actual: No error")
+		}
+	}
+}
+
+// ######### Tests for the lock command #########
+
+// Negative test: Test that the lock command fails for a mount that is not in the mounts
+func TestLockImplUnknownMount(t *testing.T) {
+	// ---- Inputs ----
+	testMountsJson := `[{"id":"some-id","bucket":"some-bucket","prefix":"some/s3/prefix/path"}]`
+	lockfile := destinationBase + "/TestLockImplUnknownMount.lock.json"
+
+	// ---- Run code under test ----
+	err := lockImpl(testAwsSession, debug, testMountsJson, "", destinationBase, "other-id", lockfile)
+
+	// ---- Assertions ----
+	if err == nil || !strings.Contains(err.Error(), `mount "other-id" not found`) {
+		t.Errorf("ASSERT_FAILURE: Expected: Error for the unknown mount | Actual: %v", err)
+	}
+	if _, err := os.Stat(lockfile); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: No lockfile written | Actual: %v", err)
+	}
+}
+
 // ------------------------------- Setup code -------------------------------/
 
 // The main testing function that calls setup and shutdown and runs each test defined in this test file
@@ -926,15 +1500,15 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-func putReadOnlyTestMountFiles(t *testing.T, bucketName string, testMountId string, noOfFiles int) *s3Mount {
+func putReadOnlyTestMountFiles(t *testing.T, bucketName string, testMountId string, noOfFiles int) *synchronizer.Mount {
 	return putTestMountFiles(t, bucketName, testMountId, noOfFiles, false)
 }
 
-func putWriteableTestMountFiles(t *testing.T, bucketName string, testMountId string, noOfFiles int) *s3Mount {
+func putWriteableTestMountFiles(t *testing.T, bucketName string, testMountId string, noOfFiles int) *synchronizer.Mount {
 	return putTestMountFiles(t, bucketName, testMountId, noOfFiles, true)
 }
 
-func putTestMountFiles(t *testing.T, bucketName string, testMountId string, noOfFiles int, writeable bool) *s3Mount {
+func putTestMountFiles(t *testing.T, bucketName string, testMountId string, noOfFiles int, writeable bool) *synchronizer.Mount {
 	s3Client := s3.New(testAwsSession)
 
 	mountPrefix := fmt.Sprintf("studies/Organization/%s", testMountId)
@@ -950,7 +1524,29 @@ func putTestMountFiles(t *testing.T, bucketName string, testMountId string, noOf
 		}
 	}
 	kmsKeyId := ""
-	return &s3Mount{Id: &testMountId, Bucket: &bucketName, Prefix: &mountPrefix, Writeable: &writeable, KmsKeyId: &kmsKeyId}
+	return &synchronizer.Mount{Id: &testMountId, Bucket: &bucketName, Prefix: &mountPrefix, Writeable: &writeable, KmsKeyId: &kmsKeyId}
+}
+
+func writeTestMountsFile(t *testing.T, mountsFile string, mounts []synchronizer.Mount) {
+	// Ensure the directory exists
+	if _, err := os.Stat(filepath.Dir(mountsFile)); os.IsNotExist(err) {
+		os.MkdirAll(filepath.Dir(mountsFile), os.ModePerm)
+	}
+
+	var content []byte
+	var err error
+	if filepath.Ext(mountsFile) == ".json" {
+		content, err = json.Marshal(mounts)
+	} else {
+		content, err = yaml.Marshal(mounts)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(mountsFile, content, os.ModePerm)
+	}
+	if err != nil {
+		// Fail test in case of any errors
+		t.Errorf("Could not write test mounts file for testing: %v", err)
+	}
 }
 
 func createTestFilesLocally(t *testing.T, testMountId string, noOfFiles int) {
@@ -1192,7 +1788,7 @@ func setup() *httptest.Server {
 
 	createFakeS3BucketForTesting()
 
-	var synchronizerState = NewPersistentSynchronizerState()
+	var synchronizerState = synchronizer.NewPersistentSynchronizerState()
 
 	// Clean synchronizer state from any previous test runs
 	synchronizerState.Clean()
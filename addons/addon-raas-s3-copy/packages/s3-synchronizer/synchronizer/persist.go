@@ -1,4 +1,4 @@
-package main
+package synchronizer
 
 import (
 	"bytes"
@@ -74,26 +74,38 @@ func NewFileBasedPersistenceWithJsonFormat(filePath string, baseDirPath string)
 }
 
 // Save saves a representation of v to the file at path.
-func (persistence fileBasedPersistence) Save(v interface{}) error {
+// The representation is written to a temporary file that replaces the file once written so that the file is never
+// left truncated, e.g., when the program exits in the middle of a save.
+func (persistence *fileBasedPersistence) Save(v interface{}) error {
 	persistence.fileLock.Lock()
 	defer persistence.fileLock.Unlock()
-	f, err := os.Create(persistence.filePath)
+	r, err := persistence.marshaller.marshal(v)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	r, err := persistence.marshaller.marshal(v)
+	tempFilePath := persistence.filePath + ".tmp"
+	f, err := os.Create(tempFilePath)
 	if err != nil {
 		return err
 	}
 	_, err = io.Copy(f, r)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFilePath, persistence.filePath)
+	}
+	if err != nil {
+		os.Remove(tempFilePath)
+	}
 	return err
 }
 
 // Load loads the file at path into v.
 // Use os.IsNotExist() to see if the returned error is due
 // to the file being missing.
-func (persistence fileBasedPersistence) Load(v interface{}) error {
+func (persistence *fileBasedPersistence) Load(v interface{}) error {
 	persistence.fileLock.Lock()
 	defer persistence.fileLock.Unlock()
 	f, err := os.Open(persistence.filePath)
@@ -104,7 +116,7 @@ func (persistence fileBasedPersistence) Load(v interface{}) error {
 	return persistence.marshaller.unmarshal(f, v)
 }
 
-func (persistence fileBasedPersistence) Clean() error {
+func (persistence *fileBasedPersistence) Clean() error {
 	persistence.fileLock.Lock()
 	defer persistence.fileLock.Unlock()
 	err := os.Remove(persistence.filePath)
@@ -0,0 +1,115 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// The storage classes whose objects must be restored before they can be downloaded
+var archiveStorageClasses = map[string]bool{
+	s3.ObjectStorageClassGlacier:     true,
+	s3.ObjectStorageClassDeepArchive: true,
+}
+
+// The retrieval tiers of the restores, see https://docs.aws.amazon.com/AmazonS3/latest/dev/restoring-objects.html
+var restoreTiers = map[string]bool{
+	s3.TierStandard:  true,
+	s3.TierBulk:      true,
+	s3.TierExpedited: true,
+}
+
+// The defaults of the number of days the restored copies are kept and of the retrieval tier of the restores
+const defaultRestoreDays = 1
+const defaultRestoreTier = s3.TierStandard
+
+// Returns whether the given listed object is archived, i.e., in the GLACIER or DEEP_ARCHIVE storage class
+func isArchived(item *s3.Object) bool {
+	return archiveStorageClasses[aws.StringValue(item.StorageClass)]
+}
+
+// The state of the restore of an archived object as reported by the "x-amz-restore" header of the object
+type restoreState int
+
+const (
+	// No restore was requested or the restored copy expired
+	restoreNotRequested restoreState = iota
+	restoreInProgress
+	// The restored copy can be downloaded
+	restoreCompleted
+)
+
+// Parses the given "x-amz-restore" header, e.g., `ongoing-request="false", expiry-date="Fri, 23 Dec 2012 00:00:00 GMT"`
+func parseRestoreHeader(header string) restoreState {
+	switch {
+	case strings.Contains(header, `ongoing-request="true"`):
+		return restoreInProgress
+	case strings.Contains(header, `ongoing-request="false"`):
+		return restoreCompleted
+	default:
+		return restoreNotRequested
+	}
+}
+
+// Checks whether the restored copy of the given archived object can be downloaded and starts a restore of the object
+// if none is in progress. Returns whether the object can be downloaded, the objects that cannot are recorded as
+// archived in the stats and downloaded by a later sync once their restore completes.
+func (s *Synchronizer) prepareArchivedObject(ctx context.Context, svc s3iface.S3API, config *mountConfiguration, item *s3.Object, stats *downloadStats) bool {
+	var resp *s3.HeadObjectOutput
+	err := s.retry(ctx, fmt.Sprintf("Head of '%v'", *item.Key), func() error {
+		var err error
+		resp, err = svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(config.bucket),
+			Key:       item.Key,
+			VersionId: config.snapshot.versionId(*item.Key),
+		})
+		return err
+	})
+	if err != nil {
+		s.logger.Printf("Error getting the restore status of archived object '%v': %v\n", *item.Key, err)
+		stats.recordError(item.Key)
+		return false
+	}
+
+	switch parseRestoreHeader(aws.StringValue(resp.Restore)) {
+	case restoreCompleted:
+		return true
+	case restoreInProgress:
+		if s.debug {
+			s.logger.Printf("The restore of archived object '%v' is in progress\n", *item.Key)
+		}
+		stats.recordArchived(item.Key)
+		return false
+	}
+
+	err = s.retry(ctx, fmt.Sprintf("Restore of '%v'", *item.Key), func() error {
+		_, err := svc.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+			Bucket:    aws.String(config.bucket),
+			Key:       item.Key,
+			VersionId: config.snapshot.versionId(*item.Key),
+			RestoreRequest: &s3.RestoreRequest{
+				Days:                 aws.Int64(config.restoreDays),
+				GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(config.restoreTier)},
+			},
+		})
+		return err
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		// Another client started a restore since the object's status was checked
+		err = nil
+	}
+	if err != nil {
+		s.logger.Printf("Error restoring archived object '%v': %v\n", *item.Key, err)
+		stats.recordError(item.Key)
+		return false
+	}
+	s.logger.Printf("Started the restore of archived object '%v' (%v tier), it is downloaded once the restore completes\n", *item.Key, config.restoreTier)
+	stats.recordArchived(item.Key)
+	stats.recordRestoreStarted()
+	return false
+}
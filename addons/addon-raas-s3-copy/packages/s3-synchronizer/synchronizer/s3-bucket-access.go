@@ -0,0 +1,40 @@
+package synchronizer
+
+import (
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The headers of the S3 calls for requester-pays buckets and for checking the owner of the bucket, the same headers the
+// RequestPayer and ExpectedBucketOwner fields of the S3 inputs are sent as
+const requestPayerHeader = "x-amz-request-payer"
+const expectedBucketOwnerHeader = "x-amz-expected-bucket-owner"
+
+var accountIdRegex = regexp.MustCompile(`^\d{12}$`)
+
+// Returns a copy of the synchronizer's session for a mount with the given settings. The settings are added to every S3
+// call made with the session as headers rather than set on each input so that they also apply to the calls the
+// s3manager makes on our behalf (e.g., the parts of multipart uploads) and to the lookup of the bucket's region.
+// The retries of the SDK are disabled, the failed calls are retried by the synchronizer (see retry) only.
+func (s *Synchronizer) sessionForMount(requesterPays bool, expectedBucketOwner string) *session.Session {
+	sess := s.sess.Copy(&aws.Config{MaxRetries: aws.Int(0)})
+	if !requesterPays && expectedBucketOwner == "" {
+		return sess
+	}
+	sess.Handlers.Build.PushBackNamed(request.NamedHandler{
+		Name: "s3-synchronizer.BucketAccessHandler",
+		Fn: func(r *request.Request) {
+			if requesterPays {
+				r.HTTPRequest.Header.Set(requestPayerHeader, s3.RequestPayerRequester)
+			}
+			if expectedBucketOwner != "" {
+				r.HTTPRequest.Header.Set(expectedBucketOwnerHeader, expectedBucketOwner)
+			}
+		},
+	})
+	return sess
+}
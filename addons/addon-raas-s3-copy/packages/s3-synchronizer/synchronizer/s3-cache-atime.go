@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package synchronizer
+
+import (
+	"os"
+	"time"
+)
+
+// Returns the modification time of the file, the last access time is not available on this platform
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,15 @@
+package synchronizer
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Returns the last access time of the file as recorded by the file system, falls back to the modification time
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,15 @@
+package synchronizer
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Returns the last access time of the file as recorded by the file system, falls back to the modification time
+func accessTime(info os.FileInfo) time.Time {
+	if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, data.LastAccessTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
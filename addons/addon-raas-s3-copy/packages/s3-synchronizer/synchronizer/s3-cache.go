@@ -0,0 +1,291 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// HydrationMarkerSuffix is the suffix of the marker files that ask for the placeholder next to them to be hydrated by
+// the next sync of the mount, e.g., "data.csv.hydrate" hydrates "data.csv". The marker is deleted once processed.
+const HydrationMarkerSuffix = ".hydrate"
+
+func isHydrationMarker(path string) bool {
+	return strings.HasSuffix(path, HydrationMarkerSuffix)
+}
+
+// Keeps track of the resident (i.e., downloaded and not evicted) files of a mount in cache mode so that their total
+// size is kept within the mount's cache budget. The files that do not fit are left as placeholders, empty files with
+// the modification time of the object, that are downloaded again when they are hydrated.
+type fileCache struct {
+	lock   sync.Mutex
+	budget int64
+	// The resident files by their local paths
+	files map[string]cachedFile
+	// The total size of the resident files and of the in-flight downloads
+	bytes int64
+}
+
+type cachedFile struct {
+	key  string
+	size int64
+}
+
+func newFileCache(budget int64) *fileCache {
+	return &fileCache{budget: budget, files: make(map[string]cachedFile)}
+}
+
+// Reserves room for a download of the given size to the given path, returns false if the download does not fit
+// within the budget once it replaces the previous version of the file, if any. The caller must either "commit" or
+// "unreserve" the reserved bytes once the download completes.
+func (cache *fileCache) reserve(path string, size int64) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.bytes-cache.files[path].size+size > cache.budget {
+		return false
+	}
+	cache.bytes += size
+	return true
+}
+
+func (cache *fileCache) unreserve(size int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.bytes -= size
+}
+
+// Records the download of a file for which room was reserved, the downloaded file replaces the previous version of
+// the file, if any
+func (cache *fileCache) commit(path string, key string, size int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if existing, ok := cache.files[path]; ok {
+		cache.bytes -= existing.size
+	}
+	cache.files[path] = cachedFile{key: key, size: size}
+}
+
+// Records a resident file found on the local file system
+func (cache *fileCache) add(path string, key string, size int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if existing, ok := cache.files[path]; ok {
+		cache.bytes -= existing.size
+	}
+	cache.files[path] = cachedFile{key: key, size: size}
+	cache.bytes += size
+}
+
+// Forgets the given file, e.g., when it is evicted or deleted. Does nothing for a nil cache.
+func (cache *fileCache) remove(path string) {
+	if cache == nil {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if existing, ok := cache.files[path]; ok {
+		cache.bytes -= existing.size
+		delete(cache.files, path)
+	}
+}
+
+// Returns whether the given number of bytes fit within the budget in addition to the resident files
+func (cache *fileCache) fits(size int64) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.bytes+size <= cache.budget
+}
+
+// Returns the total size of the resident files and of the in-flight downloads
+func (cache *fileCache) residentBytes() int64 {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.bytes
+}
+
+type evictionCandidate struct {
+	path       string
+	key        string
+	lastAccess time.Time
+}
+
+// Returns the resident files except the given one from the least to the most recently accessed. The files that no
+// longer exist are forgotten.
+func (cache *fileCache) leastRecentlyUsed(exclude string) []evictionCandidate {
+	cache.lock.Lock()
+	candidates := make([]evictionCandidate, 0, len(cache.files))
+	for path, file := range cache.files {
+		if path != exclude {
+			candidates = append(candidates, evictionCandidate{path: path, key: file.key})
+		}
+	}
+	cache.lock.Unlock()
+
+	existing := candidates[:0]
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate.path)
+		if err != nil {
+			cache.remove(candidate.path)
+			continue
+		}
+		candidate.lastAccess = accessTime(info)
+		existing = append(existing, candidate)
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].lastAccess.Before(existing[j].lastAccess) })
+	return existing
+}
+
+// Registers the resident files of the given mount in cache mode, i.e., the files downloaded from S3 that are not
+// evicted, so that they count against the mount's budget
+func (s *Synchronizer) loadCache(config *mountConfiguration) error {
+	return filepath.Walk(config.destination, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || isTempFile(path) || isHydrationMarker(path) {
+			return nil
+		}
+		key := s.fileKey(path, config)
+		if s.state.IsFileDownloadedFromS3(key) && !s.state.IsFileEvicted(key) {
+			config.cache.add(path, key, info.Size())
+		}
+		return nil
+	})
+}
+
+// Replaces the given file with a placeholder that keeps the file's modification time
+func writePlaceholder(path string, mtime time.Time) error {
+	tempFile, err := createTempFile(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = tempFile.Close()
+	if err == nil {
+		err = os.Chtimes(tempFile.Name(), time.Now(), mtime)
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+// Leaves a placeholder for the given object that does not fit in the mount's cache, replacing the previous version
+// of the file, if any
+func (s *Synchronizer) leavePlaceholder(config *mountConfiguration, destFilePath string, item *s3.Object) {
+	if err := writePlaceholder(destFilePath, aws.TimeValue(item.LastModified)); err != nil {
+		s.logger.Printf("Error creating the placeholder of '%v': %v\n", *item.Key, err)
+		return
+	}
+	if s.debug {
+		s.logger.Printf("The cache of mount %v is full, left a placeholder for '%v'\n", config.id, *item.Key)
+	}
+	config.cache.remove(destFilePath)
+	s.state.RecordFileDownloadToLocal(item)
+	s.state.RecordFileEviction(*item.Key)
+}
+
+// Evicts the least recently used resident files of the mount (except the given one) until the given number of bytes
+// fit within the mount's cache budget. Returns whether they fit.
+func (s *Synchronizer) evictLeastRecentlyUsed(config *mountConfiguration, size int64, exclude string, stats *downloadStats) bool {
+	cache := config.cache
+	if cache.fits(size) {
+		return true
+	}
+	for _, candidate := range cache.leastRecentlyUsed(exclude) {
+		info, err := os.Stat(candidate.path)
+		if err != nil {
+			cache.remove(candidate.path)
+			continue
+		}
+		if err := writePlaceholder(candidate.path, info.ModTime()); err != nil {
+			s.logger.Printf("Error evicting '%v': %v\n", candidate.path, err)
+			continue
+		}
+		if s.debug {
+			s.logger.Printf("Evicted '%v' from the cache of mount %v\n", candidate.path, config.id)
+		}
+		cache.remove(candidate.path)
+		s.state.RecordFileEviction(candidate.key)
+		stats.recordEviction()
+		if cache.fits(size) {
+			return true
+		}
+	}
+	return cache.fits(size)
+}
+
+// Hydrates the placeholders marked with the given marker files, making room in the mount's cache by evicting the least
+// recently used files. The markers are deleted once processed.
+func (s *Synchronizer) hydrateMarkedFiles(ctx context.Context, config *mountConfiguration, markers []string, stats *downloadStats) {
+	if len(markers) == 0 {
+		return
+	}
+	downloader := s.newDownloader(config)
+	for _, marker := range markers {
+		if ctx.Err() != nil {
+			// The markers left behind are processed by the next sync
+			return
+		}
+		err := s.hydrateFile(ctx, downloader, config, strings.TrimSuffix(marker, HydrationMarkerSuffix), stats)
+		if err != nil {
+			s.logger.Printf("Error hydrating '%v': %v\n", strings.TrimSuffix(marker, HydrationMarkerSuffix), err)
+		}
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			s.logger.Printf("Error deleting the hydration marker '%v': %v\n", marker, err)
+		}
+	}
+}
+
+// Downloads the object of the given placeholder again. The files that are not placeholders are left as is.
+func (s *Synchronizer) hydrateFile(ctx context.Context, downloader *s3manager.Downloader, config *mountConfiguration, path string, stats *downloadStats) error {
+	if _, err := os.Stat(path); err != nil || !s.state.IsFileEvicted(s.fileKey(path, config)) {
+		if s.debug {
+			s.logger.Printf("'%v' is not a placeholder, nothing to hydrate\n", path)
+		}
+		return nil
+	}
+	// The object is downloaded from its own key rather than the normalized key of the file, like the uploads
+	key := s.uploadKey(s.fileKey(path, config))
+
+	var resp *s3.HeadObjectOutput
+	err := s.retry(ctx, fmt.Sprintf("Head of '%v'", key), func() error {
+		var err error
+		resp, err = downloader.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(config.bucket),
+			Key:       aws.String(key),
+			VersionId: config.snapshot.versionId(key),
+		})
+		return err
+	})
+	if err != nil {
+		stats.recordError(aws.String(key))
+		return err
+	}
+	item := &s3.Object{
+		Key:          aws.String(key),
+		ETag:         resp.ETag,
+		Size:         resp.ContentLength,
+		LastModified: resp.LastModified,
+	}
+
+	if !s.evictLeastRecentlyUsed(config, *item.Size, path, stats) || !config.cache.reserve(path, *item.Size) {
+		stats.recordError(item.Key)
+		return fmt.Errorf("the object has %d bytes, it does not fit in the cache budget of %d bytes", *item.Size, config.cache.budget)
+	}
+	if !s.fetchObject(ctx, downloader, item, config, path, stats) {
+		config.cache.unreserve(*item.Size)
+		return fmt.Errorf("the download failed")
+	}
+	config.cache.commit(path, key, *item.Size)
+	stats.recordHydration()
+	return nil
+}
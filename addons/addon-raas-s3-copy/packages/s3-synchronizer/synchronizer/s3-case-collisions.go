@@ -0,0 +1,217 @@
+package synchronizer
+
+import (
+	"hash/fnv"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Resolves the keys of a mount whose local paths differ only in case (e.g., "Data/a.csv" and "data/a.csv"), which map
+// to the same file on case-insensitive file systems. The names are compared one path segment at a time: the spelling
+// of a name seen first keeps the name and the other spellings are suffixed with the quote character U+201B, a "~"
+// and their number in the order they are seen (e.g., "data‛~2"), before the extension of the name if any. The local
+// paths of the suffixed keys are recorded in the state per mount (see SynchronizerState.RecordLocalPath) and the names
+// of the mount's local files are claimed before the objects are listed (see claim), so that a file keeps its name when
+// a colliding key shows up later, whatever the order of the keys. The suffixes of the recorded local paths are dropped
+// when the files are mapped back to their keys (see Synchronizer.fileKey) so that the files uploaded from writeable
+// mounts keep their original keys, the files created locally keep their names even if they look suffixed.
+
+// Whether the local file system is case-insensitive, the default on Windows and macOS. A variable so that the tests can
+// check the collisions on all platforms.
+var caseInsensitiveFileNames = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+// The marker of the case-collision suffix, it follows U+201B
+const caseSuffixMarker = '~'
+
+// The spellings of the local paths listed by a sync. Only the hashes of the paths are kept so that the memory used
+// stays small for large mounts. Not safe for concurrent use, see syncS3ToLocal.
+type caseCollisions struct {
+	// The hash of the spelling of the name seen first by the hash of the case-folded path
+	spellings map[uint64]uint64
+	// The hashes of the spellings of the colliding names by their number minus one by the hash of the case-folded path,
+	// only for the paths with collisions
+	variants map[uint64][]uint64
+}
+
+// Returns the detector of the collisions of a sync, nil when the local file system is case-sensitive
+func newCaseCollisions() *caseCollisions {
+	if !caseInsensitiveFileNames {
+		return nil
+	}
+	return &caseCollisions{spellings: make(map[uint64]uint64), variants: make(map[uint64][]uint64)}
+}
+
+// Returns the given local path (with forward slashes) case-folded when the local file system is case-insensitive, i.e.,
+// the paths of the same file map to the same value. Used to compare the local files with the listed objects.
+func foldCase(localPath string) string {
+	if !caseInsensitiveFileNames {
+		return localPath
+	}
+	return strings.ToUpper(localPath)
+}
+
+// Records the names of the given local path (with forward slashes) of a file downloaded by a previous sync so that they
+// keep their spelling and number when they are resolved. The names of a recorded local path are suffixed if they
+// collided, the names of the other local files are claimed as they are. The names already taken by another spelling
+// are left to the resolution of their key. Does nothing on a nil detector.
+func (c *caseCollisions) claim(localPath string, suffixed bool) {
+	if c == nil {
+		return
+	}
+	folded := ""
+	for _, name := range strings.Split(localPath, "/") {
+		parent := folded
+		// The names below a suffixed name are compared within the suffixed directory, see resolve
+		folded = parent + "/" + strings.ToUpper(name)
+		base, n := name, 1
+		if suffixed {
+			base, n = splitCaseSuffix(name)
+		}
+		foldedHash := hashString(parent + "/" + strings.ToUpper(base))
+		spellingHash := hashString(base)
+
+		// The zero hash stands for the numbers that are not claimed (yet)
+		first, ok := c.spellings[foldedHash]
+		if n == 1 {
+			if !ok || first == 0 {
+				c.spellings[foldedHash] = spellingHash
+				if variants, hasVariants := c.variants[foldedHash]; hasVariants {
+					variants[0] = spellingHash
+				}
+			}
+			continue
+		}
+		variants, hasVariants := c.variants[foldedHash]
+		if !hasVariants {
+			variants = []uint64{first}
+		}
+		for len(variants) < n {
+			variants = append(variants, 0)
+		}
+		if variants[n-1] == 0 {
+			variants[n-1] = spellingHash
+		}
+		c.spellings[foldedHash] = variants[0]
+		c.variants[foldedHash] = variants
+	}
+}
+
+// Returns the local path (with forward slashes) of the given local path of a key once the names colliding with the
+// names seen before are suffixed, and whether any name was suffixed. The paths are returned unchanged by a nil
+// detector.
+func (c *caseCollisions) resolve(localPath string) (string, bool) {
+	if c == nil {
+		return localPath, false
+	}
+	names := strings.Split(localPath, "/")
+	// The case-folded path of the names resolved so far
+	folded := ""
+	suffixed := false
+	for i, name := range names {
+		parent := folded
+		folded = parent + "/" + strings.ToUpper(name)
+		foldedHash := hashString(folded)
+		spellingHash := hashString(name)
+
+		first, ok := c.spellings[foldedHash]
+		if !ok {
+			c.spellings[foldedHash] = spellingHash
+			continue
+		}
+		if first == spellingHash {
+			continue
+		}
+		variants, ok := c.variants[foldedHash]
+		if !ok {
+			variants = []uint64{first}
+		}
+		n := 0
+		for n < len(variants) && variants[n] != spellingHash {
+			n++
+		}
+		if n == len(variants) {
+			c.variants[foldedHash] = append(variants, spellingHash)
+		}
+		names[i] = withCaseSuffix(name, n+1)
+		suffixed = true
+		// The names below the suffixed name are compared within the suffixed directory
+		folded = parent + "/" + strings.ToUpper(names[i])
+	}
+	return strings.Join(names, "/"), suffixed
+}
+
+// Returns the given local name without its case-collision suffix (see withCaseSuffix) and the number of the suffix, 1
+// for a name without suffix
+func splitCaseSuffix(name string) (string, int) {
+	base, end := splitNameEnd(name)
+	marker := strings.LastIndex(base, string([]rune{keyQuote, caseSuffixMarker}))
+	if marker < 0 {
+		return name, 1
+	}
+	digits := base[marker+utf8.RuneLen(keyQuote)+1:]
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return name, 1
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 2 {
+		return name, 1
+	}
+	return base[:marker] + end, n
+}
+
+// Returns the 64-bit FNV-1a hash of the given string
+func hashString(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	return hash.Sum64()
+}
+
+// Returns the given local name with the case-collision suffix of the given number, before the extension of the name
+// and the continuation character of a split name (see encodeName)
+func withCaseSuffix(name string, n int) string {
+	base, end := splitNameEnd(name)
+	return base + string(keyQuote) + string(caseSuffixMarker) + strconv.Itoa(n) + end
+}
+
+// Returns the given local name split before its extension and the continuation character of a split name, where the
+// case-collision suffix goes
+func splitNameEnd(name string) (string, string) {
+	base, end := name, ""
+	if _, continued := decodeName(name, encodeForWindows); continued {
+		base, end = strings.TrimSuffix(name, string(keyQuote)), string(keyQuote)
+	}
+	if dot := strings.LastIndexByte(base, '.'); dot > 0 {
+		base, end = base[:dot], base[dot:]+end
+	}
+	return base, end
+}
+
+// Returns the given local path (relative to the destination of the given mount, with forward slashes) with the names
+// suffixed by the syncs of the mount replaced by the names of their keys, i.e., the local path of the keys before the
+// resolution of the collisions. Only the suffixed names of the local paths recorded in the state are replaced.
+func (s *Synchronizer) unsuffixedLocalPath(localPath string, config *mountConfiguration) string {
+	if !strings.Contains(localPath, string([]rune{keyQuote, caseSuffixMarker})) {
+		return localPath
+	}
+	names := strings.Split(localPath, "/")
+	unsuffixed := append([]string(nil), names...)
+	// The recorded keys are normalized, see normalizedState
+	scope := normalizeUnicode(mountStateKey(config.bucket, config.id, ""), config.normalization)
+	for stateKey, recordedPath := range s.state.LocalPaths(scope) {
+		relPath, err := relativePathForKey(strings.TrimPrefix(stateKey, scope), config.prefix, config.normalization)
+		if err != nil {
+			continue
+		}
+		recorded := strings.Split(recordedPath, "/")
+		encoded := strings.Split(relPath, "/")
+		if len(recorded) != len(encoded) {
+			continue
+		}
+		for i := 0; i < len(recorded) && i < len(names) && recorded[i] == names[i]; i++ {
+			unsuffixed[i] = encoded[i]
+		}
+	}
+	return strings.Join(unsuffixed, "/")
+}
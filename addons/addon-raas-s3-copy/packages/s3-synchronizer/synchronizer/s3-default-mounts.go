@@ -0,0 +1,83 @@
+package synchronizer
+
+import "encoding/json"
+
+// GetDefaultMounts is a function that returns default S3 mounts information based on the given "defaultS3Mounts"
+// The "defaultS3Mounts" is expected to be in valid JSON Array format with each array element containing the following attributes
+// 	id: A unique identifier of
+//	bucket: Name of the S3 bucket to load data from
+//	prefix: The S3 prefix path to load data from
+//	writeable: Optional boolean flag indicating if the specified S3 prefix location should be treated as writeable or READ-only. Default is false.
+//	kmsKeyId: Optional, KMS Key ARN. Default is empty string. NOTE: This attribute is not used by the program at the moment. The program assumes S3 being configured with default server side encryption.
+//	downloadRateLimit: Optional, the maximum download rate of the mount in bytes per second. Default is 0 (unlimited).
+//	uploadRateLimit: Optional, the maximum upload rate of the mount in bytes per second. Default is 0 (unlimited).
+//	maxBytes: Optional, the maximum total size in bytes of the objects downloaded for the mount. Default is 0 (unlimited).
+//	maxObjects: Optional, the maximum number of objects downloaded for the mount. Default is 0 (unlimited).
+//	cacheBytes: Optional, the budget in bytes of the mount's local cache, only for mounts that are not writeable. Default is 0 (not in cache mode).
+//	restoreArchived: Optional boolean flag indicating if the objects in the GLACIER or DEEP_ARCHIVE storage class should be restored and downloaded once restored. Default is false (archived objects are skipped).
+//	restoreDays: Optional, the number of days the restored copies of the archived objects are kept. Default is 1.
+//	restoreTier: Optional, the retrieval tier of the restores, one of Standard, Bulk or Expedited. Default is Standard.
+//	asOf: Optional, pins the mount to the versions of the objects current at the given RFC 3339 time, only for mounts that are not writeable. Default is empty string (the latest versions).
+//	lockfile: Optional, pins the mount to the versions of the objects in the given JSON lockfile of S3 keys vs version ids, only for mounts that are not writeable. Default is empty string (the latest versions).
+//	requesterPays: Optional boolean flag indicating if the bucket is a requester-pays bucket, the S3 calls are then charged to the caller's account. Default is false.
+//	expectedBucketOwner: Optional, the 12-digit AWS account id the bucket must be owned by, the S3 calls fail if the bucket is owned by another account. Default is empty string (not checked).
+// The mounts are validated using "ValidateMounts" and a single error listing all the problems is returned if any of the mounts is invalid
+func GetDefaultMounts(defaultS3Mounts string) (*[]Mount, error) {
+	mounts := make([]Mount, 0)
+
+	err := json.Unmarshal([]byte(defaultS3Mounts), &mounts)
+	if err != nil {
+		return &mounts, err
+	}
+	setMountDefaults(mounts)
+	return &mounts, ValidateMounts(mounts)
+}
+
+// Set defaults for any optional parameters not set in JSON (or YAML)
+func setMountDefaults(mounts []Mount) {
+	for i, mount := range mounts {
+		if mount.Writeable == nil {
+			mounts[i].Writeable = Bool(false)
+		}
+		if mount.KmsKeyId == nil {
+			emptyString := ""
+			mounts[i].KmsKeyId = &emptyString
+		}
+		if mount.DownloadRateLimit == nil {
+			mounts[i].DownloadRateLimit = Int64(0)
+		}
+		if mount.UploadRateLimit == nil {
+			mounts[i].UploadRateLimit = Int64(0)
+		}
+		if mount.MaxBytes == nil {
+			mounts[i].MaxBytes = Int64(0)
+		}
+		if mount.MaxObjects == nil {
+			mounts[i].MaxObjects = Int64(0)
+		}
+		if mount.CacheBytes == nil {
+			mounts[i].CacheBytes = Int64(0)
+		}
+		if mount.RestoreArchived == nil {
+			mounts[i].RestoreArchived = Bool(false)
+		}
+		if mount.RestoreDays == nil {
+			mounts[i].RestoreDays = Int64(defaultRestoreDays)
+		}
+		if mount.RestoreTier == nil {
+			mounts[i].RestoreTier = String(defaultRestoreTier)
+		}
+		if mount.AsOf == nil {
+			mounts[i].AsOf = String("")
+		}
+		if mount.Lockfile == nil {
+			mounts[i].Lockfile = String("")
+		}
+		if mount.RequesterPays == nil {
+			mounts[i].RequesterPays = Bool(false)
+		}
+		if mount.ExpectedBucketOwner == nil {
+			mounts[i].ExpectedBucketOwner = String("")
+		}
+	}
+}
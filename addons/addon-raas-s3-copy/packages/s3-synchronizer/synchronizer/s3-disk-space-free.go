@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package synchronizer
+
+import "syscall"
+
+// Returns the number of bytes available to unprivileged users on the file system of the given path
+func availableDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Returns the total number of bytes of the file system of the given path
+func totalDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,227 @@
+package synchronizer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The interval at which the downloads paused for disk space check the free disk space again
+var lowDiskSpaceCheckInterval = 10 * time.Second
+
+// The longest the downloads of a sync stay paused for disk space, the downloads still paused after that are skipped
+// until the next sync
+var lowDiskSpaceMaxPause = 30 * time.Minute
+
+// Returns the number of bytes available on the file system of the given path, replaced by the tests
+var freeDiskSpace = availableDiskSpace
+
+// Returns the total number of bytes of the file system of the given path, replaced by the tests
+var diskCapacity = totalDiskSpace
+
+// Keeps track of the disk space reserved by the in-flight downloads across all mounts so that concurrent downloads
+// do not all count on the same free space. The mounts are assumed to be on the same file system.
+type diskSpaceGuard struct {
+	lock sync.Mutex
+	// The low-disk watermark, the downloads pause rather than leave less free space than this
+	minFreeBytes int64
+	reserved     int64
+}
+
+func newDiskSpaceGuard(minFreeBytes int64) *diskSpaceGuard {
+	return &diskSpaceGuard{minFreeBytes: minFreeBytes}
+}
+
+// Reserves the given number of bytes for a download to the given directory if the download leaves at least the
+// low-disk watermark free. Returns whether the bytes were reserved and the bytes available to new downloads.
+// If the free space cannot be determined the bytes are reserved along with the error.
+func (guard *diskSpaceGuard) tryReserve(dir string, size int64) (bool, int64, error) {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		guard.reserved += size
+		return true, 0, err
+	}
+	available := free - guard.reserved
+	if available-size < guard.minFreeBytes {
+		return false, available, nil
+	}
+	guard.reserved += size
+	return true, available, nil
+}
+
+// Releases the bytes reserved for a download once the download is complete, the downloaded file takes up the space
+func (guard *diskSpaceGuard) release(size int64) {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+	guard.reserved -= size
+}
+
+// Returns the bytes available to new downloads without leaving less free space than the low-disk watermark
+func (guard *diskSpaceGuard) available(dir string) (int64, error) {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return 0, err
+	}
+	return free - guard.reserved - guard.minFreeBytes, nil
+}
+
+// Returns the most bytes the downloads can ever take up on the disk of the given directory, i.e., the capacity of the
+// disk minus the low-disk watermark. The directory does not need to exist yet, the disk of its nearest existing
+// ancestor is used.
+func (guard *diskSpaceGuard) usableCapacity(dir string) (int64, error) {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	capacity, err := diskCapacity(dir)
+	if err != nil {
+		return 0, err
+	}
+	return capacity - guard.minFreeBytes, nil
+}
+
+// Waits until the disk has room for the given object and reserves its size, the caller must release the reserved
+// bytes once the download completes. While waiting, the downloads of the mount are reported as paused (see
+// MountStatus.LowDiskSpace). The objects that can never fit on the disk are not waited for, and the downloads of a
+// sync give up waiting once they have been paused for lowDiskSpaceMaxPause, the objects are reported in the sync's
+// stats then. Returns false if the object is skipped or ctx is cancelled in the meantime.
+func (s *Synchronizer) waitForDiskSpace(ctx context.Context, config *mountConfiguration, dir string, item *s3.Object, stats *downloadStats) bool {
+	size := *item.Size
+	if capacity, err := s.diskSpace.usableCapacity(dir); err == nil && size > capacity {
+		s.logger.Printf("Low disk space: '%v' of mount %v (%d bytes) can never fit on the disk, at most %d bytes can be downloaded while keeping %d bytes free, skipping it\n",
+			*item.Key, config.id, size, capacity, s.diskSpace.minFreeBytes)
+		stats.recordObjectOverDiskSpace(item.Key)
+		return false
+	}
+	paused := false
+	defer func() {
+		if paused && atomic.AddInt32(&config.pausedDownloads, -1) == 0 {
+			s.logger.Println("Resumed the downloads of mount", config.id)
+		}
+	}()
+	for {
+		reserved, available, err := s.diskSpace.tryReserve(dir, size)
+		if err != nil && s.debug {
+			s.logger.Println("Error getting the free disk space of", dir, ":", err)
+		}
+		if reserved {
+			return true
+		}
+		if !paused {
+			paused = true
+			if atomic.AddInt32(&config.pausedDownloads, 1) == 1 {
+				s.logger.Printf("Low disk space: paused the downloads of mount %v, %d bytes available but %d bytes needed while keeping %d bytes free\n",
+					config.id, available, size, s.diskSpace.minFreeBytes)
+			}
+		}
+		wait := time.Until(stats.diskSpacePauseDeadline())
+		if wait <= 0 {
+			s.logger.Printf("Low disk space: skipping '%v' of mount %v until the next sync, the downloads have been paused for %v\n", *item.Key, config.id, lowDiskSpaceMaxPause)
+			stats.recordObjectOverDiskSpace(item.Key)
+			return false
+		}
+		if wait > lowDiskSpaceCheckInterval {
+			wait = lowDiskSpaceCheckInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// Keeps track of the listed objects of a mount admitted within the capacity of the disk of the mount's destination
+// minus the low-disk watermark during a sync, i.e., the most the mount's files can ever take up on the disk. The
+// objects are admitted in the order they are listed like the objects within the quota (see mountQuota), so the objects
+// of a mount larger than the disk are left out before they are queued for download rather than pausing the downloads
+// for good. Not used for mounts in cache mode, their files are bounded by the cache's budget.
+type diskBudget struct {
+	// Negative when there is no limit
+	capacity int64
+	bytes    int64
+	// The number of objects left out
+	objectsOverBudget int
+}
+
+// Returns the disk budget of a sync of the given mount, without limit if the capacity of the disk cannot be determined
+func (s *Synchronizer) newDiskBudget(config *mountConfiguration) *diskBudget {
+	if config.cache != nil {
+		return &diskBudget{capacity: -1}
+	}
+	capacity, err := s.diskSpace.usableCapacity(config.destination)
+	if err != nil {
+		if s.debug {
+			s.logger.Println("Error getting the capacity of the disk of", config.destination, ":", err)
+		}
+		return &diskBudget{capacity: -1}
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &diskBudget{capacity: capacity}
+}
+
+// Returns whether an object of the given size fits within the budget, counting it against the budget if it does
+func (budget *diskBudget) admit(size int64) bool {
+	if budget.capacity >= 0 && budget.bytes+size > budget.capacity {
+		budget.objectsOverBudget++
+		return false
+	}
+	budget.bytes += size
+	return true
+}
+
+// Logs a warning if the estimated bytes the sync still needs to download exceed the available disk space.
+// Returns whether the warning was logged.
+func (s *Synchronizer) warnIfLowDiskSpace(config *mountConfiguration, stats *downloadStats) bool {
+	available, err := s.diskSpace.available(config.destination)
+	if err != nil {
+		return false
+	}
+	stats.lock.Lock()
+	remaining := stats.bytesNeeded - stats.totalRetrievedBytes
+	stats.lock.Unlock()
+	if remaining <= available {
+		return false
+	}
+	s.logger.Printf("Low disk space: the sync of mount %v needs at least %d more bytes but only %d bytes are available while keeping %d bytes free, the downloads pause when the disk is full\n",
+		config.id, remaining, available, s.diskSpace.minFreeBytes)
+	return true
+}
+
+// Keeps track of the listed objects admitted within the quota of a mount during a sync. The objects are admitted in
+// the order they are listed, an object that does not fit is left out but smaller objects listed later may still fit.
+type mountQuota struct {
+	// ZERO means unlimited
+	maxBytes   int64
+	maxObjects int64
+	bytes      int64
+	objects    int64
+	// The number of objects left out
+	objectsOverQuota int
+}
+
+// Returns whether an object of the given size fits within the quota, counting it against the quota if it does
+func (quota *mountQuota) admit(size int64) bool {
+	if (quota.maxObjects > 0 && quota.objects >= quota.maxObjects) || (quota.maxBytes > 0 && quota.bytes+size > quota.maxBytes) {
+		quota.objectsOverQuota++
+		return false
+	}
+	quota.objects++
+	quota.bytes += size
+	return true
+}
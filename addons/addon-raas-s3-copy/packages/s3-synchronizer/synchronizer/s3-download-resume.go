@@ -0,0 +1,231 @@
+package synchronizer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Writes to the file at the given offset, advancing the offset with each write
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// Downloads the given object to a temporary file in the given directory using ranged GETs of "partSize" bytes,
+// "concurrency" parts at a time. The progress is recorded in the synchronizer state after each part so that an
+// interrupted download is resumed from where it stopped instead of from the start, as long as the object's ETag has
+// not changed. The partial data is kept in the temporary file when the download fails, it is discarded when the
+// object changed. Returns the temporary file holding the complete object, the number of bytes downloaded and the
+// headers of the responses needed to set the modification time of the file and to verify its data.
+// The download is throttled to the given rate limiters. The caller must rename the temporary file into place and
+// remove the partial download from the state.
+func (s *Synchronizer) downloadObjectResumable(svc s3iface.S3API, config *mountConfiguration, item *s3.Object, versionId *string, destDirPath string, limiters []*rateLimiter) (string, int64, objectResponseHeaders, error) {
+	bucket := config.bucket
+	key := *item.Key
+	eTag := *item.ETag
+	size := *item.Size
+	partSize := s.options.PartSize
+	// The progress is recorded per mount
+	stateKey := mountStateKey(bucket, config.id, key)
+
+	tempFile, offset, err := s.openPartialDownload(stateKey, eTag, size, destDirPath)
+	if err != nil {
+		return "", 0, objectResponseHeaders{}, err
+	}
+	tempFilePath := absPath(tempFile.Name())
+	if offset > 0 && s.debug {
+		s.logger.Printf("Resuming download of '%v' at byte %d of %d\n", key, offset, size)
+	}
+
+	// The parts are downloaded concurrently and may complete out of order, only the contiguous range of completed
+	// parts from the start of the object is recorded as progress
+	var lock sync.Mutex
+	completedParts := make(map[int64]bool)
+	progress := offset
+	var downloadErr error
+	var headers objectResponseHeaders
+
+	partsCh := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < s.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partStart := range partsCh {
+				partEnd := partStart + partSize - 1
+				if partEnd >= size {
+					partEnd = size - 1
+				}
+				partHeaders, err := s.downloadPart(svc, bucket, key, versionId, eTag, tempFile, partStart, partEnd, limiters)
+
+				lock.Lock()
+				if err != nil {
+					if downloadErr == nil {
+						downloadErr = err
+					}
+					lock.Unlock()
+					continue
+				}
+				completedParts[partStart] = true
+				headers = partHeaders
+				advanced := false
+				for completedParts[progress] {
+					delete(completedParts, progress)
+					progress += partSize
+					if progress > size {
+						progress = size
+					}
+					advanced = true
+				}
+				if advanced {
+					// Make sure the data is on disk before recording it as downloaded
+					if err := tempFile.Sync(); err == nil {
+						s.state.RecordPartialDownload(stateKey, PartialDownload{ETag: eTag, Size: size, TempFile: tempFilePath, Offset: progress})
+					}
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for partStart := offset; partStart < size; partStart += partSize {
+		lock.Lock()
+		failed := downloadErr != nil
+		lock.Unlock()
+		if failed || s.transfersCtx.Err() != nil {
+			break
+		}
+		partsCh <- partStart
+	}
+	close(partsCh)
+	wg.Wait()
+
+	closeErr := tempFile.Close()
+	if downloadErr == nil && s.transfersCtx.Err() != nil {
+		downloadErr = s.transfersCtx.Err()
+	}
+	if downloadErr == nil {
+		downloadErr = closeErr
+	}
+	if downloadErr != nil {
+		if isPreconditionFailed(downloadErr) {
+			// The object changed in S3 during the download, the partial data is of no use
+			s.discardPartialDownload(stateKey, tempFilePath)
+		} else if s.debug {
+			s.logger.Printf("Download of '%v' interrupted at byte %d of %d, it will be resumed with the next sync\n", key, progress, size)
+		}
+		return "", 0, objectResponseHeaders{}, downloadErr
+	}
+	if offset >= size {
+		// All parts were downloaded before the download was interrupted, the headers are needed nonetheless
+		var headersLock sync.Mutex
+		_, err := svc.HeadObjectWithContext(s.transfersCtx, &s3.HeadObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: versionId,
+			IfMatch:   aws.String(eTag),
+		}, captureObjectResponseHeaders(&headers, &headersLock))
+		if err != nil {
+			return "", 0, objectResponseHeaders{}, err
+		}
+	}
+	return tempFilePath, size - offset, headers, nil
+}
+
+// Opens the temporary file of the partial download of the object with the given state key (see mountStateKey) to resume
+// the download, or creates a new temporary file if there is no partial download or its data cannot be used. Returns
+// the file along with the offset to resume the download from.
+func (s *Synchronizer) openPartialDownload(key string, eTag string, size int64, destDirPath string) (*os.File, int64, error) {
+	partialDownload, exists := s.state.PartialDownload(key)
+	if exists {
+		if partialDownload.ETag == eTag && partialDownload.Size == size {
+			fi, err := os.Stat(partialDownload.TempFile)
+			if err == nil && fi.Size() >= partialDownload.Offset && filepath.Dir(partialDownload.TempFile) == absPath(destDirPath) {
+				tempFile, err := os.OpenFile(partialDownload.TempFile, os.O_RDWR, 0666)
+				if err == nil {
+					return tempFile, partialDownload.Offset, nil
+				}
+			}
+		}
+		// The object changed since the partial download or the partial data is gone, start from scratch
+		s.discardPartialDownload(key, partialDownload.TempFile)
+	}
+
+	tempFile, err := createTempFile(destDirPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Record the partial download right away so that the temporary file is not deleted as a stale temporary file
+	s.state.RecordPartialDownload(key, PartialDownload{ETag: eTag, Size: size, TempFile: absPath(tempFile.Name()), Offset: 0})
+	return tempFile, 0, nil
+}
+
+// Deletes the temporary file of the partial download of the object with the given state key (see mountStateKey) and
+// removes its progress from the state
+func (s *Synchronizer) discardPartialDownload(key string, tempFilePath string) {
+	if s.debug {
+		s.logger.Printf("Discarding partial download of '%v'\n", key)
+	}
+	os.Remove(tempFilePath)
+	s.state.RemovePartialDownload(key)
+}
+
+// Downloads the given byte range (inclusive) of the object to the same range of the given file. The download fails
+// with a "PreconditionFailed" error if the object's ETag no longer matches. Returns the headers of the response.
+func (s *Synchronizer) downloadPart(svc s3iface.S3API, bucket string, key string, versionId *string, eTag string, file *os.File, start int64, end int64, limiters []*rateLimiter) (objectResponseHeaders, error) {
+	var headers objectResponseHeaders
+	var headersLock sync.Mutex
+	resp, err := svc.GetObjectWithContext(s.transfersCtx, &s3.GetObjectInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(key),
+		VersionId: versionId,
+		Range:     aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		IfMatch:   aws.String(eTag),
+	}, captureObjectResponseHeaders(&headers, &headersLock))
+	if err != nil {
+		return headers, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(&offsetWriter{file: file, offset: start}, &throttledReader{ctx: s.transfersCtx, r: resp.Body, limiters: limiters})
+	if err != nil {
+		return headers, err
+	}
+	if n != end-start+1 {
+		return headers, fmt.Errorf("downloaded %d bytes of the range %d-%d of '%v'", n, start, end, key)
+	}
+	headersLock.Lock()
+	defer headersLock.Unlock()
+	return headers, nil
+}
+
+func isPreconditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// Returns the absolute representation of the given path, or the path itself if it cannot be made absolute
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
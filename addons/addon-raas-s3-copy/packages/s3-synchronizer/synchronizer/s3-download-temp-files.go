@@ -0,0 +1,76 @@
+package synchronizer
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Objects are downloaded to hidden temporary files named "<tempFilePrefix><random><tempFileSuffix>" in the directory
+// of the destination file and renamed into place once the download completes. This way the destination file is never
+// left truncated or partially written by a failed or interrupted download.
+// The ".tmp" suffix also makes the file watchers ignore the temporary files, see excludeFile.
+const tempFilePrefix = ".s3-synchronizer-"
+const tempFileSuffix = ".tmp"
+
+var tempFileCounter uint32
+
+// Creates a new temporary file to download to in the given directory. The file is created with the same permissions
+// as os.Create would use for the destination file.
+func createTempFile(dir string) (*os.File, error) {
+	for i := 0; ; i++ {
+		random := strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatUint(uint64(atomic.AddUint32(&tempFileCounter, 1)), 36)
+		name := filepath.Join(dir, tempFilePrefix+random+tempFileSuffix)
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return file, err
+	}
+}
+
+// Returns true if the given path is a temporary file created by createTempFile
+func isTempFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, tempFilePrefix) && strings.HasSuffix(name, tempFileSuffix)
+}
+
+// Deletes the temporary files left behind under the destination of the given mount by downloads that were interrupted,
+// e.g., when the program was killed in the middle of a download. The temporary files of the partial downloads of the
+// mount recorded in the synchronizer state are kept so that the downloads can be resumed. The partial downloads with
+// temporary files under the destination that are not recorded for the mount (i.e., recorded by an older version
+// without the mount in their key, see mountStateKey) are removed from the state.
+func (s *Synchronizer) removeStaleTempFiles(config *mountConfiguration) {
+	dir := config.destination
+	mountKeyPrefix := mountStateKey(config.bucket, config.id, "")
+	dirPrefix := absPath(dir) + string(filepath.Separator)
+	partialDownloadFiles := make(map[string]bool)
+	for key, partialDownload := range s.state.PartialDownloads() {
+		if strings.HasPrefix(key, mountKeyPrefix) {
+			partialDownloadFiles[partialDownload.TempFile] = true
+		} else if strings.HasPrefix(partialDownload.TempFile, dirPrefix) {
+			s.state.RemovePartialDownload(key)
+		}
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Nothing to clean up if the directory does not exist yet
+			return nil
+		}
+		if info.Mode().IsRegular() && isTempFile(path) && !partialDownloadFiles[absPath(path)] {
+			if s.debug {
+				s.logger.Println("Deleting stale temporary file", path)
+			}
+			if err := os.Remove(path); err != nil {
+				s.logger.Printf("Error deleting stale temporary file \"%s\". Error: %v\n", path, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Printf("Error cleaning up stale temporary files under \"%s\". Error: %v\n", dir, err)
+	}
+}
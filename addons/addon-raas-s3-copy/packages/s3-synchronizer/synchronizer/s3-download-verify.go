@@ -0,0 +1,303 @@
+package synchronizer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// The number of times an object is downloaded before giving up when the downloaded data does not match the object
+const maxIntegrityAttempts = 3
+
+// The headers of the GET object responses needed once the object has been downloaded
+type objectResponseHeaders struct {
+	// The value of the "mtime" user metadata, see mtimeMetadataKey
+	metadataMtime string
+	// The server side encryption of the object, the ETag of objects encrypted with SSE-KMS or SSE-C is not the MD5
+	// digest of the data
+	serverSideEncryption string
+	sseCustomerAlgorithm string
+	// The additional checksums of the object (base64 encoded), only returned for objects uploaded with checksums
+	checksumSHA256 string
+	checksumCRC32C string
+	// The size of the first part of objects uploaded in parts, ZERO if unknown, see firstPartSize
+	partSize int64
+}
+
+// Returns a request option that asks S3 for the object's additional checksums and captures the headers of the
+// successful response in the given struct. The SDK version in use does not model the checksum headers.
+func captureObjectResponseHeaders(headers *objectResponseHeaders, lock *sync.Mutex) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error != nil || r.HTTPResponse == nil {
+				return
+			}
+			h := r.HTTPResponse.Header
+			lock.Lock()
+			defer lock.Unlock()
+			*headers = objectResponseHeaders{
+				metadataMtime:        h.Get("X-Amz-Meta-" + mtimeMetadataKey),
+				serverSideEncryption: h.Get("X-Amz-Server-Side-Encryption"),
+				sseCustomerAlgorithm: h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"),
+				checksumSHA256:       h.Get("X-Amz-Checksum-Sha256"),
+				checksumCRC32C:       h.Get("X-Amz-Checksum-Crc32c"),
+			}
+		})
+	}
+}
+
+// Returned when the downloaded data does not match the object in S3
+type integrityError struct {
+	key    string
+	reason string
+}
+
+func (e *integrityError) Error() string {
+	return fmt.Sprintf("the downloaded data of '%v' does not match the object in S3: %v", e.key, e.reason)
+}
+
+func isIntegrityError(err error) bool {
+	_, ok := err.(*integrityError)
+	return ok
+}
+
+// Computes the ETag S3 assigns to an object uploaded in parts of "partSize" bytes, i.e., the MD5 digest of the
+// concatenated MD5 digests of the parts followed by "-<number of parts>"
+type multipartETagHasher struct {
+	partSize    int64
+	written     int64
+	part        hash.Hash
+	partDigests []byte
+	parts       int
+}
+
+func newMultipartETagHasher(partSize int64) *multipartETagHasher {
+	return &multipartETagHasher{partSize: partSize, part: md5.New()}
+}
+
+func (h *multipartETagHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if remaining := h.partSize - h.written; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		h.part.Write(chunk)
+		h.written += int64(len(chunk))
+		p = p[len(chunk):]
+		if h.written == h.partSize {
+			h.finishPart()
+		}
+	}
+	return n, nil
+}
+
+func (h *multipartETagHasher) finishPart() {
+	h.partDigests = h.part.Sum(h.partDigests)
+	h.part.Reset()
+	h.written = 0
+	h.parts++
+}
+
+func (h *multipartETagHasher) eTag() string {
+	if h.written > 0 || h.parts == 0 {
+		h.finishPart()
+	}
+	return fmt.Sprintf("%x-%d", md5.Sum(h.partDigests), h.parts)
+}
+
+// Returns the number of parts of the given multipart ETag ("<digest>-<number of parts>"), ZERO for other ETags
+func multipartETagParts(eTag string) int {
+	i := strings.LastIndex(eTag, "-")
+	if i < 0 {
+		return 0
+	}
+	parts, err := strconv.Atoi(strings.Trim(eTag[i+1:], `"`))
+	if err != nil {
+		return 0
+	}
+	return parts
+}
+
+// Returns the size of the first part of the given object (or the given version of the object if not nil) if it was
+// uploaded in parts, the part size needed to compute its multipart ETag. Returns ZERO if the object was not uploaded in
+// parts or the part size cannot be found, e.g., when S3 ignores the part number.
+func (s *Synchronizer) firstPartSize(svc s3iface.S3API, bucket string, item *s3.Object, versionId *string) int64 {
+	if item.ETag == nil || item.Size == nil {
+		return 0
+	}
+	parts := multipartETagParts(*item.ETag)
+	if parts < 2 {
+		return 0
+	}
+	var head *s3.HeadObjectOutput
+	err := s.retry(s.transfersCtx, fmt.Sprintf("Lookup of the part size of '%v'", *item.Key), func() error {
+		var err error
+		head, err = svc.HeadObjectWithContext(s.transfersCtx, &s3.HeadObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        item.Key,
+			VersionId:  versionId,
+			PartNumber: aws.Int64(1),
+		})
+		return err
+	})
+	if err != nil {
+		if s.debug {
+			s.logger.Printf("Cannot find the part size of '%v': %v\n", *item.Key, err)
+		}
+		return 0
+	}
+	partSize := aws.Int64Value(head.ContentLength)
+	if partSize < 1 || (head.PartsCount != nil && *head.PartsCount != int64(parts)) || (*item.Size+partSize-1)/partSize != int64(parts) {
+		return 0
+	}
+	return partSize
+}
+
+// Returns the part sizes an object of the given size uploaded in the given number of parts may have been uploaded
+// with when the actual part size is unknown (see firstPartSize). S3 does not record the part size, so the part size
+// the uploads of this program use (the s3manager default), the AWS CLI defaults and the smallest part size in MiB
+// that results in the given number of parts are tried.
+func multipartPartSizeCandidates(size int64, parts int) []int64 {
+	if parts < 1 || size < 1 {
+		return nil
+	}
+	if parts == 1 {
+		return []int64{size}
+	}
+	const mib = 1024 * 1024
+	sizes := []int64{s3manager.DefaultUploadPartSize, 8 * mib, 16 * mib}
+	// The s3manager uploader increases the part size for objects that would have too many parts
+	if size/s3manager.DefaultUploadPartSize >= s3manager.MaxUploadParts {
+		sizes = append(sizes, size/s3manager.MaxUploadParts+1)
+	}
+	minPartSize := (size + int64(parts) - 1) / int64(parts)
+	sizes = append(sizes, (minPartSize+mib-1)/mib*mib)
+
+	candidates := make([]int64, 0, len(sizes))
+	seen := make(map[int64]bool)
+	for _, partSize := range sizes {
+		if seen[partSize] || (size+partSize-1)/partSize != int64(parts) {
+			continue
+		}
+		seen[partSize] = true
+		candidates = append(candidates, partSize)
+	}
+	return candidates
+}
+
+// Verifies the downloaded file at the given path against the object's ETag and, when present, its SHA-256 and
+// CRC32C checksums. Returns an integrityError if the data does not match. Objects whose ETag is not a digest of the
+// data (e.g., encrypted with SSE-KMS) are verified against the checksums only, as are the objects uploaded in parts
+// whose part size is unknown (see objectResponseHeaders.partSize) unless one of the guessed part sizes matches.
+func (s *Synchronizer) verifyDownload(path string, item *s3.Object, headers objectResponseHeaders) error {
+	key := *item.Key
+	var writers []io.Writer
+
+	// The ETag is the MD5 digest of the data for single part uploads and "<digest>-<number of parts>" for multipart
+	// uploads unless the object is encrypted with SSE-KMS or SSE-C
+	var eTag string
+	if item.ETag != nil && headers.serverSideEncryption != "aws:kms" && headers.sseCustomerAlgorithm == "" {
+		eTag = strings.ToLower(strings.Trim(*item.ETag, `"`))
+	}
+	var md5Hash hash.Hash
+	var multipartHashers []*multipartETagHasher
+	if parts := multipartETagParts(eTag); parts > 0 {
+		var size int64
+		if item.Size != nil {
+			size = *item.Size
+		}
+		partSizes := []int64{headers.partSize}
+		if headers.partSize == 0 {
+			partSizes = multipartPartSizeCandidates(size, parts)
+		}
+		for _, partSize := range partSizes {
+			hasher := newMultipartETagHasher(partSize)
+			multipartHashers = append(multipartHashers, hasher)
+			writers = append(writers, hasher)
+		}
+		if len(multipartHashers) == 0 && s.debug {
+			s.logger.Printf("Cannot verify the multipart ETag of '%v', the part size is unknown\n", key)
+		}
+	} else if eTag != "" {
+		md5Hash = md5.New()
+		writers = append(writers, md5Hash)
+	}
+
+	// Checksums of multipart uploads ("<checksum>-<number of parts>") are checksums of the parts' checksums and
+	// cannot be verified without the parts' checksums
+	var sha256Hash hash.Hash
+	if headers.checksumSHA256 != "" && !strings.Contains(headers.checksumSHA256, "-") {
+		sha256Hash = sha256.New()
+		writers = append(writers, sha256Hash)
+	}
+	var crc32cHash hash.Hash32
+	if headers.checksumCRC32C != "" && !strings.Contains(headers.checksumCRC32C, "-") {
+		crc32cHash = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		writers = append(writers, crc32cHash)
+	}
+
+	if len(writers) == 0 {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return err
+	}
+
+	if sha256Hash != nil {
+		if actual := base64.StdEncoding.EncodeToString(sha256Hash.Sum(nil)); actual != headers.checksumSHA256 {
+			return &integrityError{key: key, reason: fmt.Sprintf("SHA-256 checksum %v, expected %v", actual, headers.checksumSHA256)}
+		}
+	}
+	if crc32cHash != nil {
+		sum := make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, crc32cHash.Sum32())
+		if actual := base64.StdEncoding.EncodeToString(sum); actual != headers.checksumCRC32C {
+			return &integrityError{key: key, reason: fmt.Sprintf("CRC32C checksum %v, expected %v", actual, headers.checksumCRC32C)}
+		}
+	}
+	if md5Hash != nil {
+		if actual := hex.EncodeToString(md5Hash.Sum(nil)); actual != eTag {
+			return &integrityError{key: key, reason: fmt.Sprintf("ETag %v, expected %v", actual, eTag)}
+		}
+	}
+	if len(multipartHashers) > 0 {
+		matched := false
+		for _, hasher := range multipartHashers {
+			if hasher.eTag() == eTag {
+				matched = true
+				break
+			}
+		}
+		if !matched && headers.partSize > 0 {
+			return &integrityError{key: key, reason: fmt.Sprintf("multipart ETag expected %v", eTag)}
+		}
+		if !matched {
+			// The object may have been uploaded with a part size that was not guessed
+			s.logger.Printf("Cannot verify the multipart ETag of '%v', none of the guessed part sizes match\n", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,998 @@
+// Adapted from https://blog.tocconsulting.fr/download-entire-aws-s3-bucket-using-go/
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// To hold the number retrieved files and other download related statistics
+type downloadStats struct {
+	start                  time.Time
+	end                    time.Time
+	numberOfRetrievedFiles int
+	totalRetrievedBytes    int64
+	errorPrefixes          []*string
+	// The keys of the objects whose downloaded data did not match the object in S3, once per failed attempt, and the
+	// bytes downloaded by the failed attempts, which are not counted in totalRetrievedBytes
+	integrityMismatches    []*string
+	integrityMismatchBytes int64
+	// The error that failed the sync as a whole (e.g., the bucket does not exist), nil if the objects were listed
+	syncError error
+	// The estimated number of bytes to download, i.e., the total size of the listed objects that are missing locally or
+	// changed in S3, within the mount's quota
+	bytesNeeded int64
+	// The number of listed objects that are not downloaded as they exceed the mount's quota
+	objectsOverQuota int
+	// The keys of the objects that were not downloaded for lack of disk space, see waitForDiskSpace and diskBudget
+	objectsOverDiskSpace []*string
+	// The time the downloads paused for disk space give up waiting, zero until a download of the sync pauses
+	pauseDeadline time.Time
+	// The number of files evicted from and hydrated in the mount's cache
+	evictedFiles  int
+	hydratedFiles int
+	// The keys of the archived objects that were not downloaded as they are not restored, and the number of restores
+	// started for them
+	archivedObjects []*string
+	restoresStarted int
+	// The keys of the objects that were not downloaded as they cannot be mapped to a file inside the mount's
+	// destination, see relativePathForKey
+	rejectedKeys []*string
+	// The keys of the objects that were downloaded under a suffixed name as their local paths differ only in case from
+	// the paths of other keys, see caseCollisions
+	collidingKeys []*string
+	// Guards the counters and the key lists as the objects are downloaded concurrently
+	lock sync.Mutex
+}
+
+func newDownloadStats() *downloadStats {
+	stats := downloadStats{}
+	return &stats
+}
+
+func (stats *downloadStats) recordDownload(numBytes int64) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.numberOfRetrievedFiles++
+	stats.totalRetrievedBytes = stats.totalRetrievedBytes + numBytes
+}
+
+func (stats *downloadStats) recordError(key *string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.errorPrefixes = append(stats.errorPrefixes, key)
+}
+
+func (stats *downloadStats) recordSyncError(err error) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.syncError = err
+}
+
+func (stats *downloadStats) recordBytesNeeded(numBytes int64) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.bytesNeeded += numBytes
+}
+
+func (stats *downloadStats) recordObjectOverQuota() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.objectsOverQuota++
+}
+
+func (stats *downloadStats) recordObjectOverDiskSpace(key *string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.objectsOverDiskSpace = append(stats.objectsOverDiskSpace, key)
+}
+
+// Returns the time the downloads of the sync paused for disk space give up waiting, lowDiskSpaceMaxPause after the
+// first download of the sync paused
+func (stats *downloadStats) diskSpacePauseDeadline() time.Time {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if stats.pauseDeadline.IsZero() {
+		stats.pauseDeadline = time.Now().Add(lowDiskSpaceMaxPause)
+	}
+	return stats.pauseDeadline
+}
+
+func (stats *downloadStats) recordEviction() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.evictedFiles++
+}
+
+func (stats *downloadStats) recordHydration() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.hydratedFiles++
+}
+
+func (stats *downloadStats) recordArchived(key *string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.archivedObjects = append(stats.archivedObjects, key)
+}
+
+func (stats *downloadStats) recordRejectedKey(key *string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.rejectedKeys = append(stats.rejectedKeys, key)
+}
+
+func (stats *downloadStats) recordCollidingKey(key *string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.collidingKeys = append(stats.collidingKeys, key)
+}
+
+func (stats *downloadStats) recordRestoreStarted() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.restoresStarted++
+}
+
+func (stats *downloadStats) recordIntegrityMismatch(key *string, numBytes int64) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.integrityMismatches = append(stats.integrityMismatches, key)
+	stats.integrityMismatchBytes += numBytes
+}
+
+type mountConfiguration struct {
+	id          string
+	bucket      string
+	prefix      string
+	destination string
+	writeable   bool
+	kmsKeyId    string
+	// The session of the S3 calls of the mount, see sessionForMount
+	sess *session.Session
+	// The Unicode normalization form of the mount's local paths, see Options.UnicodeNormalization
+	normalization string
+	// The rate limits of the mount, they are changed in place when the mount's limits change
+	downloadLimiter *rateLimiter
+	uploadLimiter   *rateLimiter
+	// The maximum total size and number of the objects downloaded for the mount, ZERO means unlimited
+	maxBytes   int64
+	maxObjects int64
+	// The number of downloads of the mount waiting for disk space, accessed atomically
+	pausedDownloads int32
+	// The resident files of the mount in cache mode, nil if the mount is not in cache mode
+	cache *fileCache
+	// Whether to restore the archived objects of the mount, for how many days and using which retrieval tier
+	restoreArchived bool
+	restoreDays     int64
+	restoreTier     string
+	// The snapshot the mount is pinned to, nil if the mount tracks the latest objects
+	snapshot *mountSnapshot
+}
+
+func newMountConfiguration(id string, bucket string, prefix string, destination string, writeable bool, kmsKeyId string) *mountConfiguration {
+	config := mountConfiguration{
+		id:          id,
+		bucket:      bucket,
+		prefix:      prefix,
+		destination: destination,
+		writeable:   writeable,
+		kmsKeyId:    kmsKeyId,
+	}
+	return &config
+}
+
+// Downloads the files based on the given mount configuration from S3 using
+// s3Manager https://docs.aws.amazon.com/sdk-for-go/api/service/s3/s3manager/#NewDownloader.
+// It downloads each file as multipart download (i.e., downloads in chunks).
+func (s *Synchronizer) downloadFiles(handle *mountHandle) {
+	config := handle.config
+	destination := config.destination
+	bucket := config.bucket
+	prefix := config.prefix
+
+	if s.debug {
+		s.logger.Println("Getting all files from the s3 bucket :", bucket, " and prefix: ", prefix)
+		s.logger.Println("And will download them to :", destination)
+	}
+
+	stats := s.syncMount(handle.ctx, handle)
+	s.reportDownloadStats(stats)
+}
+
+// Syncs the given mount from S3 and records the outcome in the mount's status.
+// Only one sync runs for a mount at a time.
+func (s *Synchronizer) syncMount(ctx context.Context, handle *mountHandle) *downloadStats {
+	handle.syncLock.Lock()
+	defer handle.syncLock.Unlock()
+	stats := s.syncS3ToLocal(ctx, handle.config)
+	handle.recordSync(stats)
+	return stats
+}
+
+func (s *Synchronizer) reportDownloadStats(stats *downloadStats) {
+	end := time.Now()
+	duration := end.Sub(stats.start)
+	seconds := duration.Seconds()
+	if s.debug {
+		s.logger.Printf("Downloaded %d files - %d bytes total at %.1f MB/s\n",
+			stats.numberOfRetrievedFiles, stats.totalRetrievedBytes, float64(stats.totalRetrievedBytes)/float64(1e6)/seconds)
+		if len(stats.errorPrefixes) > 0 {
+			s.logger.Println("The following objects had errors:")
+			for _, p := range stats.errorPrefixes {
+				s.logger.Println("- ", *p)
+			}
+		}
+		if stats.syncError != nil {
+			s.logger.Println("The sync failed:", stats.syncError)
+		}
+		if stats.evictedFiles > 0 || stats.hydratedFiles > 0 {
+			s.logger.Printf("Evicted %d files from the cache and hydrated %d files\n", stats.evictedFiles, stats.hydratedFiles)
+		}
+		if len(stats.archivedObjects) > 0 {
+			s.logger.Printf("The following archived objects were not downloaded as they are not restored (%d restores started):\n", stats.restoresStarted)
+			for _, p := range stats.archivedObjects {
+				s.logger.Println("- ", *p)
+			}
+		}
+		if len(stats.rejectedKeys) > 0 {
+			s.logger.Println("The following objects were not downloaded as their keys cannot be mapped to files inside the mount's directory:")
+			for _, p := range stats.rejectedKeys {
+				s.logger.Println("- ", *p)
+			}
+		}
+		if len(stats.collidingKeys) > 0 {
+			s.logger.Println("The following objects were downloaded under suffixed names as their keys differ only in case from other keys:")
+			for _, p := range stats.collidingKeys {
+				s.logger.Println("- ", *p)
+			}
+		}
+		if stats.objectsOverQuota > 0 {
+			s.logger.Printf("%d objects were not downloaded as they exceed the mount's quota\n", stats.objectsOverQuota)
+		}
+		if len(stats.integrityMismatches) > 0 {
+			s.logger.Println("The downloaded data of the following objects did not match the objects in S3:")
+			for _, p := range stats.integrityMismatches {
+				s.logger.Println("- ", *p)
+			}
+		}
+	}
+}
+
+// Syncs the given mount from S3 to the local file system. No new downloads are started once ctx is cancelled,
+// the in-flight downloads complete unless the synchronizer aborts them (see Synchronizer.Shutdown). Local files are
+// only deleted when the sync ran to completion.
+func (s *Synchronizer) syncS3ToLocal(ctx context.Context, config *mountConfiguration) *downloadStats {
+	destination := config.destination
+	// Ensure the destination directory exists
+	if _, err := os.Stat(destination); os.IsNotExist(err) {
+		os.MkdirAll(destination, os.ModePerm)
+	}
+
+	stats := newDownloadStats()
+	stats.start = time.Now()
+
+	// Collect the local paths of the listed objects through all pages in case s3.ListObjectsV2 is paginated, they are
+	// then used to find the files on the local filesystem that are not there in S3. The paths are spilled to disk so
+	// that the memory used does not grow with the number of objects.
+	pathsInS3 := newPathSpill()
+	defer pathsInS3.close()
+	var spillErr error
+	var spillLock sync.Mutex
+
+	bucket := config.bucket
+	prefix := config.prefix
+	svc := s.newS3ClientForBucket(ctx, config)
+
+	if s.debug {
+		s.logger.Println("Listing", bucket, "for prefix", prefix)
+	}
+
+	listPrefix := listingPrefix(prefix)
+
+	// The objects are downloaded as they are listed, the bytes needed are estimated before the objects are queued for
+	// download and the objects beyond the mount's quota or beyond the capacity of the disk are left out
+	budget := s.newDiskBudget(config)
+	pipeline := s.newDownloadPipeline(ctx, config, stats)
+	quota := &mountQuota{maxBytes: config.maxBytes, maxObjects: config.maxObjects}
+	lowDiskSpaceWarned := false
+	// The keys whose local paths differ only in case are detected as they are listed, the detector is guarded by
+	// spillLock like the spilled paths. The records of the suffixed keys that are listed are taken out of localPaths so
+	// that the records of the mount's keys no longer in S3 are removed once the listing completes.
+	collisions := newCaseCollisions()
+	localPaths := s.claimLocalPaths(collisions, config, listPrefix)
+	recordLocalPath := func(item *s3.Object, localPath string, suffixed bool) {
+		stateKey := mountStateKey(bucket, config.id, *item.Key)
+		normalizedStateKey := normalizeUnicode(stateKey, config.normalization)
+		recorded, ok := localPaths[normalizedStateKey]
+		delete(localPaths, normalizedStateKey)
+		if suffixed && recorded != localPath {
+			s.state.RecordLocalPath(stateKey, localPath)
+		} else if !suffixed && ok {
+			s.state.RecordLocalPath(stateKey, "")
+		}
+	}
+	normalized := newNormalizedKeys(config.normalization)
+	onObjects := func(objects []*s3.Object) {
+		toDownload := make([]downloadTask, 0, len(objects))
+		spillLock.Lock()
+		for _, item := range objects {
+			if isDirectoryMarker(item) {
+				relDir, err := relativeDirForMarker(*item.Key, prefix, config.normalization)
+				if err == nil {
+					err = normalized.add(*item.Key, relDir+"/")
+				}
+				if err != nil {
+					s.rejectKey(item, err, stats)
+					continue
+				}
+				if relDir != "" {
+					resolved, suffixed := collisions.resolve(relDir)
+					if suffixed {
+						relDir = resolved
+						stats.recordCollidingKey(item.Key)
+					}
+					recordLocalPath(item, relDir, suffixed)
+				}
+				// The directory is created by downloadObject, its path keeps it from being pruned as not in S3
+				if relDir != "" && spillErr == nil {
+					spillErr = pathsInS3.add(foldCase(relDir) + "/")
+				}
+				toDownload = append(toDownload, downloadTask{item, filepath.Join(destination, filepath.FromSlash(relDir))})
+				continue
+			}
+			relPath, err := relativePathForKey(*item.Key, prefix, config.normalization)
+			if err == nil {
+				err = normalized.add(*item.Key, relPath)
+			}
+			if err != nil {
+				s.rejectKey(item, err, stats)
+				continue
+			}
+			resolved, suffixed := collisions.resolve(relPath)
+			if suffixed {
+				relPath = resolved
+				stats.recordCollidingKey(item.Key)
+			}
+			recordLocalPath(item, relPath, suffixed)
+			if spillErr == nil {
+				spillErr = pathsInS3.add(foldCase(relPath))
+			}
+			destFilePath := filepath.Join(destination, filepath.FromSlash(relPath))
+			if isArchived(item) && !config.restoreArchived {
+				// Archived objects cannot be downloaded without a restore, the local file (if any) is kept
+				if s.needsDownload(destFilePath, item) {
+					stats.recordArchived(item.Key)
+				}
+				continue
+			}
+			if !quota.admit(*item.Size) {
+				if quota.objectsOverQuota == 1 {
+					s.logger.Printf("Mount %v exceeds its quota (maxBytes %d, maxObjects %d), the objects beyond the quota are not downloaded\n", config.id, config.maxBytes, config.maxObjects)
+				}
+				stats.recordObjectOverQuota()
+				continue
+			}
+			if !budget.admit(*item.Size) {
+				if budget.objectsOverBudget == 1 {
+					s.logger.Printf("Mount %v does not fit on the disk (at most %d bytes while keeping %d bytes free), the objects beyond the capacity of the disk are not downloaded\n", config.id, budget.capacity, s.diskSpace.minFreeBytes)
+				}
+				stats.recordObjectOverDiskSpace(item.Key)
+				continue
+			}
+			if s.needsDownload(destFilePath, item) {
+				stats.recordBytesNeeded(*item.Size)
+			}
+			toDownload = append(toDownload, downloadTask{item, destFilePath})
+		}
+		if !lowDiskSpaceWarned {
+			lowDiskSpaceWarned = s.warnIfLowDiskSpace(config, stats)
+		}
+		spillLock.Unlock()
+		for _, task := range toDownload {
+			pipeline.add(task)
+		}
+	}
+	var err error
+	if config.snapshot != nil {
+		err = s.listSnapshot(ctx, svc, config, listPrefix, stats, onObjects)
+	} else if s.options.ListingConcurrency > 1 {
+		err = s.listObjectsConcurrently(ctx, svc, bucket, listPrefix, s.options.ListingConcurrency, onObjects)
+	} else {
+		err = s.listObjects(ctx, svc, bucket, listPrefix, onObjects)
+	}
+	// Wait for the in-flight downloads to complete
+	pipeline.wait()
+
+	if err != nil && ctx.Err() == nil {
+		// Give up on this sync, the next sync (if any) lists the objects again
+		s.logger.Println("Failed to list objects for bucket", bucket, "and prefix", prefix, ":", err)
+		stats.recordSyncError(err)
+		stats.end = time.Now()
+		return stats
+	}
+
+	if ctx.Err() != nil {
+		// The listing is incomplete, do not delete the local files that are not listed yet
+		if s.debug {
+			s.logger.Println("Sync stopped before completion for", config.destination)
+		}
+		stats.end = time.Now()
+		return stats
+	}
+
+	// The keys of the mount whose local paths are still recorded were not listed
+	for stateKey := range localPaths {
+		s.state.RecordLocalPath(stateKey, "")
+	}
+
+	if spillErr != nil {
+		// Without the complete set of paths the local files cannot be reconciled safely
+		s.logger.Println("Error collecting the listed objects, not deleting local files:", spillErr)
+		stats.end = time.Now()
+		return stats
+	}
+	hydrationMarkers, err := s.deleteLocalFilesNotInS3(pathsInS3, config)
+	if err != nil {
+		s.logger.Println("Error: ", err)
+	}
+
+	if config.cache != nil {
+		s.hydrateMarkedFiles(ctx, config, hydrationMarkers, stats)
+		// Evict down to the budget, e.g., when the budget was lowered
+		s.evictLeastRecentlyUsed(config, 0, "", stats)
+	}
+
+	stats.end = time.Now()
+	return stats
+}
+
+// Claims the names of the local files of the given mount (see caseCollisions), the recorded local paths of the
+// suffixed keys of the mount first and then the names of the files and directories under the mount's destination, i.e.,
+// the names given by the previous syncs. Returns the recorded local paths by the (normalized) mount state keys (see
+// mountStateKey), nil when the local file system is case-sensitive.
+func (s *Synchronizer) claimLocalPaths(collisions *caseCollisions, config *mountConfiguration, listPrefix string) map[string]string {
+	if collisions == nil {
+		return nil
+	}
+	localPaths := s.state.LocalPaths(mountStateKey(config.bucket, config.id, listPrefix))
+	for _, localPath := range localPaths {
+		collisions.claim(localPath, true)
+	}
+	filepath.Walk(config.destination, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == config.destination || isTempFile(path) {
+			// Nothing to claim if the directory does not exist yet
+			return nil
+		}
+		if relPath, err := filepath.Rel(config.destination, path); err == nil {
+			collisions.claim(normalizeUnicode(filepath.ToSlash(relPath), config.normalization), false)
+		}
+		return nil
+	})
+	return localPaths
+}
+
+// Returns an S3 client for the given mount in the region of the mount's bucket
+func (s *Synchronizer) newS3ClientForBucket(ctx context.Context, config *mountConfiguration) *s3.S3 {
+	sess := config.sess
+	bucket := config.bucket
+	var awsRegion string
+	err := s.retry(ctx, fmt.Sprintf("Lookup of the region of bucket %v", bucket), func() error {
+		var err error
+		awsRegion, err = s3manager.GetBucketRegion(ctx, sess, bucket, *sess.Config.Region)
+		return err
+	})
+	if err != nil {
+		// Fall back to the session's region, the listing reports the actual problem (e.g., NoSuchBucket)
+		s.logger.Println("Error getting region of the bucket", bucket, err)
+		awsRegion = *sess.Config.Region
+	}
+	if s.debug {
+		s.logger.Println("Bucket", bucket, "region is", awsRegion)
+	}
+
+	// Copy the session instead of creating a new one from its config, the config is shared with the other mounts
+	return s3.New(sess.Copy(&aws.Config{Region: aws.String(awsRegion)}))
+}
+
+// Returns the prefix to list the objects of a mount with the given prefix, "/" stands for the whole bucket
+func listingPrefix(prefix string) string {
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+// Deletes the local files of the mount that are not in the given set of the listed objects' paths. The local files are
+// walked in the same sorted order as the paths and the two are merge-joined, so the reconciliation is linear in the
+// number of files and only holds one directory's entries in memory. The paths are compared case-folded on
+// case-insensitive file systems (see foldCase) as the file of a key may be stored under another spelling. The empty directories that no longer exist in S3
+// (i.e., without a directory marker or an object under them) are pruned as well, see pruneDirectory.
+// For mounts in cache mode, the placeholders of the deleted objects are deleted like the other files and the
+// hydration markers (which are not in S3) are returned instead of being deleted, see hydrateMarkedFiles.
+func (s *Synchronizer) deleteLocalFilesNotInS3(pathsInS3 *pathSpill, config *mountConfiguration) ([]string, error) {
+	destination := config.destination
+	var hydrationMarkers []string
+
+	sortedPathsInS3, err := pathsInS3.sortedPaths()
+	if err != nil {
+		return nil, err
+	}
+	defer sortedPathsInS3.close()
+	pathInS3, more, err := sortedPathsInS3.next()
+	if err != nil {
+		return nil, err
+	}
+	// The listed path before pathInS3
+	var previousPathInS3 string
+	// Skips the listed paths that sort before the given local path, they are not downloaded yet
+	skipPathsInS3Before := func(relPath string) error {
+		for more && pathInS3 < relPath {
+			previousPathInS3 = pathInS3
+			var err error
+			if pathInS3, more, err = sortedPathsInS3.next(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// The directories (relative to the destination) whose files or sub-directories were deleted
+	emptiedDirs := make(map[string]bool)
+
+	walkerFn := func(path string, relPath string, info os.FileInfo, err error) error {
+		// Don't do anything if there was any error during walking the file tree
+		if err != nil {
+			s.logger.Printf("\nError walking the file tree: \"%s\". Error: %v\n", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			// The directory is in S3 if a listed path is under it. The directory's files were walked already, so such
+			// a path is either the one the listing is at or, if all of them sort before the last file, the one before.
+			dirPrefix := relPath + "/"
+			if err := skipPathsInS3Before(dirPrefix); err != nil {
+				return err
+			}
+			if (more && strings.HasPrefix(pathInS3, dirPrefix)) || strings.HasPrefix(previousPathInS3, dirPrefix) {
+				return nil
+			}
+			if s.pruneDirectory(path, config, emptiedDirs[relPath]) {
+				emptiedDirs[filepath.ToSlash(filepath.Dir(relPath))] = true
+			}
+			return nil
+		}
+		if isTempFile(path) {
+			// Ignore the temporary files of the downloads, they are cleaned up when the mount starts
+			return nil
+		}
+
+		if err := skipPathsInS3Before(relPath); err != nil {
+			return err
+		}
+		if !more || pathInS3 != relPath {
+			// file NOT in S3 but is in local file system
+			if config.cache != nil && isHydrationMarker(path) {
+				hydrationMarkers = append(hydrationMarkers, path)
+				return nil
+			}
+
+			// This may be due to following situations:
+			// 1. File was deleted from S3 (i.e., the file was originally downloaded from S3 and now it does not exist in S3)
+			//		-- Delete the file from local file system in this case
+			// 2. The file was created locally and
+			//		2.1 The file mount is "writeable"
+			//			-- DO NOT delete the file from local file system in this case
+			//		2.2 The file mount is NOT "writeable"
+			//			-- Delete the file from local file system in this case
+			if !config.writeable || s.state.IsFileDownloadedFromS3(s.fileKey(path, config)) {
+				if s.debug {
+					s.logger.Printf("\n\nFile '%s' removed from S3 so deleting it from local file system\n\n", path)
+				}
+				error := os.Remove(path)
+				if error == nil {
+					config.cache.remove(path)
+					s.state.RecordFileDeletionFromLocal(s.fileKey(path, config))
+					emptiedDirs[filepath.ToSlash(filepath.Dir(relPath))] = true
+				} else {
+					s.logger.Printf("\nError deleting file: \"%s\". Error: %v\n", path, error)
+				}
+			}
+		}
+		return nil
+	}
+
+	err = walkSorted(destination, config.normalization, walkerFn)
+	return hydrationMarkers, err
+}
+
+// Deletes the given directory of the mount if it is empty, the caller checked that it does not exist in S3. The
+// directories of writeable mounts are only deleted if they came from S3, i.e., if their directory marker was
+// downloaded or they were emptied by the deletion of the files deleted from S3, an empty directory created locally is
+// uploaded as a directory marker instead (see uploadDirMarkerToS3). Returns whether the directory was deleted.
+func (s *Synchronizer) pruneDirectory(path string, config *mountConfiguration, emptied bool) bool {
+	if !isEmptyDir(path) {
+		return false
+	}
+	markerKey := s.fileKey(path, config) + "/"
+	if config.writeable && !emptied && !s.state.IsFileDownloadedFromS3(markerKey) {
+		return false
+	}
+	if s.debug {
+		s.logger.Printf("Directory '%s' removed from S3 so deleting it from local file system\n", path)
+	}
+	if err := os.Remove(path); err != nil {
+		s.logger.Printf("Error deleting directory: \"%s\". Error: %v\n", path, err)
+		return false
+	}
+	s.state.RecordFileDeletionFromLocal(markerKey)
+	return true
+}
+
+// Sets up recurring downloads for the given mount. The recurring downloads stop when
+// Options.StopRecurringDownloadsAfter has elapsed (if applicable) or when the mount is stopped.
+func (s *Synchronizer) setupRecurringDownloads(handle *mountHandle) {
+	config := handle.config
+	wg := &handle.wg
+	downloadInterval := s.options.DownloadInterval
+	stopRecurringDownloadsAfter := s.options.StopRecurringDownloadsAfter
+
+	// Increment wait group counter everytime we spawn recurring downloads and reporter threads to make sure
+	// the caller (main) can wait
+	wg.Add(2)
+
+	statsCh := make(chan *downloadStats, 50)
+
+	setupStartTime := time.Now()
+
+	// Kick off thread for recurring download for this mount configuration
+	// This thread will push download stats to stats channel and the reporter thread will receive stats from the
+	// stats channel and report (print) the stats
+	go func() {
+		// Decrement from the wait group indicating we are done
+		defer wg.Done()
+		// Closing the stats channel stops the reporter thread
+		defer close(statsCh)
+
+		for {
+			stats := s.syncMount(handle.ctx, handle)
+
+			statsCh <- stats // Push download stats to the stats channel. The reporter will read from statsCh and report it
+
+			// stopRecurringDownloadsAfter is ZERO or negative then continue recurring downloads indefinitely
+			// If the duration to continue recurring downloads has passed then stop the recurring downloads
+			// from happening further
+			if stopRecurringDownloadsAfter > 0 && time.Since(setupStartTime) > stopRecurringDownloadsAfter {
+				return
+			}
+			// Sleep for the download interval duration or until the mount is stopped or a sync is requested
+			select {
+			case <-handle.ctx.Done():
+				if s.debug {
+					s.logger.Println("Stopping recurring downloads to", config.destination)
+				}
+				return
+			case <-handle.syncNowCh:
+				if s.debug {
+					s.logger.Println("Sync requested for", config.destination)
+				}
+			case <-time.After(downloadInterval):
+			}
+		}
+	}()
+
+	// Kick off reporter thread for recurring reporting of the download stats
+	go func() {
+		defer wg.Done()
+		for stats := range statsCh {
+			s.reportDownloadStats(stats)
+		}
+	}()
+}
+
+// Returns a downloader for the given mount with the synchronizer's part size and concurrency
+func (s *Synchronizer) newDownloader(config *mountConfiguration) *s3manager.Downloader {
+	return s3manager.NewDownloader(config.sess, func(d *s3manager.Downloader) {
+		d.PartSize = s.options.PartSize
+		d.Concurrency = s.concurrency
+	})
+}
+
+// Downloads the listed objects that are missing locally or changed in S3 using a pool of workers, each worker
+// downloads one object at a time. The objects can be added from multiple goroutines as they are listed, "wait" must
+// be called once all the objects are added. Stops starting new downloads once ctx is cancelled, see syncS3ToLocal.
+type downloadPipeline struct {
+	ctx     context.Context
+	tasksCh chan downloadTask
+	wg      sync.WaitGroup
+}
+
+// A listed object and the local path it is downloaded to
+type downloadTask struct {
+	item         *s3.Object
+	destFilePath string
+}
+
+func (s *Synchronizer) newDownloadPipeline(
+	ctx context.Context,
+	config *mountConfiguration,
+	stats *downloadStats,
+) *downloadPipeline {
+	downloader := s.newDownloader(config)
+	pipeline := &downloadPipeline{ctx: ctx, tasksCh: make(chan downloadTask)}
+	for i := 0; i < s.objectConcurrency; i++ {
+		pipeline.wg.Add(1)
+		go func() {
+			defer pipeline.wg.Done()
+			for task := range pipeline.tasksCh {
+				s.downloadObject(ctx, downloader, task.item, config, task.destFilePath, stats)
+			}
+		}()
+	}
+	return pipeline
+}
+
+// Queues the given object for download, blocks until a worker picks it up. The object is dropped once ctx is cancelled.
+func (pipeline *downloadPipeline) add(task downloadTask) {
+	if pipeline.ctx.Err() != nil {
+		return
+	}
+	pipeline.tasksCh <- task
+}
+
+// Waits for the in-flight downloads to complete, no objects can be added afterwards
+func (pipeline *downloadPipeline) wait() {
+	close(pipeline.tasksCh)
+	pipeline.wg.Wait()
+}
+
+// Returns whether the object needs to be downloaded to the given path, i.e., the file does not exist or the object
+// has changed in S3 since the file was downloaded
+func (s *Synchronizer) needsDownload(destFilePath string, item *s3.Object) bool {
+	// Note that we cannot use os.IsExist(fileError) to check for file's existence
+	// os.IsExist and os.IsNotExist are error checker functions and only work when error is not nil
+	// The correct way to check if file exists is using !os.IsNotExist(fileError)
+	if _, fileError := os.Stat(destFilePath); !os.IsNotExist(fileError) {
+		// Placeholders of evicted files are only downloaded again when they are hydrated
+		if s.state.IsFileEvicted(*item.Key) {
+			return false
+		}
+		// If the file has not changed in S3 since last download then skip downloading it
+		return s.state.HasFileChangedInS3(item)
+	}
+	return true
+}
+
+// Downloads the given object to the given path (the directory to create for a directory marker) unless it is already
+// downloaded and has not changed in S3 since. The download waits for a slot in the synchronizer's download budget (see
+// Options.MaxConcurrentObjects) so that the number of objects downloaded at a time is bounded across all mounts. For
+// mounts in cache mode, a placeholder is left instead if the object does not fit in the mount's cache. Archived
+// objects are only downloaded once restored, see prepareArchivedObject.
+func (s *Synchronizer) downloadObject(
+	ctx context.Context,
+	downloader *s3manager.Downloader,
+	item *s3.Object,
+	config *mountConfiguration,
+	destFilePath string,
+	stats *downloadStats,
+) {
+	if isDirectoryMarker(item) {
+		s.createMarkedDirectory(destFilePath, item, stats)
+		return
+	}
+
+	// Ensure the directory exists
+	destDirPath := filepath.Dir(destFilePath)
+	if _, err := os.Stat(destDirPath); os.IsNotExist(err) {
+		os.MkdirAll(destDirPath, os.ModePerm)
+	}
+
+	if !s.needsDownload(destFilePath, item) {
+		if s.debug {
+			s.logger.Printf("'%v' already exists and is up-to-date. Skip downloading '%v'\n", destFilePath, *item.Key)
+		}
+		return
+	}
+
+	if isArchived(item) && !s.prepareArchivedObject(ctx, downloader.S3, config, item, stats) {
+		return
+	}
+
+	if config.cache == nil {
+		s.fetchObject(ctx, downloader, item, config, destFilePath, stats)
+		return
+	}
+	if !config.cache.reserve(destFilePath, *item.Size) {
+		s.leavePlaceholder(config, destFilePath, item)
+		return
+	}
+	if s.fetchObject(ctx, downloader, item, config, destFilePath, stats) {
+		config.cache.commit(destFilePath, *item.Key, *item.Size)
+	} else {
+		config.cache.unreserve(*item.Size)
+	}
+}
+
+// Records the given object as not downloaded as its key cannot be mapped to a local file for the given reason
+func (s *Synchronizer) rejectKey(item *s3.Object, reason error, stats *downloadStats) {
+	if s.debug {
+		s.logger.Printf("Rejecting the key '%v': %v\n", *item.Key, reason)
+	}
+	stats.recordRejectedKey(item.Key)
+}
+
+// Creates the local directory of the given directory marker. The marker is recorded in the synchronizer state like a
+// downloaded file so that the directory of a writeable mount is pruned once the marker is deleted from S3.
+func (s *Synchronizer) createMarkedDirectory(destDirPath string, item *s3.Object, stats *downloadStats) {
+	if err := os.MkdirAll(destDirPath, os.ModePerm); err != nil {
+		s.logger.Printf("Error creating directory '%v' for directory marker '%v': %v\n", destDirPath, *item.Key, err)
+		stats.recordError(item.Key)
+		return
+	}
+	if s.state.HasFileChangedInS3(item) {
+		if s.debug {
+			s.logger.Printf("Created directory '%v' for directory marker '%v'\n", destDirPath, *item.Key)
+		}
+		s.state.RecordFileDownloadToLocal(item)
+	}
+}
+
+// Downloads the given object to the given path and records the download in the synchronizer state. Returns whether
+// the object was downloaded.
+func (s *Synchronizer) fetchObject(
+	ctx context.Context,
+	downloader *s3manager.Downloader,
+	item *s3.Object,
+	config *mountConfiguration,
+	destFilePath string,
+	stats *downloadStats,
+) bool {
+	bucket := config.bucket
+	versionId := config.snapshot.versionId(*item.Key)
+	destDirPath := filepath.Dir(destFilePath)
+
+	// Wait until the disk has room for the object, give up if the mount is stopped in the meantime
+	if !s.waitForDiskSpace(ctx, config, destDirPath, item, stats) {
+		return false
+	}
+	defer s.diskSpace.release(*item.Size)
+
+	// Wait for a download slot, give up if the mount is stopped in the meantime
+	select {
+	case s.downloadSlots <- struct{}{}:
+		defer func() { <-s.downloadSlots }()
+	case <-ctx.Done():
+		return false
+	}
+
+	if s.debug {
+		s.logger.Printf("%v -> %v\n", *item.Key, destFilePath)
+	}
+
+	// Download to a temporary file first and only replace the destination file once the download is complete and
+	// verified so that a failed download does not leave a truncated or corrupted file behind
+	var tempFilePath string
+	// The bytes downloaded by the attempt that succeeded, the bytes of the failed attempts are not counted
+	var numBytes int64
+	var err error
+	resumable := item.Size != nil && *item.Size > s.options.PartSize
+	// Throttle the download to the mount's and the global download rate limits
+	limiters := []*rateLimiter{config.downloadLimiter, s.downloadLimiter}
+	// The part size is needed to verify the ETag of objects uploaded in parts
+	partSize := s.firstPartSize(downloader.S3, bucket, item, versionId)
+	for attempt := 1; ; attempt++ {
+		var headers objectResponseHeaders
+		err = s.retry(s.transfersCtx, fmt.Sprintf("Download of '%v'", *item.Key), func() error {
+			var attemptBytes int64
+			var err error
+			if resumable {
+				// Objects with more than one part are downloaded in a way that can be resumed if the download is
+				// interrupted, a retry continues from the last completed part
+				tempFilePath, attemptBytes, headers, err = s.downloadObjectResumable(downloader.S3, config, item, versionId, destDirPath, limiters)
+			} else {
+				tempFilePath, attemptBytes, headers, err = s.downloadObjectToTempFile(downloader, bucket, item, versionId, destDirPath, limiters)
+			}
+			numBytes = attemptBytes
+			return err
+		})
+		if err == nil && item.Size != nil {
+			fi, statErr := os.Stat(tempFilePath)
+			if statErr != nil {
+				err = statErr
+			} else if fi.Size() != *item.Size {
+				err = fmt.Errorf("downloaded %d bytes but the object has %d bytes", fi.Size(), *item.Size)
+			}
+		}
+		if err == nil {
+			headers.partSize = partSize
+			err = s.verifyDownload(tempFilePath, item, headers)
+		}
+		if err == nil {
+			// Preserve the modification time of the object, the rename keeps it
+			s.setLocalMtime(tempFilePath, item, headers.metadataMtime)
+			err = os.Rename(tempFilePath, destFilePath)
+		}
+		if !isIntegrityError(err) {
+			break
+		}
+
+		// The data is corrupted, download the object again from the start
+		s.logger.Printf("%v (attempt %d of %d)\n", err, attempt, maxIntegrityAttempts)
+		stats.recordIntegrityMismatch(item.Key, numBytes)
+		numBytes = 0
+		if resumable {
+			s.discardPartialDownload(mountStateKey(bucket, config.id, *item.Key), tempFilePath)
+		} else {
+			os.Remove(tempFilePath)
+		}
+		tempFilePath = ""
+		if attempt >= maxIntegrityAttempts || s.transfersCtx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		if s.debug {
+			s.logger.Println("Error downloading file: ", err.Error())
+		}
+		// The temporary file of a resumable download is kept to resume the download with the next sync
+		if tempFilePath != "" && !resumable {
+			os.Remove(tempFilePath)
+		}
+		stats.recordError(item.Key)
+		return false
+	}
+	if resumable {
+		s.state.RemovePartialDownload(mountStateKey(bucket, config.id, *item.Key))
+	}
+
+	stats.recordDownload(numBytes)
+
+	s.state.RecordFileDownloadToLocal(item)
+	return true
+}
+
+// Downloads the given object (or the given version of the object if not nil) to a new temporary file in the given
+// directory using the s3manager downloader. Returns the temporary file, the number of bytes downloaded and the headers of the response needed to set the
+// modification time of the file and to verify its data. The temporary file is deleted if the download fails.
+// The download is throttled to the given rate limiters.
+func (s *Synchronizer) downloadObjectToTempFile(downloader *s3manager.Downloader, bucket string, item *s3.Object, versionId *string, destDirPath string, limiters []*rateLimiter) (string, int64, objectResponseHeaders, error) {
+	tempFile, err := createTempFile(destDirPath)
+	if err != nil {
+		return "", 0, objectResponseHeaders{}, err
+	}
+
+	// The downloader does not return the response of the GET request, capture the headers from it
+	var headers objectResponseHeaders
+	var headersLock sync.Mutex
+	captureHeaders := func(d *s3manager.Downloader) {
+		d.RequestOptions = append(d.RequestOptions, captureObjectResponseHeaders(&headers, &headersLock))
+	}
+
+	// The download is not tied to ctx so that it completes when the mount is stopped, it is only aborted when
+	// the synchronizer shuts down and the in-flight transfers do not complete in time
+	numBytes, err := downloader.DownloadWithContext(s.transfersCtx, &throttledWriterAt{ctx: s.transfersCtx, w: tempFile, limiters: limiters},
+		&s3.GetObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(*item.Key),
+			VersionId: versionId,
+		}, captureHeaders)
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", 0, objectResponseHeaders{}, err
+	}
+	headersLock.Lock()
+	defer headersLock.Unlock()
+	return tempFile.Name(), numBytes, headers, nil
+}
@@ -0,0 +1,255 @@
+package synchronizer
+
+import (
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// The reversible encoding of the S3 keys that are not valid local filenames. Each "/"-separated segment of the path of
+// a key relative to the mount's prefix is encoded into one or more local names:
+//   - On Windows, the characters that are not allowed in filenames are replaced by the quote character U+201B and
+//     their look-alikes: the control characters 0x01-0x1F by the symbols U+2401-U+241F and " * : < > ? \ | by their
+//     full-width forms (e.g., ":" by "‛" and U+FF1A). The trailing dot or space of a name, which Windows drops, is
+//     replaced by U+201B and U+FF0E or U+2420. The look-alikes found in the key are kept as they are.
+//   - On Windows, the reserved device names (CON, PRN, AUX, NUL, COM1-9 and LPT1-9, also with an extension) are
+//     prefixed with U+201B.
+//   - A segment whose encoding is longer than maxNameBytes is split into a chain of directories, each but the last name
+//     of the chain ends with U+201B.
+//   - The U+201B characters of the key are doubled where they would otherwise be decoded, i.e., before the end of a
+//     name, before a look-alike and before a reserved name on Windows. Elsewhere they are kept as they are.
+//   - On case-insensitive file systems, the names that differ only in case from the names of other keys are suffixed
+//     with U+201B and "~<n>", see caseCollisions.
+// The keys that do not need any of these map to the same filenames on all platforms. The local filenames are decoded
+// back to their keys by ToS3KeyForFile so that the files uploaded from writeable mounts keep the original keys. The
+// names that are not the encoding of any key, like most of the names of the files created locally, are taken as they
+// are, i.e., a file created locally is uploaded to the key of its name unless its name is the encoding of another key.
+
+// The quote and continuation character of the encoding
+const keyQuote = '‛'
+
+// The maximum length in bytes of a local filename, the limit of the common file systems
+const maxNameBytes = 255
+
+// Whether the local filenames must be valid on Windows. A variable so that the tests can check both encodings.
+var encodeForWindows = runtime.GOOS == "windows"
+
+// The look-alikes of the characters that are not allowed in filenames on Windows
+var windowsLookAlikes = map[rune]rune{
+	'"':  '＂',
+	'*':  '＊',
+	':':  '：',
+	'<':  '＜',
+	'>':  '＞',
+	'?':  '？',
+	'\\': '＼',
+	'|':  '｜',
+}
+
+// The look-alikes of the trailing dot and space of a name on Windows
+const windowsTrailingDot = '．'
+const windowsTrailingSpace = '␠'
+
+// The characters decoded by the Windows encoding vs the characters they stand for
+var windowsDecodings = func() map[rune]rune {
+	decodings := map[rune]rune{windowsTrailingDot: '.', windowsTrailingSpace: ' '}
+	for r, lookAlike := range windowsLookAlikes {
+		decodings[lookAlike] = r
+	}
+	for r := rune(1); r < 0x20; r++ {
+		decodings[0x2400+r] = r
+	}
+	return decodings
+}()
+
+// The device names reserved on Windows, case-insensitive
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Returns the local path (with forward slashes) of the given path of a key relative to the mount's prefix
+func encodeRelativePath(relPath string) string {
+	segments := strings.Split(relPath, "/")
+	names := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		names = append(names, encodeName(segment, encodeForWindows)...)
+	}
+	return strings.Join(names, "/")
+}
+
+// Returns the path of a key relative to the mount's prefix of the given local path (with forward slashes), the
+// inverse of encodeRelativePath. A chain of names that is not the encoding of its segment is taken as it is, one segment
+// per name, so that the names created locally keep their spelling in the keys.
+func decodeRelativePath(localPath string) string {
+	names := strings.Split(localPath, "/")
+	segments := make([]string, 0, len(names))
+	var chain strings.Builder
+	first := 0
+	for i, name := range names {
+		decoded, continued := decodeName(name, encodeForWindows)
+		chain.WriteString(decoded)
+		if continued && i < len(names)-1 {
+			continue
+		}
+		segment := chain.String()
+		chain.Reset()
+		if encoded := encodeName(segment, encodeForWindows); strings.Join(encoded, "/") == strings.Join(names[first:i+1], "/") {
+			segments = append(segments, segment)
+		} else {
+			segments = append(segments, names[first:i+1]...)
+		}
+		first = i + 1
+	}
+	return strings.Join(segments, "/")
+}
+
+// Returns the local names of the given segment of a key, more than one if the encoded segment is too long for a name
+func encodeName(segment string, windows bool) []string {
+	// Split the segments that are too long, the names are filled up one character at a time and each but the last name
+	// ends with the continuation character
+	runes := []rune(segment)
+	var names []string
+	start := 0
+	for start < len(runes) {
+		if name := encodeNamePart(runes[start:], windows, true); len(name) <= maxNameBytes {
+			names = append(names, name)
+			break
+		}
+		end := start + 1
+		for end < len(runes) && len(encodeNamePart(runes[start:end+1], windows, false)) <= maxNameBytes {
+			end++
+		}
+		names = append(names, encodeNamePart(runes[start:end], windows, false))
+		start = end
+	}
+	if len(names) == 0 {
+		names = append(names, encodeNamePart(nil, windows, true))
+	}
+	return names
+}
+
+// Returns the local name of the given characters of a segment, the last characters of the segment if last is true,
+// followed by the continuation character otherwise
+func encodeNamePart(runes []rune, windows bool, last bool) string {
+	var name []rune
+	// The quote characters of the key seen since the last character, doubled when the next character is decoded
+	quotes := 0
+	writeQuotes := func(decoded bool) {
+		for i := 0; i < quotes; i++ {
+			name = append(name, keyQuote)
+			if decoded {
+				name = append(name, keyQuote)
+			}
+		}
+		quotes = 0
+	}
+	for i, r := range runes {
+		trailing := last && i == len(runes)-1
+		switch {
+		case r == keyQuote:
+			quotes++
+		case !windows:
+			writeQuotes(false)
+			name = append(name, r)
+		case windowsDecodings[r] != 0:
+			writeQuotes(true)
+			name = append(name, r)
+		case windowsLookAlikes[r] != 0:
+			writeQuotes(true)
+			name = append(name, keyQuote, windowsLookAlikes[r])
+		case r > 0 && r < 0x20:
+			writeQuotes(true)
+			name = append(name, keyQuote, 0x2400+r)
+		case trailing && r == '.':
+			writeQuotes(true)
+			name = append(name, keyQuote, windowsTrailingDot)
+		case trailing && r == ' ':
+			writeQuotes(true)
+			name = append(name, keyQuote, windowsTrailingSpace)
+		default:
+			writeQuotes(false)
+			name = append(name, r)
+		}
+	}
+	// The quotes before the end of the name
+	writeQuotes(true)
+	if !last {
+		name = append(name, keyQuote)
+	}
+
+	encoded := string(name)
+	if windows {
+		// The quotes before a reserved name are doubled as well, a single quote is the prefix of the reserved name
+		if rest := strings.TrimLeft(encoded, string(keyQuote)); isWindowsReservedName(rest) {
+			leading := utf8.RuneCountInString(encoded) - utf8.RuneCountInString(rest)
+			if leading == 0 {
+				leading = 1
+			}
+			encoded = strings.Repeat(string(keyQuote), leading) + encoded
+		}
+	}
+	return encoded
+}
+
+// Returns the segment of a key (or the part of it, see encodeName) of the given local name and whether the name is
+// continued by the next name of the path. A run of quote characters stands for half as many quotes of the key when it
+// is followed by a character that is decoded, the odd quote of the run quotes the character.
+func decodeName(name string, windows bool) (string, bool) {
+	runes := []rune(name)
+	decoded := make([]rune, 0, len(runes))
+	quotes := 0
+	// Writes the quotes of the key of the run of quotes before the current character and returns whether the run
+	// quotes the character
+	writeQuotes := func(quoting bool) bool {
+		n := quotes
+		if quoting {
+			n = quotes / 2
+		}
+		for i := 0; i < n; i++ {
+			decoded = append(decoded, keyQuote)
+		}
+		odd := quoting && quotes%2 == 1
+		quotes = 0
+		return odd
+	}
+	i := 0
+	if windows {
+		// The prefix of a reserved name, see encodeNamePart
+		if rest := strings.TrimLeft(name, string(keyQuote)); rest != name && isWindowsReservedName(rest) {
+			for runes[i] == keyQuote {
+				quotes++
+				i++
+			}
+			writeQuotes(true)
+		}
+	}
+	for ; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == keyQuote:
+			quotes++
+		case windows && windowsDecodings[r] != 0:
+			if writeQuotes(true) {
+				decoded = append(decoded, windowsDecodings[r])
+			} else {
+				decoded = append(decoded, r)
+			}
+		default:
+			writeQuotes(false)
+			decoded = append(decoded, r)
+		}
+	}
+	continued := writeQuotes(true)
+	return string(decoded), continued
+}
+
+// Returns whether the given name is a device name reserved on Windows, alone or with an extension
+func isWindowsReservedName(name string) bool {
+	base := name
+	if dot := strings.IndexByte(base, '.'); dot >= 0 {
+		base = base[:dot]
+	}
+	return windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
@@ -0,0 +1,77 @@
+package synchronizer
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Maps the S3 keys of the objects of a mount to the local paths they are downloaded to. The keys that cannot be mapped
+// to a file inside the mount's destination (e.g., keys with "../" segments in a bucket shared with external
+// collaborators) are rejected rather than sanitized so that a rejected key never overwrites the file of another key.
+// The other keys are encoded into valid local filenames, see encodeRelativePath.
+
+// Drive letters (e.g., "C:"), which start absolute or drive-relative paths on Windows
+var windowsVolumeRegex = regexp.MustCompile(`^[A-Za-z]:`)
+
+// Returns the path relative to the mount's destination (with forward slashes) the object with the given key is
+// downloaded to, or an error naming the reason the key is rejected. The path is in the given Unicode normalization
+// form, see Options.UnicodeNormalization. Directory markers must be mapped using relativeDirForMarker instead.
+func relativePathForKey(key string, prefix string, normalization string) (string, error) {
+	relPath, err := mapKey(key, prefix, normalization)
+	if err == nil && relPath == "" {
+		err = fmt.Errorf("the key is the mount's prefix itself")
+	}
+	return relPath, err
+}
+
+// Returns the path relative to the mount's destination (with forward slashes) of the directory of the directory
+// marker with the given key, or an empty string for the marker of the mount's prefix itself. Returns an error naming
+// the reason the key is rejected, like relativePathForKey.
+func relativeDirForMarker(key string, prefix string, normalization string) (string, error) {
+	return mapKey(strings.TrimSuffix(key, "/"), prefix, normalization)
+}
+
+// Returns the relative path of the given key under the given prefix, an empty string for the prefix itself
+func mapKey(key string, prefix string, normalization string) (string, error) {
+	if strings.ContainsRune(key, 0) {
+		return "", fmt.Errorf("the key contains a NUL byte")
+	}
+	relPath := strings.TrimPrefix(key, prefix)
+	// The prefixes of the mounts usually do not end in "/"
+	if !strings.HasSuffix(prefix, "/") {
+		relPath = strings.TrimPrefix(relPath, "/")
+	}
+	if relPath == "" {
+		return "", nil
+	}
+	relPath = normalizeUnicode(relPath, normalization)
+	if strings.HasPrefix(relPath, "/") || strings.HasPrefix(relPath, `\`) || windowsVolumeRegex.MatchString(relPath) {
+		return "", fmt.Errorf("the key maps to an absolute path")
+	}
+	// Backslashes are separators on Windows, check the segments between them on all platforms so that a key is either
+	// accepted or rejected everywhere
+	segments := strings.FieldsFunc(relPath, func(r rune) bool { return r == '/' || r == '\\' })
+	if len(segments) != strings.Count(relPath, "/")+strings.Count(relPath, `\`)+1 {
+		return "", fmt.Errorf("the key has an empty path segment")
+	}
+	for _, segment := range segments {
+		if segment == "." || segment == ".." || (runtime.GOOS == "windows" && strings.TrimRight(segment, ". ") == "") {
+			// Windows drops the trailing dots and spaces of names, so ". ." is ".." there
+			return "", fmt.Errorf("the key has a %q path segment", segment)
+		}
+	}
+	if name := segments[len(segments)-1]; isTempFile(name) || strings.HasSuffix(name, HydrationMarkerSuffix) {
+		return "", fmt.Errorf("the name %q is reserved for the files of the synchronizer", name)
+	}
+	return encodeRelativePath(relPath), nil
+}
+
+// Returns whether the given object is a directory marker, i.e., an empty object whose key ends in "/" such as the
+// folders created in the S3 console
+func isDirectoryMarker(item *s3.Object) bool {
+	return strings.HasSuffix(*item.Key, "/")
+}
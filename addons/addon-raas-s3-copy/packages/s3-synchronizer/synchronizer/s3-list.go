@@ -0,0 +1,177 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The delimiter used to partition a prefix into its sub-prefixes when listing prefixes concurrently
+const listingDelimiter = "/"
+
+// Lists the objects under the given prefix with a single chain of s3.ListObjectsV2 calls, fn is called with the
+// objects of each page as soon as the page is listed. Returns the error of the first call that fails after retries.
+func (s *Synchronizer) listObjects(ctx context.Context, svc *s3.S3, bucket string, prefix string, fn func(objects []*s3.Object)) error {
+	query := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	for ctx.Err() == nil {
+		var resp *s3.ListObjectsV2Output
+		err := s.retry(ctx, fmt.Sprintf("Listing bucket %v and prefix %v", bucket, prefix), func() error {
+			var err error
+			resp, err = svc.ListObjectsV2WithContext(ctx, query)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fn(resp.Contents)
+		if !aws.BoolValue(resp.IsTruncated) {
+			return nil
+		}
+		query.ContinuationToken = resp.NextContinuationToken
+	}
+	return ctx.Err()
+}
+
+// Lists the objects under the given prefix using the given number of concurrent listings. The prefix is partitioned
+// into its sub-prefixes using a "/" delimiter, each sub-prefix is partitioned again when it is listed and so on, so
+// every "directory" is listed separately and the listings run concurrently. fn is called with the objects of each
+// page as soon as the page is listed, from multiple goroutines. Returns the error of the first call that fails after
+// retries, the other listings are stopped then.
+//
+// Note that this makes one listing per "directory", it pays off for prefixes with many objects spread across
+// directories but is slower than listObjects for deep hierarchies with few objects per directory.
+func (s *Synchronizer) listObjectsConcurrently(ctx context.Context, svc *s3.S3, bucket string, prefix string, concurrency int, fn func(objects []*s3.Object)) error {
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := newPrefixQueue(prefix, cancel)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				nextPrefix, ok := queue.next()
+				if !ok {
+					return
+				}
+				queue.done(s.listObjectsOfPrefix(listCtx, svc, bucket, nextPrefix, fn, queue.add))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if queue.err != nil {
+		return queue.err
+	}
+	return ctx.Err()
+}
+
+// Lists the objects directly under the given prefix (i.e., up to the next "/"), fn is called with the objects of
+// each page and onPrefixes with the sub-prefixes found in each page
+func (s *Synchronizer) listObjectsOfPrefix(
+	ctx context.Context,
+	svc *s3.S3,
+	bucket string,
+	prefix string,
+	fn func(objects []*s3.Object),
+	onPrefixes func(prefixes []string),
+) error {
+	if s.debug {
+		s.logger.Println("Listing", bucket, "for sub-prefix", prefix)
+	}
+	query := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String(listingDelimiter),
+	}
+	for ctx.Err() == nil {
+		var resp *s3.ListObjectsV2Output
+		err := s.retry(ctx, fmt.Sprintf("Listing bucket %v and prefix %v", bucket, prefix), func() error {
+			var err error
+			resp, err = svc.ListObjectsV2WithContext(ctx, query)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.CommonPrefixes) > 0 {
+			prefixes := make([]string, 0, len(resp.CommonPrefixes))
+			for _, commonPrefix := range resp.CommonPrefixes {
+				prefixes = append(prefixes, aws.StringValue(commonPrefix.Prefix))
+			}
+			onPrefixes(prefixes)
+		}
+		fn(resp.Contents)
+		if !aws.BoolValue(resp.IsTruncated) {
+			return nil
+		}
+		query.ContinuationToken = resp.NextContinuationToken
+	}
+	return ctx.Err()
+}
+
+// The prefixes waiting to be listed by listObjectsConcurrently. The queue is drained once there are no pending
+// prefixes and no listing in progress (that could discover more prefixes), or once a listing fails.
+type prefixQueue struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	pending []string
+	// The number of prefixes being listed
+	active int
+	// The error of the first listing that failed
+	err    error
+	cancel context.CancelFunc
+}
+
+func newPrefixQueue(prefix string, cancel context.CancelFunc) *prefixQueue {
+	queue := &prefixQueue{pending: []string{prefix}, cancel: cancel}
+	queue.cond = sync.NewCond(&queue.lock)
+	return queue
+}
+
+// Returns the next prefix to list, waits while other listings may still discover prefixes. Returns false once the
+// queue is drained.
+func (queue *prefixQueue) next() (string, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for len(queue.pending) == 0 && queue.active > 0 && queue.err == nil {
+		queue.cond.Wait()
+	}
+	if len(queue.pending) == 0 || queue.err != nil {
+		return "", false
+	}
+	// Take the most recently discovered prefix so that the hierarchy is traversed depth first, this keeps the number
+	// of pending prefixes small
+	last := len(queue.pending) - 1
+	prefix := queue.pending[last]
+	queue.pending = queue.pending[:last]
+	queue.active++
+	return prefix, true
+}
+
+// Adds the given prefixes to list
+func (queue *prefixQueue) add(prefixes []string) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.pending = append(queue.pending, prefixes...)
+	queue.cond.Broadcast()
+}
+
+// Marks a listing taken using "next" as done, a non-nil error stops the other listings
+func (queue *prefixQueue) done(err error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.active--
+	if err != nil && queue.err == nil {
+		queue.err = err
+		queue.cancel()
+	}
+	queue.cond.Broadcast()
+}
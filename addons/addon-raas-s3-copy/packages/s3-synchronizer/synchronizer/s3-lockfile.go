@@ -0,0 +1,103 @@
+package synchronizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Parses the "asOf" time of a mount
+func parseAsOf(asOf string) (time.Time, error) {
+	return time.Parse(time.RFC3339, asOf)
+}
+
+// Reads the lockfile at the given path, a JSON object of S3 keys vs version ids
+func readLockfile(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the lockfile: %v", err)
+	}
+	versions := make(map[string]string)
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return nil, fmt.Errorf("error parsing the lockfile '%s': %v", path, err)
+	}
+	return versions, nil
+}
+
+// WriteLockfile writes a lockfile of the current state of the mount with the given id to the given path, i.e., the
+// version ids of the objects whose files are downloaded for the mount. Pinning a mount to the lockfile (see
+// Mount.Lockfile) materializes the same files again. The mount must be one of the synchronizer's mounts, it does not
+// need to be running. Returns an error if the version of a downloaded file is no longer in S3 (e.g., the bucket is not
+// versioned and the object changed since it was downloaded).
+func (s *Synchronizer) WriteLockfile(mountId string, path string) error {
+	config := s.findMountConfig(mountId)
+	if config == nil {
+		return fmt.Errorf("mount %q not found", mountId)
+	}
+
+	// The files downloaded from S3 by their S3 keys
+	downloaded := make(map[string]bool)
+	err := filepath.Walk(config.destination, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || isTempFile(path) || isHydrationMarker(path) {
+			return nil
+		}
+		key := s.fileKey(path, config)
+		if s.state.IsFileDownloadedFromS3(key) {
+			downloaded[key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Find the version of each downloaded file using the ETag recorded when the file was downloaded
+	ctx := context.Background()
+	versions := make(map[string]string, len(downloaded))
+	// The keys of the downloaded files whose version was found
+	found := make(map[string]bool, len(downloaded))
+	err = s.listObjectVersions(ctx, s.newS3ClientForBucket(ctx, config), config.bucket, listingPrefix(config.prefix), func(groups [][]objectVersion) {
+		for _, group := range groups {
+			// The keys of the local files are normalized, see Options.UnicodeNormalization
+			key := normalizeUnicode(group[0].key, config.normalization)
+			if !downloaded[key] {
+				continue
+			}
+			for _, version := range group {
+				if !version.deleteMarker && !s.state.HasFileChangedInS3(version.object) {
+					versions[version.key] = version.versionId
+					found[key] = true
+					break
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for key := range downloaded {
+		if !found[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("the versions of %d downloaded files are not in S3, e.g., '%s'", len(missing), missing[0])
+	}
+
+	content, err := json.MarshalIndent(versions, "", "\t")
+	if err != nil {
+		return err
+	}
+	if s.debug {
+		s.logger.Printf("Writing the versions of %d objects of mount %v to the lockfile '%s'\n", len(versions), mountId, path)
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
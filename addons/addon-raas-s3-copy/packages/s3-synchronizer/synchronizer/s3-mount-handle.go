@@ -0,0 +1,170 @@
+package synchronizer
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Keeps track of a mount that has been handed over to the download and upload workers so that the mount can be
+// torn down at runtime (e.g., when the mount is removed from the mounts file)
+type mountHandle struct {
+	config *mountConfiguration
+	// Cancelled to signal the download and upload workers of the mount to stop. The workers do not start new
+	// transfers once it is cancelled but let the in-flight ones complete.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Signals the recurring download loop to sync right away instead of waiting for the download interval
+	syncNowCh chan struct{}
+	// Keeps track of the go routines (recurring downloads and file watchers) running for the mount
+	wg sync.WaitGroup
+	// Makes sure only one sync from S3 runs for the mount at a time
+	syncLock sync.Mutex
+	// Guards "stopped" and "status"
+	lock    sync.Mutex
+	stopped bool
+	status  MountStatus
+}
+
+func newMountHandle(config *mountConfiguration) *mountHandle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mountHandle{
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		syncNowCh: make(chan struct{}, 1),
+		status: MountStatus{
+			Id:          config.id,
+			Bucket:      config.bucket,
+			Prefix:      config.prefix,
+			Destination: config.destination,
+			Writeable:   config.writeable,
+		},
+	}
+}
+
+// Registers the setup of the mount's workers with the mount's wait group so that "Stop" waits for the setup to
+// complete. Returns false if the mount was already stopped, in which case the workers must not be started.
+// The caller must call "handle.wg.Done()" once the setup is complete.
+func (handle *mountHandle) tryStart() bool {
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	if handle.stopped {
+		return false
+	}
+	handle.wg.Add(1)
+	return true
+}
+
+// Asks the recurring download loop to sync right away. Does nothing if a sync is already requested.
+func (handle *mountHandle) requestSync() {
+	select {
+	case handle.syncNowCh <- struct{}{}:
+	default:
+	}
+}
+
+func (handle *mountHandle) setRunning(running bool) {
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	handle.status.Running = running
+}
+
+// Records the outcome of a sync from S3 in the mount's status
+func (handle *mountHandle) recordSync(stats *downloadStats) {
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	handle.status.SyncCount++
+	handle.status.LastSyncStart = stats.start
+	handle.status.LastSyncEnd = stats.end
+	handle.status.LastSyncDownloadedFiles = stats.numberOfRetrievedFiles
+	handle.status.LastSyncDownloadedBytes = stats.totalRetrievedBytes
+	handle.status.LastSyncErrors = make([]string, 0, len(stats.errorPrefixes))
+	for _, p := range stats.errorPrefixes {
+		handle.status.LastSyncErrors = append(handle.status.LastSyncErrors, *p)
+	}
+	handle.status.LastSyncError = ""
+	if stats.syncError != nil {
+		handle.status.LastSyncError = stats.syncError.Error()
+	}
+	handle.status.LastSyncBytesNeeded = stats.bytesNeeded
+	handle.status.LastSyncObjectsOverQuota = stats.objectsOverQuota
+	handle.status.LastSyncObjectsOverDiskSpace = make([]string, 0, len(stats.objectsOverDiskSpace))
+	for _, p := range stats.objectsOverDiskSpace {
+		handle.status.LastSyncObjectsOverDiskSpace = append(handle.status.LastSyncObjectsOverDiskSpace, *p)
+	}
+	handle.status.LastSyncEvictedFiles = stats.evictedFiles
+	handle.status.LastSyncHydratedFiles = stats.hydratedFiles
+	handle.status.LastSyncArchivedObjects = make([]string, 0, len(stats.archivedObjects))
+	for _, p := range stats.archivedObjects {
+		handle.status.LastSyncArchivedObjects = append(handle.status.LastSyncArchivedObjects, *p)
+	}
+	handle.status.LastSyncRestoresStarted = stats.restoresStarted
+	handle.status.LastSyncRejectedKeys = make([]string, 0, len(stats.rejectedKeys))
+	for _, p := range stats.rejectedKeys {
+		handle.status.LastSyncRejectedKeys = append(handle.status.LastSyncRejectedKeys, *p)
+	}
+	handle.status.LastSyncCollidingKeys = make([]string, 0, len(stats.collidingKeys))
+	for _, p := range stats.collidingKeys {
+		handle.status.LastSyncCollidingKeys = append(handle.status.LastSyncCollidingKeys, *p)
+	}
+	handle.status.LastSyncIntegrityMismatches = make([]string, 0, len(stats.integrityMismatches))
+	for _, p := range stats.integrityMismatches {
+		handle.status.LastSyncIntegrityMismatches = append(handle.status.LastSyncIntegrityMismatches, *p)
+	}
+	handle.status.LastSyncIntegrityMismatchBytes = stats.integrityMismatchBytes
+}
+
+// Returns a copy of the mount's status
+func (handle *mountHandle) Status() MountStatus {
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	status := handle.status
+	status.LastSyncErrors = append([]string(nil), handle.status.LastSyncErrors...)
+	status.LastSyncIntegrityMismatches = append([]string(nil), handle.status.LastSyncIntegrityMismatches...)
+	status.LastSyncObjectsOverDiskSpace = append([]string(nil), handle.status.LastSyncObjectsOverDiskSpace...)
+	status.LastSyncArchivedObjects = append([]string(nil), handle.status.LastSyncArchivedObjects...)
+	status.LastSyncRejectedKeys = append([]string(nil), handle.status.LastSyncRejectedKeys...)
+	status.LastSyncCollidingKeys = append([]string(nil), handle.status.LastSyncCollidingKeys...)
+	status.LowDiskSpace = atomic.LoadInt32(&handle.config.pausedDownloads) > 0
+	if handle.config.cache != nil {
+		status.CachedBytes = handle.config.cache.residentBytes()
+	}
+	return status
+}
+
+// Stops the recurring downloads and the file watchers of the mount and waits for them to complete.
+// Any file changes already queued up for upload are uploaded before the file watchers stop.
+// If removeLocalFiles is true, the mount's destination directory is deleted from the local file system after the
+// workers have stopped, otherwise the local files are left in place.
+func (handle *mountHandle) Stop(removeLocalFiles bool, logger *log.Logger, debug bool) error {
+	handle.lock.Lock()
+	if !handle.stopped {
+		handle.stopped = true
+		handle.cancel()
+	}
+	handle.lock.Unlock()
+
+	// Wait for the in-flight download and upload to complete
+	handle.wg.Wait()
+	handle.setRunning(false)
+	if debug {
+		logger.Println("Stopped mount with destination", handle.config.destination)
+	}
+
+	if !removeLocalFiles {
+		return nil
+	}
+	if debug {
+		logger.Println("Deleting local files of the mount from", handle.config.destination)
+	}
+	// The synchronizer state entries of the deleted files are intentionally left behind, if the mount is
+	// added again the files no longer exist locally and are therefore downloaded again
+	err := os.RemoveAll(handle.config.destination)
+	if err != nil {
+		logger.Printf("Error deleting local files of the mount from \"%s\". Error: %v\n", handle.config.destination, err)
+	}
+	return err
+}
@@ -0,0 +1,34 @@
+package synchronizer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// GetMountsFromFile is a function that returns S3 mounts information from the given "mountsFile"
+// Files with ".yaml" or ".yml" extension are parsed as YAML, all other files are parsed as JSON.
+// In both cases the file is expected to contain an array of mounts with the same attributes as the "defaultS3Mounts"
+// argument, see "GetDefaultMounts" for details.
+func GetMountsFromFile(mountsFile string) (*[]Mount, error) {
+	content, err := ioutil.ReadFile(mountsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]Mount, 0)
+	switch strings.ToLower(filepath.Ext(mountsFile)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &mounts)
+	default:
+		err = json.Unmarshal(content, &mounts)
+	}
+	if err != nil {
+		return &mounts, err
+	}
+	setMountDefaults(mounts)
+	return &mounts, ValidateMounts(mounts)
+}
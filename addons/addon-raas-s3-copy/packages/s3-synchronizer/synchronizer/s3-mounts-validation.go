@@ -0,0 +1,162 @@
+package synchronizer
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Bucket naming rules as per https://docs.aws.amazon.com/AmazonS3/latest/userguide/bucketnamingrules.html
+var bucketNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// KMS key ARN (or key alias ARN) e.g., arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab
+var kmsKeyArnRegex = regexp.MustCompile(`^arn:aws[a-z-]*:kms:[a-z0-9-]+:[0-9]{12}:(key|alias)/[a-zA-Z0-9/_+=,.@-]+$`)
+
+// MountValidationError holds all the problems found while validating the mounts so they can be reported at once
+type MountValidationError struct {
+	Problems []string
+}
+
+func (e *MountValidationError) Error() string {
+	return fmt.Sprintf("invalid mounts, found %d problem(s):\n- %s", len(e.Problems), strings.Join(e.Problems, "\n- "))
+}
+
+// ValidateMounts validates the given mounts and returns a *MountValidationError listing all the problems found, if any.
+// The validation makes sure that:
+//   - the required attributes (id, bucket and prefix) are present, the ids are unique and can be safely used as a
+//     directory name under the destination and the bucket names are valid
+//   - the KMS key ids are well formed KMS key ARNs and the expected bucket owners are 12-digit AWS account ids
+//   - the rate limits, quotas (maxBytes and maxObjects) and cache sizes are not negative, and writeable mounts are
+//     not in cache mode
+//   - restoreDays is at least 1 and restoreTier is a valid retrieval tier
+//   - asOf is an RFC 3339 time, it is not used together with lockfile and neither is used by writeable mounts
+func ValidateMounts(mounts []Mount) error {
+	var problems []string
+	addProblem := func(idx int, mount *Mount, format string, args ...interface{}) {
+		mountDesc := fmt.Sprintf("mount at index %d", idx)
+		if mount.Id != nil && *mount.Id != "" {
+			mountDesc = fmt.Sprintf("%s (id %q)", mountDesc, *mount.Id)
+		}
+		problems = append(problems, mountDesc+": "+fmt.Sprintf(format, args...))
+	}
+
+	// Map of mount id vs index of the first mount with that id
+	seenIds := make(map[string]int, len(mounts))
+	for i := range mounts {
+		mount := &mounts[i]
+
+		if mount.Id == nil || strings.TrimSpace(*mount.Id) == "" {
+			addProblem(i, mount, "id is missing or empty")
+		} else {
+			id := *mount.Id
+			if firstIdx, exists := seenIds[id]; exists {
+				addProblem(i, mount, "id is a duplicate of the id of the mount at index %d", firstIdx)
+			} else {
+				seenIds[id] = i
+			}
+			if problem := checkMountId(id); problem != "" {
+				addProblem(i, mount, "id %s", problem)
+			}
+		}
+
+		if mount.Bucket == nil || *mount.Bucket == "" {
+			addProblem(i, mount, "bucket is missing or empty")
+		} else if problem := checkBucketName(*mount.Bucket); problem != "" {
+			addProblem(i, mount, "bucket name %q %s", *mount.Bucket, problem)
+		}
+
+		if mount.Prefix == nil {
+			addProblem(i, mount, "prefix is missing")
+		}
+
+		if mount.KmsKeyId != nil && *mount.KmsKeyId != "" && !kmsKeyArnRegex.MatchString(*mount.KmsKeyId) {
+			addProblem(i, mount, "kmsKeyId %q is not a valid KMS key ARN", *mount.KmsKeyId)
+		}
+
+		if mount.DownloadRateLimit != nil && *mount.DownloadRateLimit < 0 {
+			addProblem(i, mount, "downloadRateLimit %d must not be negative", *mount.DownloadRateLimit)
+		}
+		if mount.UploadRateLimit != nil && *mount.UploadRateLimit < 0 {
+			addProblem(i, mount, "uploadRateLimit %d must not be negative", *mount.UploadRateLimit)
+		}
+		if mount.MaxBytes != nil && *mount.MaxBytes < 0 {
+			addProblem(i, mount, "maxBytes %d must not be negative", *mount.MaxBytes)
+		}
+		if mount.MaxObjects != nil && *mount.MaxObjects < 0 {
+			addProblem(i, mount, "maxObjects %d must not be negative", *mount.MaxObjects)
+		}
+		if mount.CacheBytes != nil && *mount.CacheBytes < 0 {
+			addProblem(i, mount, "cacheBytes %d must not be negative", *mount.CacheBytes)
+		} else if mount.CacheBytes != nil && *mount.CacheBytes > 0 && mount.Writeable != nil && *mount.Writeable {
+			addProblem(i, mount, "cacheBytes is not supported for writeable mounts")
+		}
+		if mount.RestoreDays != nil && *mount.RestoreDays < 1 {
+			addProblem(i, mount, "restoreDays %d must be at least 1", *mount.RestoreDays)
+		}
+		if mount.RestoreTier != nil && !restoreTiers[*mount.RestoreTier] {
+			addProblem(i, mount, "restoreTier %q must be one of Standard, Bulk or Expedited", *mount.RestoreTier)
+		}
+		pinned := false
+		if mount.AsOf != nil && *mount.AsOf != "" {
+			pinned = true
+			if _, err := parseAsOf(*mount.AsOf); err != nil {
+				addProblem(i, mount, "asOf %q is not a valid RFC 3339 time", *mount.AsOf)
+			}
+		}
+		if mount.Lockfile != nil && *mount.Lockfile != "" {
+			if pinned {
+				addProblem(i, mount, "asOf and lockfile cannot be used together")
+			}
+			pinned = true
+		}
+		if pinned && mount.Writeable != nil && *mount.Writeable {
+			addProblem(i, mount, "asOf and lockfile are not supported for writeable mounts")
+		}
+		if mount.ExpectedBucketOwner != nil && *mount.ExpectedBucketOwner != "" && !accountIdRegex.MatchString(*mount.ExpectedBucketOwner) {
+			addProblem(i, mount, "expectedBucketOwner %q is not a valid 12-digit AWS account id", *mount.ExpectedBucketOwner)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &MountValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Returns a description of the problem with the given mount id or empty string if the id is valid.
+// The mount id is used as the name of the directory the mount is downloaded to (under the destination directory)
+// so it must be a single path element that does not escape the destination directory.
+func checkMountId(id string) string {
+	switch {
+	case id == "." || id == "..":
+		return "must not be a relative path reference"
+	case strings.ContainsAny(id, `/\`):
+		return "must not contain path separators"
+	case strings.ContainsRune(id, 0):
+		return "must not contain NUL characters"
+	case strings.Contains(id, ":"):
+		// Drive letters (e.g., "C:") and alternate data streams on Windows
+		return "must not contain colons"
+	}
+	return ""
+}
+
+// Returns a description of the problem with the given bucket name or empty string if the name is valid
+func checkBucketName(bucket string) string {
+	switch {
+	case len(bucket) < 3 || len(bucket) > 63:
+		return "must be between 3 and 63 characters long"
+	case !bucketNameRegex.MatchString(bucket):
+		return "must consist of lowercase letters, numbers, dots and hyphens and begin and end with a letter or number"
+	case strings.Contains(bucket, ".."):
+		return "must not contain two adjacent periods"
+	case net.ParseIP(bucket) != nil:
+		return "must not be formatted as an IP address"
+	case strings.HasPrefix(bucket, "xn--"):
+		return "must not start with the prefix \"xn--\""
+	case strings.HasSuffix(bucket, "-s3alias"):
+		return "must not end with the suffix \"-s3alias\""
+	}
+	return ""
+}
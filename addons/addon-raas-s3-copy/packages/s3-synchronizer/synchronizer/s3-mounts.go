@@ -0,0 +1,127 @@
+package synchronizer
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mount describes an S3 location (bucket and prefix) to synchronize with a local directory named after the mount's id.
+// Use pointers in this struct so its easy to tell if a value was not in JSON (ie the ptr is nil)
+type Mount struct {
+	Id        *string `json:"id,omitempty" yaml:"id,omitempty"`
+	Bucket    *string `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Prefix    *string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Writeable *bool   `json:"writeable,omitempty" yaml:"writeable,omitempty"`
+	KmsKeyId  *string `json:"kmsKeyId,omitempty" yaml:"kmsKeyId,omitempty"`
+	// Optional limits of the download and upload rates of the mount in bytes per second, ZERO means unlimited.
+	// The limits apply in addition to the global limits and can be changed without restarting the mount.
+	DownloadRateLimit *int64 `json:"downloadRateLimit,omitempty" yaml:"downloadRateLimit,omitempty"`
+	UploadRateLimit   *int64 `json:"uploadRateLimit,omitempty" yaml:"uploadRateLimit,omitempty"`
+	// Optional quota of the mount, the total size in bytes and the number of the objects downloaded for the mount.
+	// ZERO means unlimited.
+	MaxBytes   *int64 `json:"maxBytes,omitempty" yaml:"maxBytes,omitempty"`
+	MaxObjects *int64 `json:"maxObjects,omitempty" yaml:"maxObjects,omitempty"`
+	// Optional budget in bytes of the mount's local cache, ZERO means the mount is not in cache mode. In cache mode,
+	// the least recently used files are evicted to placeholders to keep the downloaded files within the budget.
+	// Only supported for mounts that are not writeable.
+	CacheBytes *int64 `json:"cacheBytes,omitempty" yaml:"cacheBytes,omitempty"`
+	// Optional, whether to restore the objects of the mount in the GLACIER or DEEP_ARCHIVE storage class so that they
+	// are downloaded once the restore completes, for how many days the restored copies are kept and the retrieval
+	// tier of the restores (Standard, Bulk or Expedited). Archived objects are skipped by default.
+	RestoreArchived *bool   `json:"restoreArchived,omitempty" yaml:"restoreArchived,omitempty"`
+	RestoreDays     *int64  `json:"restoreDays,omitempty" yaml:"restoreDays,omitempty"`
+	RestoreTier     *string `json:"restoreTier,omitempty" yaml:"restoreTier,omitempty"`
+	// Optional, pins the mount to a snapshot of a versioned bucket instead of the latest objects: either the versions
+	// current at the "asOf" time (RFC 3339, e.g., "2020-10-01T00:00:00Z") or the versions listed in the JSON lockfile
+	// at the "lockfile" path (see Synchronizer.WriteLockfile). Only supported for mounts that are not writeable.
+	AsOf     *string `json:"asOf,omitempty" yaml:"asOf,omitempty"`
+	Lockfile *string `json:"lockfile,omitempty" yaml:"lockfile,omitempty"`
+	// Optional, whether the bucket is a requester-pays bucket (i.e., the S3 calls are charged to the caller's account)
+	// and the account id the bucket must be owned by, the S3 calls fail with AccessDenied if the bucket is owned by
+	// another account. Both apply to every S3 call made for the mount.
+	RequesterPays       *bool   `json:"requesterPays,omitempty" yaml:"requesterPays,omitempty"`
+	ExpectedBucketOwner *string `json:"expectedBucketOwner,omitempty" yaml:"expectedBucketOwner,omitempty"`
+}
+
+// Returns a string identifying the mount, any change to the mount's attributes results in a different string.
+// The rate limits are not part of the string as they are applied to the running mount when they change. The string
+// attributes are quoted so that distinct mounts never result in the same string (e.g., bucket "ab" with prefix "c/"
+// and bucket "a" with prefix "bc/").
+func mountToString(mount *Mount) string {
+	return strings.Join([]string{
+		strconv.Quote(*mount.Bucket), strconv.Quote(*mount.Prefix), strconv.Quote(*mount.Id),
+		strconv.FormatBool(*mount.Writeable), strconv.Quote(*mount.KmsKeyId),
+		strconv.FormatInt(*mount.MaxBytes, 10), strconv.FormatInt(*mount.MaxObjects, 10), strconv.FormatInt(*mount.CacheBytes, 10),
+		strconv.FormatBool(*mount.RestoreArchived), strconv.FormatInt(*mount.RestoreDays, 10), strconv.Quote(*mount.RestoreTier),
+		strconv.Quote(*mount.AsOf), strconv.Quote(*mount.Lockfile),
+		strconv.FormatBool(*mount.RequesterPays), strconv.Quote(*mount.ExpectedBucketOwner),
+	}, "|")
+}
+
+func Bool(v bool) *bool       { return &v }
+func String(v string) *string { return &v }
+func Int64(v int64) *int64    { return &v }
+
+// Returns S3 object key based on file path and mountConfiguration
+func ToS3Key(filePath string, config *mountConfiguration) string {
+	return ToS3KeyForFile(filePath, config.prefix, config.destination, config.normalization)
+}
+
+// Returns S3 object key based on file path, prefix and sync dir. The file path is decoded into the key of the object it
+// was downloaded from, the inverse of the mapping of the keys to the local paths (see encodeRelativePath). The path is
+// normalized to the given Unicode normalization form first (see Options.UnicodeNormalization) as the file system may
+// have stored the name in another form. The key of a file downloaded from a key in another form is recorded in the state,
+// see SynchronizerState.OriginalKey.
+func ToS3KeyForFile(filePath string, prefix string, syncDir string, normalization string) string {
+	return keyForLocalPath(localPathForFile(filePath, syncDir, normalization), prefix)
+}
+
+// Returns the path (with forward slashes) of the given file relative to the given sync dir in the given Unicode
+// normalization form
+func localPathForFile(filePath string, syncDir string, normalization string) string {
+	normalizedSyncDir := filepath.ToSlash(syncDir)
+	normalizedFilePath := filepath.ToSlash(filePath)
+	s3FilePath := strings.TrimPrefix(normalizedFilePath, normalizedSyncDir)
+	// if s3 file path starts with a trailing slash then remove extra slash
+	if strings.HasPrefix(s3FilePath, "/") {
+		s3FilePath = strings.TrimPrefix(s3FilePath, "/")
+	}
+	return normalizeUnicode(s3FilePath, normalization)
+}
+
+// Returns the key of the given local path (with forward slashes) relative to the destination of the mount with the
+// given prefix
+func keyForLocalPath(localPath string, prefix string) string {
+	// if prefix ends with trailing slash then remove extra slash
+	s3Prefix := filepath.ToSlash(prefix)
+	if strings.HasSuffix(s3Prefix, "/") {
+		s3Prefix = strings.TrimSuffix(s3Prefix, "/")
+	}
+
+	s3Key := s3Prefix + "/" + decodeRelativePath(localPath)
+	return s3Key
+}
+
+// Returns the key of the object the given file of the given mount was downloaded from, like ToS3Key, once the names
+// suffixed by the resolution of the case collisions are mapped back to the names of their keys, see caseCollisions.
+// Only the suffixed names recorded in the state are mapped back, a file created locally keeps its name in its key.
+func (s *Synchronizer) fileKey(filePath string, config *mountConfiguration) string {
+	localPath := localPathForFile(filePath, config.destination, config.normalization)
+	return keyForLocalPath(s.unsuffixedLocalPath(localPath, config), config.prefix)
+}
+
+// Returns the configuration of the running mount with the given destination, bucket and prefix, or the configuration
+// of a mount without any recorded local paths if there is no such mount. Used by the file watchers, which only know
+// the destination, bucket and prefix of their mount.
+func (s *Synchronizer) mountConfigForFiles(syncDir string, bucket string, prefix string) *mountConfiguration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, handle := range s.mounts {
+		config := handle.config
+		if config.destination == syncDir && config.bucket == bucket && config.prefix == prefix {
+			return config
+		}
+	}
+	return &mountConfiguration{destination: syncDir, bucket: bucket, prefix: prefix, normalization: s.options.UnicodeNormalization}
+}
@@ -0,0 +1,64 @@
+package synchronizer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The user metadata key (i.e., the "x-amz-meta-mtime" header) holding the modification time of the file an object was
+// uploaded from. The value is the number of seconds since the Unix epoch with an optional fractional part
+// (e.g., "1608227935.123456789"), the same format other tools like rclone use.
+const mtimeMetadataKey = "mtime"
+
+// Formats the given modification time as the value of the "mtime" user metadata
+func formatMtime(mtime time.Time) string {
+	return fmt.Sprintf("%d.%09d", mtime.Unix(), mtime.Nanosecond())
+}
+
+// Parses the value of the "mtime" user metadata
+func parseMtime(value string) (time.Time, error) {
+	parts := strings.SplitN(strings.TrimSpace(value), ".", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid mtime %q: %v", value, err)
+	}
+	var nanoseconds int64
+	if len(parts) == 2 && parts[1] != "" {
+		// Right pad the fraction to nanoseconds, any digits beyond nanoseconds are ignored
+		fraction := (parts[1] + "000000000")[:9]
+		nanoseconds, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid mtime %q: %v", value, err)
+		}
+	}
+	return time.Unix(seconds, nanoseconds), nil
+}
+
+// Sets the modification time of the given downloaded file to the modification time recorded in the object's "mtime"
+// user metadata if present, otherwise to the object's LastModified time
+func (s *Synchronizer) setLocalMtime(path string, item *s3.Object, metadataMtime string) {
+	var mtime time.Time
+	if metadataMtime != "" {
+		parsed, err := parseMtime(metadataMtime)
+		if err == nil {
+			mtime = parsed
+		} else {
+			s.logger.Printf("Ignoring the mtime metadata of '%v': %v\n", *item.Key, err)
+		}
+	}
+	if mtime.IsZero() && item.LastModified != nil {
+		mtime = *item.LastModified
+	}
+	if mtime.IsZero() {
+		return
+	}
+	err := os.Chtimes(path, time.Now(), mtime)
+	if err != nil {
+		s.logger.Printf("Error setting the modification time of \"%s\". Error: %v\n", path, err)
+	}
+}
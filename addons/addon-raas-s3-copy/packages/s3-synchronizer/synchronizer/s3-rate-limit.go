@@ -0,0 +1,120 @@
+package synchronizer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// The maximum number of bytes read at a time from a throttled reader so that large reads do not burst
+const throttledReadSize = 64 * 1024
+
+// Limits the rate of transfers to a number of bytes per second using a token bucket that holds up to one second
+// worth of bytes. The limit can be changed at any time, a limit of ZERO or less means unlimited.
+// A nil *rateLimiter does not limit anything.
+type rateLimiter struct {
+	lock  sync.Mutex
+	limit int64
+	// The number of bytes that can be transferred right away, negative when the transfers are ahead of the limit
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit int64) *rateLimiter {
+	return &rateLimiter{limit: limit, tokens: float64(limit), last: time.Now()}
+}
+
+// Changes the limit, the transfers in progress adapt to the new limit right away
+func (l *rateLimiter) setLimit(limit int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.limit = limit
+	if l.tokens > float64(limit) {
+		l.tokens = float64(limit)
+	}
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	if l.limit > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+		if l.tokens > float64(l.limit) {
+			l.tokens = float64(l.limit)
+		}
+	}
+	l.last = now
+}
+
+// Waits until the given number of bytes can be transferred without exceeding the limit, or until ctx is cancelled
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	if l.limit <= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.limit) * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Waits until the given number of bytes can be transferred without exceeding any of the given limits
+func waitForRateLimiters(ctx context.Context, limiters []*rateLimiter, n int) error {
+	for _, limiter := range limiters {
+		if err := limiter.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Throttles the writes to the wrapped io.WriterAt, used for the s3manager downloads
+type throttledWriterAt struct {
+	ctx      context.Context
+	w        io.WriterAt
+	limiters []*rateLimiter
+}
+
+func (t *throttledWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := waitForRateLimiters(t.ctx, t.limiters, len(p)); err != nil {
+		return 0, err
+	}
+	return t.w.WriteAt(p, off)
+}
+
+// Throttles the reads from the wrapped io.Reader, used for the ranged downloads and the s3manager uploads
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttledReadSize {
+		p = p[:throttledReadSize]
+	}
+	n, err := t.r.Read(p)
+	if waitErr := waitForRateLimiters(t.ctx, t.limiters, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
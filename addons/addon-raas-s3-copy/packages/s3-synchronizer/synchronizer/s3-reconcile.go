@@ -0,0 +1,239 @@
+package synchronizer
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The number of paths kept in memory by a pathSpill before they are sorted and spilled to a file on disk. This bounds
+// the memory used to reconcile the local files with the listing of prefixes with millions of objects.
+var spillChunkSize = 100000
+
+// Collects the local paths (relative to the mount's destination, with forward slashes) of the listed objects in
+// sorted chunks on disk so that they can be read back in sorted order with bounded memory, see sortedPaths.
+// The caller must call "close" to delete the spilled files.
+type pathSpill struct {
+	chunk []string
+	runs  []string
+}
+
+func newPathSpill() *pathSpill {
+	return &pathSpill{}
+}
+
+// Adds the given relative path to the set
+func (spill *pathSpill) add(relPath string) error {
+	spill.chunk = append(spill.chunk, relPath)
+	if len(spill.chunk) >= spillChunkSize {
+		return spill.flush()
+	}
+	return nil
+}
+
+// Sorts the paths in memory and writes them to a new run file
+func (spill *pathSpill) flush() error {
+	if len(spill.chunk) == 0 {
+		return nil
+	}
+	sort.Strings(spill.chunk)
+	file, err := ioutil.TempFile("", "s3-synchronizer-paths-")
+	if err != nil {
+		return err
+	}
+	spill.runs = append(spill.runs, file.Name())
+	w := bufio.NewWriter(file)
+	for _, path := range spill.chunk {
+		err = writePath(w, path)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	spill.chunk = spill.chunk[:0]
+	return err
+}
+
+// Returns the paths added to the set in sorted (byte-wise) order
+func (spill *pathSpill) sortedPaths() (*sortedPaths, error) {
+	if err := spill.flush(); err != nil {
+		return nil, err
+	}
+	paths := &sortedPaths{}
+	for _, run := range spill.runs {
+		file, err := os.Open(run)
+		if err != nil {
+			paths.close()
+			return nil, err
+		}
+		reader := &runReader{file: file, r: bufio.NewReader(file)}
+		paths.files = append(paths.files, file)
+		if err := reader.advance(); err != nil {
+			paths.close()
+			return nil, err
+		}
+		if !reader.done {
+			heap.Push(&paths.readers, reader)
+		}
+	}
+	return paths, nil
+}
+
+// Deletes the spilled files
+func (spill *pathSpill) close() {
+	for _, run := range spill.runs {
+		os.Remove(run)
+	}
+	spill.runs = nil
+	spill.chunk = nil
+}
+
+// The paths are written with their length as prefix as S3 keys may contain new lines
+func writePath(w *bufio.Writer, path string) error {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(path)))
+	if _, err := w.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err := w.WriteString(path)
+	return err
+}
+
+type runReader struct {
+	file    *os.File
+	r       *bufio.Reader
+	current string
+	done    bool
+}
+
+// Reads the next path of the run
+func (reader *runReader) advance() error {
+	length, err := binary.ReadUvarint(reader.r)
+	if err == io.EOF {
+		reader.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(reader.r, buf); err != nil {
+		return err
+	}
+	reader.current = string(buf)
+	return nil
+}
+
+type runReaderHeap []*runReader
+
+func (h runReaderHeap) Len() int            { return len(h) }
+func (h runReaderHeap) Less(i, j int) bool  { return h[i].current < h[j].current }
+func (h runReaderHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runReaderHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runReaderHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// Merges the sorted runs of a pathSpill, duplicates are returned once
+type sortedPaths struct {
+	readers runReaderHeap
+	files   []*os.File
+	last    string
+	started bool
+}
+
+// Returns the next path, or false if there are no more paths
+func (paths *sortedPaths) next() (string, bool, error) {
+	for paths.readers.Len() > 0 {
+		reader := paths.readers[0]
+		path := reader.current
+		if err := reader.advance(); err != nil {
+			return "", false, err
+		}
+		if reader.done {
+			heap.Pop(&paths.readers)
+		} else {
+			heap.Fix(&paths.readers, 0)
+		}
+		if paths.started && path == paths.last {
+			continue
+		}
+		paths.started = true
+		paths.last = path
+		return path, true, nil
+	}
+	return "", false, nil
+}
+
+func (paths *sortedPaths) close() {
+	for _, file := range paths.files {
+		file.Close()
+	}
+}
+
+// Walks the files under the given root in the byte-wise order of their paths relative to root (with forward
+// slashes), i.e., the order S3 lists keys in. Only one directory is held in memory at a time. Errors reading a
+// directory are passed to fn with a nil info, like filepath.Walk does. The directories under root are passed to fn
+// after their contents so that fn can delete the directories emptied by the deletion of their contents. The relative
+// paths are in the given Unicode normalization form (see Options.UnicodeNormalization), case-folded on case-insensitive
+// file systems (see foldCase) and sorted as such.
+func walkSorted(root string, normalization string, fn func(path string, relPath string, info os.FileInfo, err error) error) error {
+	return walkSortedDir(root, "", normalization, fn)
+}
+
+func walkSortedDir(dir string, relDir string, normalization string, fn func(path string, relPath string, info os.FileInfo, err error) error) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fn(dir, relDir, nil, err)
+	}
+	// A directory's files sort as "<name>/<file>" so "a-b" and "a.b" come before the files of the directory "a"
+	sortKey := func(info os.FileInfo) string {
+		if info.IsDir() {
+			return foldCase(normalizeUnicode(info.Name(), normalization)) + "/"
+		}
+		return foldCase(normalizeUnicode(info.Name(), normalization))
+	}
+	sort.Slice(infos, func(i, j int) bool { return sortKey(infos[i]) < sortKey(infos[j]) })
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		relPath := foldCase(normalizeUnicode(info.Name(), normalization))
+		if relDir != "" {
+			relPath = relDir + "/" + relPath
+		}
+		if info.IsDir() {
+			if err := walkSortedDir(path, relPath, normalization, fn); err != nil {
+				return err
+			}
+		}
+		if err := fn(path, relPath, info, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns whether the given directory is empty. Returns false if the directory cannot be read.
+func isEmptyDir(path string) bool {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	_, err = dir.Readdirnames(1)
+	return err == io.EOF
+}
@@ -0,0 +1,171 @@
+package synchronizer
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// The class of an error returned by an S3 call, it determines whether and how soon the call is retried
+type errorClass int
+
+const (
+	// The request was throttled (e.g., SlowDown or 503), retried with a longer backoff
+	errorClassThrottling errorClass = iota
+	// Network errors, timeouts and server errors, retried
+	errorClassTransient
+	// Errors that do not go away by retrying (e.g., AccessDenied or NoSuchBucket), not retried
+	errorClassPermanent
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorClassThrottling:
+		return "throttling"
+	case errorClassTransient:
+		return "transient"
+	default:
+		return "permanent"
+	}
+}
+
+// The error codes S3 and STS use when throttling requests
+var throttlingErrorCodes = map[string]bool{
+	"SlowDown":                               true,
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"RequestLimitExceeded":                   true,
+	"ProvisionedThroughputExceededException": true,
+	"BandwidthLimitExceeded":                 true,
+}
+
+// The error codes that do not go away by retrying
+var permanentErrorCodes = map[string]bool{
+	"AccessDenied":                 true,
+	"AllAccessDisabled":            true,
+	"AccountProblem":               true,
+	"InvalidAccessKeyId":           true,
+	"SignatureDoesNotMatch":        true,
+	"ExpiredToken":                 true,
+	"InvalidToken":                 true,
+	"NoSuchBucket":                 true,
+	"NoSuchKey":                    true,
+	"NotFound":                     true,
+	"InvalidBucketName":            true,
+	"InvalidObjectState":           true,
+	"RestoreAlreadyInProgress":     true,
+	"PermanentRedirect":            true,
+	"AuthorizationHeaderMalformed": true,
+	"PreconditionFailed":           true,
+	"InvalidRange":                 true,
+}
+
+// Classifies the given error returned by an S3 call
+func classifyError(err error) errorClass {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return errorClassPermanent
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		code := aerr.Code()
+		if code == request.CanceledErrorCode {
+			return errorClassPermanent
+		}
+		if throttlingErrorCodes[code] {
+			return errorClassThrottling
+		}
+		if permanentErrorCodes[code] {
+			return errorClassPermanent
+		}
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			status := reqErr.StatusCode()
+			switch {
+			case status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests:
+				return errorClassThrottling
+			case status >= 500 || status == http.StatusRequestTimeout:
+				return errorClassTransient
+			case status >= 400:
+				return errorClassPermanent
+			}
+		}
+		// Errors without a response (e.g., connection reset) are network errors
+		return errorClassTransient
+	}
+	// Anything else is most likely a network error
+	return errorClassTransient
+}
+
+// Controls how failed S3 calls are retried. The delay before the nth retry is "baseDelay * 2^(n-1)" capped at
+// maxDelay, randomly reduced by up to half (jitter). Throttled calls start from throttlingBaseDelay instead.
+type retryPolicy struct {
+	maxAttempts         int
+	baseDelay           time.Duration
+	throttlingBaseDelay time.Duration
+	maxDelay            time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxAttempts:         5,
+	baseDelay:           1 * time.Second,
+	throttlingBaseDelay: 5 * time.Second,
+	maxDelay:            60 * time.Second,
+}
+
+var jitterLock sync.Mutex
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// Returns the delay before retrying a call that failed with an error of the given class for the given attempt
+func (p retryPolicy) backoff(class errorClass, attempt int) time.Duration {
+	delay := p.baseDelay
+	if class == errorClassThrottling {
+		delay = p.throttlingBaseDelay
+	}
+	for i := 1; i < attempt && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return delay/2 + time.Duration(jitterRand.Int63n(int64(delay/2)+1))
+}
+
+// Calls the given function until it succeeds, fails with a permanent error or the maximum number of attempts is
+// reached, backing off between the attempts as per the synchronizer's retry policy. Returns the last error.
+// Gives up right away when ctx is cancelled.
+func (s *Synchronizer) retry(ctx context.Context, operation string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		class := classifyError(err)
+		if class == errorClassPermanent || attempt >= s.retryPolicy.maxAttempts || ctx.Err() != nil {
+			if attempt > 1 {
+				s.logger.Printf("%s failed after %d attempts, giving up: %v\n", operation, attempt, err)
+			}
+			return err
+		}
+		delay := s.retryPolicy.backoff(class, attempt)
+		s.logger.Printf("%s failed with a %v error (attempt %d of %d), retrying in %v: %v\n", operation, class, attempt, s.retryPolicy.maxAttempts, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package synchronizer
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The Unicode normalization policies of the keys and the local paths, see Options.UnicodeNormalization. The same name
+// may be written in different forms by different clients (e.g., "é" as the single character U+00E9 in NFC or as "e"
+// followed by the combining accent U+0301 in NFD, as written by macOS) and some file systems change the form of the
+// names they store. With a policy, the keys are mapped to local paths in the policy's form, the local paths read back
+// are normalized before they are compared with the listed keys and the state uses the normalized keys. The files created
+// locally are uploaded to their normalized keys, the downloaded files to the keys of their objects (see
+// SynchronizerState.OriginalKey).
+const (
+	// Composed characters, as written by most Linux and Windows tools
+	UnicodeNormalizationNFC = "NFC"
+	// Decomposed characters, as written by macOS
+	UnicodeNormalizationNFD = "NFD"
+)
+
+// Returns the given key or path in the given normalization form, unchanged without a normalization policy
+func normalizeUnicode(value string, normalization string) string {
+	switch normalization {
+	case UnicodeNormalizationNFC:
+		return norm.NFC.String(value)
+	case UnicodeNormalizationNFD:
+		return norm.NFD.String(value)
+	}
+	return value
+}
+
+// Returns an error if the given normalization policy is not supported
+func validateUnicodeNormalization(normalization string) error {
+	switch normalization {
+	case "", UnicodeNormalizationNFC, UnicodeNormalizationNFD:
+		return nil
+	}
+	return fmt.Errorf("unicodeNormalization %q is not one of %q or %q", normalization, UnicodeNormalizationNFC, UnicodeNormalizationNFD)
+}
+
+// The keys listed by a sync by the hash of their normalized paths, to detect the keys that differ only in their
+// normalization form. Such keys map to the same local path, only the key listed first is downloaded. Nil without a
+// normalization policy. Not safe for concurrent use, see syncS3ToLocal.
+type normalizedKeys map[uint64]uint64
+
+func newNormalizedKeys(normalization string) normalizedKeys {
+	if normalization == "" {
+		return nil
+	}
+	return make(normalizedKeys)
+}
+
+// Records the given key and returns an error if a different key with the same normalized local path was listed before
+func (keys normalizedKeys) add(key string, localPath string) error {
+	if keys == nil {
+		return nil
+	}
+	pathHash, keyHash := hashString(localPath), hashString(key)
+	first, ok := keys[pathHash]
+	if !ok {
+		keys[pathHash] = keyHash
+		return nil
+	}
+	if first != keyHash {
+		return fmt.Errorf("the key differs only in its Unicode normalization from a key listed before")
+	}
+	return nil
+}
+
+// Normalizes the S3 keys of a state so that the keys recorded for the downloaded objects match the keys of their local
+// files, see ToS3KeyForFile. The original keys of the downloaded objects are recorded so that the files are uploaded
+// back to them, see SynchronizerState.OriginalKey.
+type normalizedState struct {
+	SynchronizerState
+	normalization string
+}
+
+// Returns the given state with its keys normalized by the given policy, the state itself without a policy
+func newNormalizedState(state SynchronizerState, normalization string) SynchronizerState {
+	if normalization == "" {
+		return state
+	}
+	return normalizedState{SynchronizerState: state, normalization: normalization}
+}
+
+// Returns a copy of the given object with its key normalized
+func (state normalizedState) normalizeObject(item *s3.Object) *s3.Object {
+	normalized := *item
+	normalized.Key = aws.String(normalizeUnicode(*item.Key, state.normalization))
+	return &normalized
+}
+
+func (state normalizedState) RecordFileDownloadToLocal(item *s3.Object) {
+	normalized := state.normalizeObject(item)
+	state.SynchronizerState.RecordFileDownloadToLocal(normalized)
+	if *normalized.Key != *item.Key {
+		state.SynchronizerState.RecordOriginalKey(*normalized.Key, *item.Key)
+	} else {
+		// The object may have replaced an object whose key was normalized
+		state.SynchronizerState.RecordOriginalKey(*normalized.Key, "")
+	}
+}
+
+func (state normalizedState) RecordFileDeletionFromLocal(s3Key string) {
+	state.SynchronizerState.RecordFileDeletionFromLocal(normalizeUnicode(s3Key, state.normalization))
+}
+
+func (state normalizedState) HasFileChangedInS3(item *s3.Object) bool {
+	return state.SynchronizerState.HasFileChangedInS3(state.normalizeObject(item))
+}
+
+func (state normalizedState) IsFileDownloadedFromS3(s3Key string) bool {
+	return state.SynchronizerState.IsFileDownloadedFromS3(normalizeUnicode(s3Key, state.normalization))
+}
+
+func (state normalizedState) PartialDownload(s3Key string) (PartialDownload, bool) {
+	return state.SynchronizerState.PartialDownload(normalizeUnicode(s3Key, state.normalization))
+}
+
+func (state normalizedState) RecordPartialDownload(s3Key string, partialDownload PartialDownload) {
+	state.SynchronizerState.RecordPartialDownload(normalizeUnicode(s3Key, state.normalization), partialDownload)
+}
+
+func (state normalizedState) RemovePartialDownload(s3Key string) {
+	state.SynchronizerState.RemovePartialDownload(normalizeUnicode(s3Key, state.normalization))
+}
+
+func (state normalizedState) RecordFileEviction(s3Key string) {
+	state.SynchronizerState.RecordFileEviction(normalizeUnicode(s3Key, state.normalization))
+}
+
+func (state normalizedState) IsFileEvicted(s3Key string) bool {
+	return state.SynchronizerState.IsFileEvicted(normalizeUnicode(s3Key, state.normalization))
+}
+
+func (state normalizedState) RecordLocalPath(s3Key string, localPath string) {
+	state.SynchronizerState.RecordLocalPath(normalizeUnicode(s3Key, state.normalization), localPath)
+}
+
+func (state normalizedState) LocalPaths(prefix string) map[string]string {
+	return state.SynchronizerState.LocalPaths(normalizeUnicode(prefix, state.normalization))
+}
+
+func (state normalizedState) RecordOriginalKey(s3Key string, originalKey string) {
+	state.SynchronizerState.RecordOriginalKey(normalizeUnicode(s3Key, state.normalization), originalKey)
+}
+
+func (state normalizedState) OriginalKey(s3Key string) (string, bool) {
+	return state.SynchronizerState.OriginalKey(normalizeUnicode(s3Key, state.normalization))
+}
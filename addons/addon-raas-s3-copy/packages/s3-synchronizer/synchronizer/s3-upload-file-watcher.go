@@ -0,0 +1,688 @@
+// Adapted from https://github.com/andymotta/s3-fsnotify-go
+package synchronizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Sets up file watchers to upload local changes in the given mount's destination to S3.
+// The file watchers stop when Options.StopUploadWatchersAfter has elapsed (if applicable) or when the mount is stopped.
+func (s *Synchronizer) setupUploadWatcher(handle *mountHandle) error {
+	config := handle.config
+	wg := &handle.wg
+	ctx := handle.ctx
+	stopUploadWatchersAfter := s.options.StopUploadWatchersAfter
+	debug := s.debug
+
+	syncDir := config.destination
+	bucket := config.bucket
+	prefix := config.prefix
+	kmsKeyId := config.kmsKeyId
+	uploadLimiter := config.uploadLimiter
+	sess := config.sess
+
+	if debug {
+		s.logger.Println("syncDir: " + syncDir + " bucket: " + bucket + " prefix: " + prefix)
+	}
+
+	// This shouldn't happen, but make the directory if it doesn't exist
+	if _, err := os.Stat(syncDir); os.IsNotExist(err) {
+		os.MkdirAll(syncDir, os.ModePerm)
+	}
+
+	// Create a channel for sub directories that get added
+	// These directories require explicit crawling to sync files up to S3 instead of just relying on file watcher
+	// This is required to capture the following edge case:
+	// 1. User directly creates a file and sub directories in one operation
+	// 2. This will result in OS firing CREATE events for the sub directories and the file
+	// 3. The code in processFileWatcherEvent will capture the CREATE event for the directories and attach
+	//	   new file watchers
+	// 4. The initial CREATE event of the file is never captured in this case because that event was fired
+	//	  BEFORE we could complete registration of the file watchers for the created sub directories
+	// To work around this timing issue, we need to enqueue these directories and crawl them after they are
+	// registered for file watching. This crawling is for catch up of any files that existed in that directory
+	//	before the watching began.
+	dirRequiringCrawlCh := make(chan string, 1000)
+
+
+	// There are two primary loops (running in go routines - similar to threads)
+	// 1. THE MAIN LOOP: It takes care of starting new file watcher go routine everytime it receives a signal from "startNewWatcherLoopCh" channel below.
+	//					 The main loop stops when it times out i.e., when stopUploadWatchersAfter time elapses (if applicable)
+	//
+	// 2. THE FILE WATCHER LOOP: It receives events from the directory watcher and reacts to those events.
+	//							 The file watcher loop receives STOP signal from "stopWatcherLoopCh" channel below to stop.
+	//							 A stop signal is pushed to "stopWatcherLoopCh" either due to timeout or
+	//							 when the file watcher loop needs to be restarted with new directory watcher instance.
+	startNewWatcherLoopCh := make(chan bool, 1)
+	stopWatcherLoopCh := make(chan bool, 1000)
+
+	addDirsToFileWatcher := func(watcher *dirWatcher) {
+		// Watch the syncDir and all it's children directories
+		err := filepath.Walk(
+			syncDir,
+			s.watchDirFactory(watcher, dirRequiringCrawlCh))
+
+		if err != nil {
+			s.logger.Printf("Error setting up file watcher: %v\n", err)
+		}
+	}
+
+	processFileWatcherEvent := func(watcher *dirWatcher, event *fsnotify.Event) {
+		if debug {
+			s.logger.Println("event:", event)
+		}
+		if (event.Op&fsnotify.Rename == fsnotify.Rename || event.Op&fsnotify.Remove == fsnotify.Remove) && !excludeFile(event.Name) {
+			if debug {
+				s.logger.Println("renamed or deleted file:", event.Name)
+			}
+
+			if watcher.IsBeingWatched(event.Name) {
+				if debug {
+					s.logger.Printf("\nDirectory being watched is renamed or deleted: %v\n\n", event.Name)
+				}
+				// Directory that was being watched is renamed or deleted
+				// When dir is renamed event.Name has the dir's old name
+				// Remove the directory from the file watcher
+				watcher.UnwatchDir(event.Name)
+				// If it's rename, it will also cause "Create" event for the dir with new name if the dir is moved
+				// to a directory that is also monitored so delete the older directory from S3
+				s.deleteDirFromS3(s.transfersCtx, sess, syncDir, event.Name, bucket, prefix)
+			} else {
+				// When file is renamed event.Name has the file's old name
+				// Rename will also cause "Create" event for the file with new name if the file is moved
+				// to a directory that is also monitored so delete old file from S3
+				s.deleteFromS3(s.transfersCtx, sess, syncDir, event.Name, bucket, prefix)
+			}
+
+		} else if (event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create) && !excludeFile(event.Name) {
+			if debug {
+				s.logger.Println("modified file:", event.Name)
+			}
+			// First check that this is a file
+			fi, err := os.Stat(event.Name)
+			if err != nil && os.IsNotExist(err) {
+				// We just received WRITE or CREATE event for the file but the file does not exist on the file system
+				// This can happen on Windows when a folder is renamed and new file is created or modified in the
+				// renamed folder
+				// Somehow, windows generates CREATE/WRITE events for the file under the old path
+				// For example, on Windows,
+				// When you manually create a directory, it’s created as "New directory" first and then when
+				// you rename it to say "d1" and add a file say "f1" to the directory, Windows generates file system
+				// CREATE event for file "New directory\f1" instead of "d1\f1"
+
+				if debug {
+					s.logger.Println("Received CREATE or WRITE event for ", event.Name, " but the file or directory does not exist. This can happen when directory is renamed on Windows. Stopping existing file watcher loop and starting a new one.")
+				}
+
+				// In this case restart the watcher and let it re-watch all the way from the root of the mount i.e., syncDir
+				// Send stop signal to the loop running the current watcher
+				if debug {
+					s.logger.Println("Sending STOP signal to existing file watcher loop")
+				}
+				stopWatcherLoopCh <- true
+				if debug {
+					s.logger.Println("Sent STOP signal to existing file watcher loop")
+				}
+
+				// Send signal to start new watcher loop
+				if debug {
+					s.logger.Println("Sending START signal to start new file watcher loop")
+				}
+				select {
+				case startNewWatcherLoopCh <- true:
+					if debug {
+						s.logger.Println("Sent START signal to start new file watcher loop")
+					}
+				default:
+					// A new file watcher loop is already pending (or the main loop has stopped), no need to signal again
+				}
+
+				return
+			} else if err != nil {
+				s.logger.Println("Unable to stat file", err)
+				return
+			}
+
+			if fi.Mode().IsDir() {
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					if debug {
+						s.logger.Println(event.Name, "is a new directory, watching")
+					}
+					if err := filepath.Walk(
+						event.Name,
+						s.watchDirFactory(watcher, dirRequiringCrawlCh),
+					); err != nil {
+						s.logger.Println("Unable to watch directory", err)
+					}
+					return
+				}
+				if debug {
+					s.logger.Println(event.Name, "is a directory, skipping")
+				}
+				return
+			}
+
+			s.uploadToS3(s.transfersCtx, sess, syncDir, event.Name, bucket, prefix, kmsKeyId, uploadLimiter)
+		}
+	}
+
+	uploadDir := func(watcher *dirWatcher, dirToUpload string, debug bool) {
+		if debug {
+			s.logger.Println("Crawling directory", dirToUpload, "to upload file to s3 who may have been missed by file watcher")
+		}
+		if err := filepath.Walk(
+			dirToUpload,
+			func(path string, fi os.FileInfo, err error) error {
+				if fi != nil && fi.Mode().IsDir() {
+					if debug {
+						s.logger.Println(path, "is a new directory, watching")
+					}
+					if err := filepath.Walk(
+						path,
+						s.watchDirFactory(watcher, dirRequiringCrawlCh),
+					); err != nil {
+						s.logger.Println("Unable to watch directory", err)
+					}
+					// Empty directories have no files to upload, upload them as directory markers instead
+					if path != syncDir && isEmptyDir(path) {
+						s.uploadDirMarkerToS3(s.transfersCtx, sess, syncDir, path, bucket, prefix, kmsKeyId)
+					}
+					return nil
+				} else if fi != nil && !fi.Mode().IsDir() && !excludeFile(path) {
+					if debug {
+						s.logger.Println("Uploading file", path, "to S3")
+					}
+					s.uploadToS3(s.transfersCtx, sess, syncDir, path, bucket, prefix, kmsKeyId, uploadLimiter)
+					return nil
+				}
+				return nil
+			},
+		); err != nil {
+			s.logger.Println("Unable to upload directory", err)
+		}
+	}
+
+	// Increment wait group counter for the main loop to make sure the caller can wait
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+	TheMainLoop:
+		for {
+			if stopUploadWatchersAfter > 0 {
+				select {
+				case <-time.After(stopUploadWatchersAfter):
+					if debug {
+						s.logger.Printf("\n\n THE MAIN LOOP TIMEOUT \n\n")
+					}
+					break TheMainLoop
+				case <-ctx.Done():
+					// The file watcher loop receives the same signal and stops on its own
+					if debug {
+						s.logger.Printf("\n\n THE MAIN LOOP STOPPED \n\n")
+					}
+					break TheMainLoop
+				case <-startNewWatcherLoopCh:
+					if debug {
+						s.logger.Printf("\n\n RECEIVED SIGNAL TO START NEW FILE WATCHER \n\n")
+					}
+					watcher := NewDirWatcher(debug)
+					wg.Add(1)
+					go s.runFileWatcherLoop(wg, watcher, stopUploadWatchersAfter, &dirRequiringCrawlCh, uploadDir, debug, processFileWatcherEvent, &stopWatcherLoopCh, ctx)
+					addDirsToFileWatcher(watcher)
+				}
+			} else {
+				select {
+				case <-ctx.Done():
+					// The file watcher loop receives the same signal and stops on its own
+					if debug {
+						s.logger.Printf("\n\n THE MAIN LOOP STOPPED \n\n")
+					}
+					break TheMainLoop
+				case <-startNewWatcherLoopCh:
+					if debug {
+						s.logger.Printf("\n\n RECEIVED SIGNAL TO START NEW FILE WATCHER \n\n")
+					}
+					watcher := NewDirWatcher(debug)
+					wg.Add(1)
+					go s.runFileWatcherLoop(wg, watcher, stopUploadWatchersAfter, &dirRequiringCrawlCh, uploadDir, debug, processFileWatcherEvent, &stopWatcherLoopCh, ctx)
+					addDirsToFileWatcher(watcher)
+				}
+			}
+		}
+	}()
+
+	// Send signal to the channel to start new file watcher
+	startNewWatcherLoopCh <- true
+
+	return nil
+}
+
+// Runs the file watcher loop until it receives a signal on stopLoopCh or the mount is stopped (i.e., ctx is cancelled).
+// The caller must increment the given wait group before spawning the loop, the loop decrements it when it exits.
+func (s *Synchronizer) runFileWatcherLoop(wg *sync.WaitGroup, watcher *dirWatcher, stopAfter time.Duration, dirRequiringCrawlCh *chan string, uploadDir func(dw *dirWatcher, dirToUpload string, debug bool), debug bool, processFileWatcherEvent func(dw *dirWatcher, event *fsnotify.Event), stopLoopCh *chan bool, ctx context.Context) *chan bool {
+	// Decrement from the wait group when the loop exits indicating we are done
+	defer wg.Done()
+
+	// Processes the events and directories that are already queued up when the mount is stopped so that the
+	// changes made just before the mount was stopped still make it to S3
+	drainPendingUploads := func() {
+		for {
+			select {
+			case dirToUpload := <-*dirRequiringCrawlCh:
+				uploadDir(watcher, dirToUpload, debug)
+			case event := <-watcher.FsEvents():
+				processFileWatcherEvent(watcher, &event)
+			default:
+				return
+			}
+		}
+	}
+	stopMount := func() {
+		if debug {
+			s.logger.Printf("\n\n MOUNT STOPPED, DRAINING PENDING UPLOADS IN THE FILE WATCHER LOOP \n\n")
+		}
+		drainPendingUploads()
+		watcher.Stop()
+	}
+
+	timeOut := func() {
+		if debug {
+			s.logger.Printf("\n\n THE FILE WATCHER LOOP TIMEOUT \n\n")
+		}
+		*stopLoopCh <- true
+	}
+
+TheWatcherLoop:
+	for {
+		if stopAfter > 0 {
+			select {
+			case <-time.After(stopAfter):
+				timeOut()
+				break
+			case <-*stopLoopCh:
+				if debug {
+					s.logger.Printf("\n\n RECEIVED STOP SIGNAL IN THE FILE WATCHER LOOP \n\n")
+				}
+				// Stop the watcher and exit
+				watcher.Stop()
+				break TheWatcherLoop
+			case <-ctx.Done():
+				stopMount()
+				break TheWatcherLoop
+			case dirToUpload := <-*dirRequiringCrawlCh:
+				uploadDir(watcher, dirToUpload, debug)
+			case event := <-watcher.FsEvents():
+				processFileWatcherEvent(watcher, &event)
+			case err := <-watcher.FsErrors():
+				s.logger.Println("error:", err)
+				//s.logger.Printf("\n\n WATCHER IS ALREADY STOPPED. EXITING THE WATCHER LOOP \n\n")
+				//break TheWatcherLoop
+			}
+		} else {
+			select {
+			case <-*stopLoopCh:
+				if debug {
+					s.logger.Printf("\n\n RECEIVED STOP SIGNAL IN THE FILE WATCHER LOOP \n\n")
+				}
+				// Stop the watcher and exit
+				watcher.Stop()
+				break TheWatcherLoop
+			case <-ctx.Done():
+				stopMount()
+				break TheWatcherLoop
+			case dirToUpload := <-*dirRequiringCrawlCh:
+				uploadDir(watcher, dirToUpload, debug)
+			case event := <-watcher.FsEvents():
+				processFileWatcherEvent(watcher, &event)
+			case err := <-watcher.FsErrors():
+				s.logger.Println("error:", err)
+				//s.logger.Printf("\n\n WATCHER IS ALREADY STOPPED. EXITING THE WATCHER LOOP \n\n")
+				//break TheWatcherLoop
+			}
+		}
+	}
+	return stopLoopCh
+}
+
+func (s *Synchronizer) deleteFromS3(ctx context.Context, sess *session.Session, syncDir string, filename string, bucket string, prefix string) error {
+	svc := s3.New(sess)
+	fileKey := s.uploadKey(s.fileKey(filename, s.mountConfigForFiles(syncDir, bucket, prefix)))
+	deleteObjectInput := &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(fileKey)}
+	err := s.retry(ctx, fmt.Sprintf("Deletion of '%v'", fileKey), func() error {
+		_, err := svc.DeleteObjectWithContext(ctx, deleteObjectInput)
+		return err
+	})
+
+	if err == nil {
+		if s.debug {
+			s.logger.Println("Successfully deleted", filename, "from", bucket+"/"+fileKey)
+		}
+	} else {
+		s.logger.Println("Failed to delete object: ", err)
+	}
+
+	return err
+}
+
+func (s *Synchronizer) deleteDirFromS3(ctx context.Context, sess *session.Session, syncDir string, dirName string, bucket string, prefix string) error {
+	svc := s3.New(sess)
+
+	// Add trailing slash for the dir name if it doesn't exist
+	dirPrefixInS3 := filepath.ToSlash(dirName)
+	if !strings.HasSuffix(dirPrefixInS3, "/") {
+		dirPrefixInS3 = dirPrefixInS3 + "/"
+	}
+	dirKey := s.uploadKey(s.fileKey(dirPrefixInS3, s.mountConfigForFiles(syncDir, bucket, prefix)))
+
+	if s.debug {
+		s.logger.Printf("Deleting directory: %v from S3: %v\n", dirKey, bucket)
+	}
+	truncatedListing := true
+	query := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(dirKey),
+	}
+
+	for truncatedListing {
+		var resp *s3.ListObjectsV2Output
+		err := s.retry(ctx, fmt.Sprintf("Listing prefix %v", dirKey), func() error {
+			var err error
+			resp, err = svc.ListObjectsV2WithContext(ctx, query)
+			return err
+		})
+
+		if err != nil {
+			s.logger.Println("Failed to list objects: ", err)
+			return err
+		}
+
+		var objectIdentifiers []*s3.ObjectIdentifier
+		// If the directory path is not empty in S3 then first delete all objects under the directory
+		// (i.e., under the specific S3 suffix)
+		if len(resp.Contents) > 0 {
+			for _, item := range resp.Contents {
+				objectIdentifiers = append(objectIdentifiers, &s3.ObjectIdentifier{Key: item.Key})
+			}
+
+			deleteObjectsInput := &s3.DeleteObjectsInput{
+				Bucket: aws.String(bucket),
+				Delete: &s3.Delete{
+					Objects: objectIdentifiers,
+				},
+			}
+			if s.debug {
+				s.logger.Printf("Deleting objects from old S3 path %v: %v\n", dirKey, deleteObjectsInput)
+			}
+			var deleteObjectsResp *s3.DeleteObjectsOutput
+			err := s.retry(ctx, fmt.Sprintf("Deletion of the objects under '%v'", dirKey), func() error {
+				var err error
+				deleteObjectsResp, err = svc.DeleteObjectsWithContext(ctx, deleteObjectsInput)
+				return err
+			})
+			if err != nil {
+				s.logger.Println("Failed to delete objects: ", err)
+				return err
+			}
+			if len(deleteObjectsResp.Errors) > 0 && len(deleteObjectsResp.Deleted) > 0 {
+				s.logger.Println("Failed to delete some objects: ", deleteObjectsResp.Errors)
+			}
+			if len(deleteObjectsResp.Errors) > 0 && len(deleteObjectsResp.Deleted) == 0 {
+				s.logger.Println("Failed to delete objects: ", deleteObjectsResp)
+				return errors.New(fmt.Sprintf("Failed to delete objects: %v\n", deleteObjectsResp.Errors))
+			}
+		}
+
+		query.ContinuationToken = resp.NextContinuationToken
+		truncatedListing = *resp.IsTruncated
+	}
+
+	keyToDelete := strings.TrimSuffix(dirKey, "/")
+	deleteObjectInput := &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(keyToDelete)}
+	err := s.retry(ctx, fmt.Sprintf("Deletion of '%v'", keyToDelete), func() error {
+		_, err := svc.DeleteObjectWithContext(ctx, deleteObjectInput)
+		return err
+	})
+	if err == nil {
+		if s.debug {
+			s.logger.Println("Successfully deleted dir", keyToDelete, "from", bucket+"/"+keyToDelete)
+		}
+	} else {
+		s.logger.Println("Failed to delete dir ", keyToDelete, "from S3", err)
+	}
+	return err
+}
+
+// Returns the key of the object the local file with the given key was downloaded from, which differs from the key
+// when the key was normalized (see Options.UnicodeNormalization). The keys of the files created locally are returned
+// as they are, i.e., normalized. Used for the uploads and for the hydration of the placeholders of evicted files.
+func (s *Synchronizer) uploadKey(s3Key string) string {
+	if originalKey, ok := s.state.OriginalKey(s3Key); ok {
+		return originalKey
+	}
+	return s3Key
+}
+
+// Uploads the given file to S3 if its size changed. The upload is aborted when ctx is cancelled.
+func (s *Synchronizer) uploadToS3(ctx context.Context, sess *session.Session, syncDir string, filename string, bucket string, prefix string, kmsKeyId string, uploadLimiter *rateLimiter) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		s.logger.Println("Unable to open file", err)
+		return err
+	}
+	defer file.Close()
+	uploader := s3manager.NewUploader(sess)
+
+	fileKeyInS3 := s.uploadKey(s.fileKey(filename, s.mountConfigForFiles(syncDir, bucket, prefix)))
+
+	// Do NOT upload if there is no change in file size (bytes)
+	// Without this there will be infinite loop between the downloader thread and the upload watcher thread as follows
+	// Say, the file watcher is watching directory "A", the downloader thread syncs all files from S3 to "A"
+	// This will trigger the file watcher events, the file watcher will upload them (if we don't check size)
+	// The upload in S3 will cause the file's ETag to change even though there is no change in file's content
+	// Due to this, the downloader thread will detect this as file update in S3 and download the file again
+	// This will cause file change event in file watcher and so on...
+
+	// Also, DO NOT upload file if the file is empty. The downloader thread on some platforms (e.g., on Windows) creates empty file on local file system first before writing stream of data from S3 to the file
+	// The creation of the empty file will cause the file CREATE event to trigger and we will end up uploading empty file to S3 if we don't check for non-empty here.
+	if s.areSizesDifferent(ctx, sess, bucket, fileKeyInS3, file) && !s.isEmptyFile(file) {
+		// Record the local modification time so that it is restored when the object is downloaded
+		var metadata map[string]*string
+		if fi, err := file.Stat(); err == nil {
+			metadata = map[string]*string{mtimeMetadataKey: aws.String(formatMtime(fi.ModTime()))}
+		}
+		// Throttle the upload to the mount's and the global upload rate limits
+		body := &throttledReader{ctx: ctx, r: file, limiters: []*rateLimiter{uploadLimiter, s.uploadLimiter}}
+
+		var uploadInput *s3manager.UploadInput
+		if strings.TrimSpace(kmsKeyId) == "" {
+			uploadInput = &s3manager.UploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(fileKeyInS3),
+				Body:     body,
+				ACL:      aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
+				Metadata: metadata,
+			}
+		} else {
+			uploadInput = &s3manager.UploadInput{
+				Bucket:               aws.String(bucket),
+				Key:                  aws.String(fileKeyInS3),
+				Body:                 body,
+				ServerSideEncryption: aws.String("aws:kms"),
+				SSEKMSKeyId:          aws.String(kmsKeyId),
+				ACL:                  aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
+				Metadata:             metadata,
+			}
+		}
+
+		// upload file to S3, each attempt uploads the file from the start
+		err = s.retry(ctx, fmt.Sprintf("Upload of '%v'", filename), func() error {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			_, err := uploader.UploadWithContext(ctx, uploadInput)
+			return err
+		})
+
+		if err == nil {
+			if s.debug {
+				s.logger.Println("Successfully uploaded", filename, "to", bucket+"/"+fileKeyInS3)
+			}
+		} else {
+			s.logger.Println("Unable to upload", filename, bucket, err)
+		}
+
+	} else {
+		if s.debug {
+			s.logger.Println(filename, " size has not changed since last upload or the file is empty, skipping upload this time")
+		}
+	}
+
+	return nil
+}
+
+// Uploads an empty directory marker object (i.e., an object whose key ends in "/") for the given empty directory unless
+// the directory already exists in S3, i.e., unless there is an object under it. This keeps the markers of the
+// directories downloaded from S3 from being uploaded again and the directories created by downloads from getting
+// markers before their files are downloaded.
+func (s *Synchronizer) uploadDirMarkerToS3(ctx context.Context, sess *session.Session, syncDir string, dirName string, bucket string, prefix string, kmsKeyId string) error {
+	svc := s3.New(sess)
+	dirKey := s.uploadKey(s.fileKey(dirName, s.mountConfigForFiles(syncDir, bucket, prefix)) + "/")
+
+	var resp *s3.ListObjectsV2Output
+	err := s.retry(ctx, fmt.Sprintf("Listing prefix %v", dirKey), func() error {
+		var err error
+		resp, err = svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(bucket),
+			Prefix:  aws.String(dirKey),
+			MaxKeys: aws.Int64(1),
+		})
+		return err
+	})
+	if err != nil {
+		s.logger.Println("Failed to list objects: ", err)
+		return err
+	}
+	if len(resp.Contents) > 0 {
+		if s.debug {
+			s.logger.Println("Directory", dirName, "already exists in S3, skipping the upload of its directory marker")
+		}
+		return nil
+	}
+
+	putObjectInput := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(dirKey),
+		Body:   strings.NewReader(""),
+		ACL:    aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
+	}
+	if strings.TrimSpace(kmsKeyId) != "" {
+		putObjectInput.ServerSideEncryption = aws.String("aws:kms")
+		putObjectInput.SSEKMSKeyId = aws.String(kmsKeyId)
+	}
+	err = s.retry(ctx, fmt.Sprintf("Upload of '%v'", dirKey), func() error {
+		_, err := svc.PutObjectWithContext(ctx, putObjectInput)
+		return err
+	})
+	if err == nil {
+		if s.debug {
+			s.logger.Println("Successfully uploaded directory marker of", dirName, "to", bucket+"/"+dirKey)
+		}
+	} else {
+		s.logger.Println("Unable to upload directory marker of", dirName, bucket, err)
+	}
+	return err
+}
+
+// Checks if the file's sizes are different on disk and in S3
+func (s *Synchronizer) areSizesDifferent(ctx context.Context, sess *session.Session, bucket string, fileKeyInS3 string, file *os.File) bool {
+	query := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(fileKeyInS3),
+	}
+	svc := s3.New(sess)
+	var resp *s3.ListObjectsV2Output
+	err := s.retry(ctx, fmt.Sprintf("Listing '%v'", fileKeyInS3), func() error {
+		var err error
+		resp, err = svc.ListObjectsV2WithContext(ctx, query)
+		return err
+	})
+	if err != nil {
+		// The size in S3 is unknown, upload the file. The upload fails as well if S3 cannot be reached.
+		s.logger.Println("Failed to list objects: ", err)
+		return true
+	}
+
+	if len(resp.Contents) > 0 {
+		item := resp.Contents[0] // Expecting only one element since we are doing ListObjectsV2 on specific object path
+
+		fi, err := file.Stat()
+		if err != nil {
+			s.logger.Printf("Failed to read file '%v' size, Error: %v\n", file.Name(), err)
+			return true
+		}
+		return *item.Size != fi.Size()
+	}
+
+	return true
+}
+
+func (s *Synchronizer) isEmptyFile(file *os.File) bool {
+	fi, err := file.Stat()
+	if err != nil {
+		s.logger.Printf("Failed to read file '%v' size, Error: %v\n", file.Name(), err)
+		return true
+	}
+	return !(fi.Size() > 0)
+}
+
+func (s *Synchronizer) watchDirFactory(watcher *dirWatcher, dirRequiringCrawlCh chan string) func(path string, fi os.FileInfo, err error) error {
+	return func(path string, fi os.FileInfo, err error) error {
+		// since fsnotify can watch all the files in a directory, watchers only need
+		// to be added to each nested directory
+		if fi != nil && fi.Mode().IsDir() {
+			if watcher.IsBeingWatched(path) {
+				if s.debug {
+					s.logger.Println("Directory", path, "is already being watched. Skipping registration for watcher.")
+				}
+			} else {
+				if s.debug {
+					s.logger.Println("Watching directory", path)
+				}
+				err := watcher.WatchDir(path)
+				dirRequiringCrawlCh <- path
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func excludeFile(path string) bool {
+	// On Windows ignore the recycle bin
+	if strings.HasPrefix(path, "$RECYCLE.BIN") {
+		return true
+	}
+	var extension = filepath.Ext(path)
+	switch extension {
+	case ".swp":
+		return true
+	case ".tmp":
+		return true
+	default:
+		return false
+	}
+}
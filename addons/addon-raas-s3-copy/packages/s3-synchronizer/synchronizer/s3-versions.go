@@ -0,0 +1,209 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// A version of an object or a delete marker, as listed by s3.ListObjectVersions
+type objectVersion struct {
+	key          string
+	versionId    string
+	lastModified time.Time
+	deleteMarker bool
+	// The object as it would be listed by s3.ListObjectsV2, nil for delete markers
+	object *s3.Object
+}
+
+// Lists all the versions and delete markers of the objects under the given prefix. fn is called once per page with
+// the versions grouped by key, each group holds all the versions of one key from the newest to the oldest. The
+// versions of a key that span two pages are passed with the next page. Returns the error of the first call that fails
+// after retries.
+func (s *Synchronizer) listObjectVersions(ctx context.Context, svc *s3.S3, bucket string, prefix string, fn func(groups [][]objectVersion)) error {
+	query := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	var pending []objectVersion
+	for ctx.Err() == nil {
+		var resp *s3.ListObjectVersionsOutput
+		err := s.retry(ctx, fmt.Sprintf("Listing versions of bucket %v and prefix %v", bucket, prefix), func() error {
+			var err error
+			resp, err = svc.ListObjectVersionsWithContext(ctx, query)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		versions := pending
+		for _, version := range resp.Versions {
+			versions = append(versions, objectVersion{
+				key:          aws.StringValue(version.Key),
+				versionId:    aws.StringValue(version.VersionId),
+				lastModified: aws.TimeValue(version.LastModified),
+				object: &s3.Object{
+					Key:          version.Key,
+					ETag:         version.ETag,
+					Size:         version.Size,
+					LastModified: version.LastModified,
+					StorageClass: version.StorageClass,
+				},
+			})
+		}
+		for _, marker := range resp.DeleteMarkers {
+			versions = append(versions, objectVersion{
+				key:          aws.StringValue(marker.Key),
+				versionId:    aws.StringValue(marker.VersionId),
+				lastModified: aws.TimeValue(marker.LastModified),
+				deleteMarker: true,
+			})
+		}
+		// The versions and the delete markers are listed separately, merge them by key from the newest to the oldest
+		sort.SliceStable(versions, func(i, j int) bool {
+			if versions[i].key != versions[j].key {
+				return versions[i].key < versions[j].key
+			}
+			return versions[i].lastModified.After(versions[j].lastModified)
+		})
+
+		truncated := aws.BoolValue(resp.IsTruncated)
+		var groups [][]objectVersion
+		pending = nil
+		for start := 0; start < len(versions); {
+			end := start + 1
+			for end < len(versions) && versions[end].key == versions[start].key {
+				end++
+			}
+			if end == len(versions) && truncated {
+				// The next page may have more versions of the last key
+				pending = versions[start:end]
+				break
+			}
+			groups = append(groups, versions[start:end])
+			start = end
+		}
+		fn(groups)
+		if !truncated {
+			return nil
+		}
+		query.KeyMarker = resp.NextKeyMarker
+		query.VersionIdMarker = resp.NextVersionIdMarker
+	}
+	return ctx.Err()
+}
+
+// Pins the objects of a mount to a snapshot of a versioned bucket, either the versions that were current at a point
+// in time or the versions listed in a lockfile (see WriteLockfile). The snapshot is materialized again by every sync,
+// so the local files stay frozen as long as the lockfile does not change.
+type mountSnapshot struct {
+	// The point in time of the snapshot, zero if the snapshot is pinned by a lockfile
+	asOf     time.Time
+	lockfile string
+	// Guards versions
+	lock sync.Mutex
+	// The version ids of the objects of the snapshot by their keys. Loaded from the lockfile, or filled as the versions
+	// are listed for a point in time.
+	versions map[string]string
+}
+
+func newMountSnapshot(asOf time.Time, lockfile string) *mountSnapshot {
+	return &mountSnapshot{asOf: asOf, lockfile: lockfile, versions: make(map[string]string)}
+}
+
+// Returns the version id of the given object of the snapshot, nil for a nil snapshot (i.e., the latest version)
+func (snapshot *mountSnapshot) versionId(key string) *string {
+	if snapshot == nil {
+		return nil
+	}
+	snapshot.lock.Lock()
+	defer snapshot.lock.Unlock()
+	if versionId, ok := snapshot.versions[key]; ok {
+		return aws.String(versionId)
+	}
+	return nil
+}
+
+// Returns the version of the object of the snapshot among the given versions of the object, false if the object is
+// not part of the snapshot
+func (snapshot *mountSnapshot) resolve(versions []objectVersion) (objectVersion, bool) {
+	snapshot.lock.Lock()
+	defer snapshot.lock.Unlock()
+	key := versions[0].key
+	if snapshot.lockfile != "" {
+		lockedVersionId, ok := snapshot.versions[key]
+		if !ok {
+			return objectVersion{}, false
+		}
+		for _, version := range versions {
+			if version.versionId == lockedVersionId && !version.deleteMarker {
+				return version, true
+			}
+		}
+		return objectVersion{}, false
+	}
+	for _, version := range versions {
+		if !version.lastModified.After(snapshot.asOf) {
+			if version.deleteMarker {
+				// The object was deleted at that point in time
+				return objectVersion{}, false
+			}
+			snapshot.versions[key] = version.versionId
+			return version, true
+		}
+	}
+	// The object did not exist yet
+	return objectVersion{}, false
+}
+
+// Lists the objects of the mount's snapshot under the given prefix, fn is called with the objects of each page of
+// versions as soon as the page is listed. The objects locked by the lockfile that have no such version in S3 are
+// recorded as errors.
+func (s *Synchronizer) listSnapshot(ctx context.Context, svc *s3.S3, config *mountConfiguration, prefix string, stats *downloadStats, fn func(objects []*s3.Object)) error {
+	snapshot := config.snapshot
+	snapshot.lock.Lock()
+	if snapshot.lockfile != "" {
+		versions, err := readLockfile(snapshot.lockfile)
+		if err != nil {
+			snapshot.lock.Unlock()
+			return err
+		}
+		snapshot.versions = versions
+	} else {
+		snapshot.versions = make(map[string]string)
+	}
+	snapshot.lock.Unlock()
+
+	found := make(map[string]bool)
+	err := s.listObjectVersions(ctx, svc, config.bucket, prefix, func(groups [][]objectVersion) {
+		objects := make([]*s3.Object, 0, len(groups))
+		for _, versions := range groups {
+			if version, ok := snapshot.resolve(versions); ok {
+				if snapshot.lockfile != "" {
+					found[version.key] = true
+				}
+				objects = append(objects, version.object)
+			}
+		}
+		fn(objects)
+	})
+	if err != nil || snapshot.lockfile == "" {
+		return err
+	}
+
+	snapshot.lock.Lock()
+	defer snapshot.lock.Unlock()
+	for key, versionId := range snapshot.versions {
+		if !found[key] {
+			s.logger.Printf("Version %v of '%v' locked by %v not found\n", versionId, key, snapshot.lockfile)
+			stats.recordError(aws.String(key))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,451 @@
+package synchronizer
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/fsnotify/fsnotify"
+	"github.com/orcaman/concurrent-map"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The minimum interval between two saves of the ETags. Saving the whole state after each download or deletion would
+// make a sync quadratic in the number of files, the changes made within the interval are saved together instead.
+const minStateSaveInterval = time.Second
+
+// SynchronizerState keeps track of the objects downloaded from S3. Files are identified by their S3 keys, use ToS3Key
+// to get the S3 key of a local file.
+type SynchronizerState interface {
+	RecordFileDownloadToLocal(item *s3.Object)
+	RecordFileDeletionFromLocal(s3Key string)
+	HasFileChangedInS3(item *s3.Object) bool
+	IsFileDownloadedFromS3(s3Key string) bool
+	// PartialDownload returns the progress of the interrupted download of the object with the given key, if any. The
+	// partial downloads are kept per mount, their keys include the bucket and the id of the mount (see mountStateKey).
+	PartialDownload(s3Key string) (PartialDownload, bool)
+	// PartialDownloads returns the progress of all the interrupted downloads by the keys of the objects
+	PartialDownloads() map[string]PartialDownload
+	RecordPartialDownload(s3Key string, partialDownload PartialDownload)
+	RemovePartialDownload(s3Key string)
+	// RecordFileEviction records that the downloaded file of the object with the given key was replaced by a
+	// placeholder to free up disk space. The file is still considered downloaded from S3 (see IsFileDownloadedFromS3)
+	// until it is deleted, downloading the object again makes the file resident again.
+	RecordFileEviction(s3Key string)
+	// IsFileEvicted returns whether the file of the object with the given key is a placeholder of an evicted file
+	IsFileEvicted(s3Key string) bool
+	// RecordLocalPath records the path (relative to the mount's destination, with forward slashes) of the local file of
+	// the object with the given key when it is not the path the key maps to, i.e., when the name of the file was
+	// suffixed as it differs only in case from the name of another key (see caseCollisions). The local paths are kept
+	// per mount, their keys include the bucket and the id of the mount (see mountStateKey). An empty path removes the
+	// record.
+	RecordLocalPath(s3Key string, localPath string)
+	// LocalPaths returns the recorded local paths by the keys that start with the given prefix
+	LocalPaths(prefix string) map[string]string
+	// RecordOriginalKey records the key of the object the file with the given key was downloaded from when the two
+	// differ, i.e., when the key was normalized to the Unicode normalization form of the local paths (see
+	// Options.UnicodeNormalization). An empty key removes the record. The record is also removed when the file is
+	// deleted (see RecordFileDeletionFromLocal).
+	RecordOriginalKey(s3Key string, originalKey string)
+	// OriginalKey returns the recorded key of the object the file with the given key was downloaded from, if any
+	OriginalKey(s3Key string) (string, bool)
+	// Save flushes the state to its backing store (if any)
+	Save() error
+	Clean() error
+}
+
+// PartialDownload describes the progress of an interrupted download of an object so that the download can be resumed
+type PartialDownload struct {
+	// The ETag of the object being downloaded. The partial data is discarded if the object changes in S3.
+	ETag string `json:"eTag"`
+	// The size of the object in bytes
+	Size int64 `json:"size"`
+	// The absolute path of the temporary file holding the partial data
+	TempFile string `json:"tempFile"`
+	// The number of bytes from the start of the object that have been written to TempFile
+	Offset int64 `json:"offset"`
+}
+
+type persistentSynchronizerState struct {
+	s3FileETagsMap cmap.ConcurrentMap
+	persistence    Persistence
+	// Map of mount state key (see mountStateKey) vs PartialDownload, persisted in a separate file next to the ETags
+	partialDownloadsMap         cmap.ConcurrentMap
+	partialDownloadsPersistence Persistence
+	// Set of the S3 keys of the evicted files, persisted in a separate file next to the ETags
+	evictedFilesMap         cmap.ConcurrentMap
+	evictedFilesPersistence Persistence
+	// Map of S3 key vs the local path of the files whose names collide, persisted in a separate file next to the ETags
+	localPathsMap         cmap.ConcurrentMap
+	localPathsPersistence Persistence
+	// Map of the normalized S3 key vs the original S3 key of the downloaded files, persisted in a separate file next to
+	// the ETags
+	originalKeysMap         cmap.ConcurrentMap
+	originalKeysPersistence Persistence
+	// Coalesces the saves of the ETags, see saveSoon
+	saver *stateSaver
+}
+
+type stateSaver struct {
+	lock     sync.Mutex
+	lastSave time.Time
+	pending  bool
+	// Logs the errors of the saves, the synchronizer's logger once the state is used by a synchronizer
+	logger *log.Logger
+}
+
+// The states that log the errors of their background saves, see saveSoon. The synchronizer sets its logger.
+type loggingState interface {
+	setLogger(logger *log.Logger)
+}
+
+// Returns the key of the state records of the object with the given S3 key that are kept per mount (e.g., the partial
+// downloads), as the same key may be mounted from different buckets or twice from the same bucket. Neither the bucket
+// names nor the mount ids contain "/".
+func mountStateKey(bucket string, mountId string, s3Key string) string {
+	return bucket + "/" + mountId + "/" + s3Key
+}
+
+// NewPersistentSynchronizerState returns the state persisted in the "s3-synchronizer-state" file under the user's
+// home directory
+func NewPersistentSynchronizerState() SynchronizerState {
+	return NewPersistentSynchronizerStateIn("")
+}
+
+// NewPersistentSynchronizerStateIn returns the state persisted in the "s3-synchronizer-state" file under the given
+// directory. The progress of interrupted downloads is persisted in the "s3-synchronizer-partial-downloads" file and
+// the evicted files in the "s3-synchronizer-evicted-files" file in the same directory, the local paths of the files
+// whose names collide in the "s3-synchronizer-local-paths" file and the original keys of the files whose keys were
+// normalized in the "s3-synchronizer-original-keys" file. If baseDirPath is empty then
+// the state is persisted under the user's home directory.
+func NewPersistentSynchronizerStateIn(baseDirPath string) SynchronizerState {
+	persistence := NewFileBasedPersistenceWithJsonFormat("s3-synchronizer-state", baseDirPath)
+	partialDownloadsPersistence := NewFileBasedPersistenceWithJsonFormat("s3-synchronizer-partial-downloads", baseDirPath)
+	evictedFilesPersistence := NewFileBasedPersistenceWithJsonFormat("s3-synchronizer-evicted-files", baseDirPath)
+	localPathsPersistence := NewFileBasedPersistenceWithJsonFormat("s3-synchronizer-local-paths", baseDirPath)
+	originalKeysPersistence := NewFileBasedPersistenceWithJsonFormat("s3-synchronizer-original-keys", baseDirPath)
+	synchronizerState := &persistentSynchronizerState{
+		s3FileETagsMap:              cmap.New(),
+		persistence:                 persistence,
+		partialDownloadsMap:         cmap.New(),
+		partialDownloadsPersistence: partialDownloadsPersistence,
+		evictedFilesMap:             cmap.New(),
+		evictedFilesPersistence:     evictedFilesPersistence,
+		localPathsMap:               cmap.New(),
+		localPathsPersistence:       localPathsPersistence,
+		originalKeysMap:             cmap.New(),
+		originalKeysPersistence:     originalKeysPersistence,
+		saver:                       &stateSaver{logger: log.New(log.Writer(), log.Prefix(), log.Flags())},
+	}
+
+	err := synchronizerState.Load()
+	if err != nil {
+		// The initial load may fail if this is clean state and there is no state from any of the previous runs.
+		// Just log and move on in this case
+		fmt.Printf("Error loading synchronizerState from disk: %v", err)
+	}
+	return synchronizerState
+}
+
+func (state persistentSynchronizerState) Load() error {
+	// The concurrent map can be marshalled to JSON but not unmarshalled from it, load into a plain map first
+	var s3FileETags map[string]string
+	err := state.persistence.Load(&s3FileETags)
+	for s3Key, eTag := range s3FileETags {
+		state.s3FileETagsMap.Set(s3Key, eTag)
+	}
+
+	// The partial downloads are loaded even if the ETags could not be loaded, e.g., when the first download of
+	// the first run was interrupted there are no ETags yet
+	var partialDownloads map[string]PartialDownload
+	partialDownloadsErr := state.partialDownloadsPersistence.Load(&partialDownloads)
+	for s3Key, partialDownload := range partialDownloads {
+		state.partialDownloadsMap.Set(s3Key, partialDownload)
+	}
+	// It is fine if there are no partial downloads from the previous runs
+	if err == nil && !os.IsNotExist(partialDownloadsErr) {
+		err = partialDownloadsErr
+	}
+
+	var evictedFiles map[string]bool
+	evictedFilesErr := state.evictedFilesPersistence.Load(&evictedFiles)
+	for s3Key := range evictedFiles {
+		state.evictedFilesMap.Set(s3Key, true)
+	}
+	// It is fine if no files were evicted in the previous runs
+	if err == nil && !os.IsNotExist(evictedFilesErr) {
+		err = evictedFilesErr
+	}
+
+	var localPaths map[string]string
+	localPathsErr := state.localPathsPersistence.Load(&localPaths)
+	for s3Key, localPath := range localPaths {
+		state.localPathsMap.Set(s3Key, localPath)
+	}
+	// It is fine if no names collided in the previous runs
+	if err == nil && !os.IsNotExist(localPathsErr) {
+		err = localPathsErr
+	}
+
+	var originalKeys map[string]string
+	originalKeysErr := state.originalKeysPersistence.Load(&originalKeys)
+	for s3Key, originalKey := range originalKeys {
+		state.originalKeysMap.Set(s3Key, originalKey)
+	}
+	// It is fine if no keys were normalized in the previous runs
+	if err == nil && !os.IsNotExist(originalKeysErr) {
+		err = originalKeysErr
+	}
+	return err
+}
+
+func (state persistentSynchronizerState) Save() error {
+	err := state.persistence.Save(&state.s3FileETagsMap)
+	if err != nil {
+		return err
+	}
+	err = state.evictedFilesPersistence.Save(&state.evictedFilesMap)
+	if err != nil {
+		return err
+	}
+	err = state.localPathsPersistence.Save(&state.localPathsMap)
+	if err != nil {
+		return err
+	}
+	err = state.originalKeysPersistence.Save(&state.originalKeysMap)
+	if err != nil {
+		return err
+	}
+	return state.savePartialDownloads()
+}
+
+// Saves the state once minStateSaveInterval has passed since the last save. The changes recorded in the meantime are
+// saved by the same save.
+func (state persistentSynchronizerState) saveSoon() {
+	state.saver.lock.Lock()
+	defer state.saver.lock.Unlock()
+	if state.saver.pending {
+		return
+	}
+	state.saver.pending = true
+	time.AfterFunc(minStateSaveInterval-time.Since(state.saver.lastSave), func() {
+		state.saver.lock.Lock()
+		state.saver.pending = false
+		state.saver.lastSave = time.Now()
+		logger := state.saver.logger
+		state.saver.lock.Unlock()
+		if err := state.Save(); err != nil {
+			logger.Println("Error saving the synchronizer state:", err)
+		}
+	})
+}
+
+func (state persistentSynchronizerState) setLogger(logger *log.Logger) {
+	state.saver.lock.Lock()
+	defer state.saver.lock.Unlock()
+	state.saver.logger = logger
+}
+
+func (state persistentSynchronizerState) savePartialDownloads() error {
+	return state.partialDownloadsPersistence.Save(&state.partialDownloadsMap)
+}
+
+func (state persistentSynchronizerState) Clean() error {
+	err := state.persistence.Clean()
+	partialDownloadsErr := state.partialDownloadsPersistence.Clean()
+	if err == nil && !os.IsNotExist(partialDownloadsErr) {
+		err = partialDownloadsErr
+	}
+	evictedFilesErr := state.evictedFilesPersistence.Clean()
+	if err == nil && !os.IsNotExist(evictedFilesErr) {
+		err = evictedFilesErr
+	}
+	localPathsErr := state.localPathsPersistence.Clean()
+	if err == nil && !os.IsNotExist(localPathsErr) {
+		err = localPathsErr
+	}
+	originalKeysErr := state.originalKeysPersistence.Clean()
+	if err == nil && !os.IsNotExist(originalKeysErr) {
+		err = originalKeysErr
+	}
+	return err
+}
+
+func (state persistentSynchronizerState) RecordFileDownloadToLocal(item *s3.Object) {
+	state.s3FileETagsMap.Set(*item.Key, *item.ETag)
+	// The downloaded file replaces the placeholder, if any
+	state.evictedFilesMap.Remove(*item.Key)
+
+	// Keep saving the changes
+	state.saveSoon()
+}
+
+// Returns flag indicating if the given file was downloaded from S3 (as opposed to created locally)
+func (state persistentSynchronizerState) IsFileDownloadedFromS3(s3Key string) bool {
+	_, exists := state.s3FileETagsMap.Get(s3Key)
+
+	// If the entry for the given file exists in the state.s3FileETagsMap then it means this file was downloaded from S3
+	return exists
+}
+
+func (state persistentSynchronizerState) RecordFileDeletionFromLocal(s3Key string) {
+	// Delete ETag from cache map when file is deleted from local machine
+	state.s3FileETagsMap.Remove(s3Key)
+	state.evictedFilesMap.Remove(s3Key)
+	state.originalKeysMap.Remove(s3Key)
+
+	// Keep saving the changes
+	state.saveSoon()
+}
+
+func (state persistentSynchronizerState) HasFileChangedInS3(item *s3.Object) bool {
+	// Return true is the file was never downloaded from S3 (could happen when the file originated from local machine)
+	// and was uploaded to S3 but was never downloaded from S3 OR
+	// Return true if the S3 object's ETag is different than the one we have in our map since the last download
+	existing, ok := state.s3FileETagsMap.Get(*item.Key)
+
+	return !ok || existing.(string) != *item.ETag
+}
+
+func (state persistentSynchronizerState) PartialDownload(s3Key string) (PartialDownload, bool) {
+	partialDownload, ok := state.partialDownloadsMap.Get(s3Key)
+	if !ok {
+		return PartialDownload{}, false
+	}
+	return partialDownload.(PartialDownload), true
+}
+
+func (state persistentSynchronizerState) PartialDownloads() map[string]PartialDownload {
+	partialDownloads := make(map[string]PartialDownload)
+	for item := range state.partialDownloadsMap.IterBuffered() {
+		partialDownloads[item.Key] = item.Val.(PartialDownload)
+	}
+	return partialDownloads
+}
+
+func (state persistentSynchronizerState) RecordPartialDownload(s3Key string, partialDownload PartialDownload) {
+	state.partialDownloadsMap.Set(s3Key, partialDownload)
+
+	// Keep saving after each change
+	state.savePartialDownloads()
+}
+
+func (state persistentSynchronizerState) RemovePartialDownload(s3Key string) {
+	if !state.partialDownloadsMap.Has(s3Key) {
+		return
+	}
+	state.partialDownloadsMap.Remove(s3Key)
+
+	// Keep saving after each change
+	state.savePartialDownloads()
+}
+
+func (state persistentSynchronizerState) RecordFileEviction(s3Key string) {
+	state.evictedFilesMap.Set(s3Key, true)
+
+	// Keep saving the changes
+	state.saveSoon()
+}
+
+func (state persistentSynchronizerState) IsFileEvicted(s3Key string) bool {
+	return state.evictedFilesMap.Has(s3Key)
+}
+
+func (state persistentSynchronizerState) RecordLocalPath(s3Key string, localPath string) {
+	if localPath == "" {
+		state.localPathsMap.Remove(s3Key)
+	} else {
+		state.localPathsMap.Set(s3Key, localPath)
+	}
+
+	// Keep saving the changes
+	state.saveSoon()
+}
+
+func (state persistentSynchronizerState) RecordOriginalKey(s3Key string, originalKey string) {
+	if originalKey == "" {
+		if !state.originalKeysMap.Has(s3Key) {
+			return
+		}
+		state.originalKeysMap.Remove(s3Key)
+	} else {
+		state.originalKeysMap.Set(s3Key, originalKey)
+	}
+
+	// Keep saving the changes
+	state.saveSoon()
+}
+
+func (state persistentSynchronizerState) OriginalKey(s3Key string) (string, bool) {
+	originalKey, ok := state.originalKeysMap.Get(s3Key)
+	if !ok {
+		return "", false
+	}
+	return originalKey.(string), true
+}
+
+func (state persistentSynchronizerState) LocalPaths(prefix string) map[string]string {
+	localPaths := make(map[string]string)
+	for item := range state.localPathsMap.IterBuffered() {
+		if strings.HasPrefix(item.Key, prefix) {
+			localPaths[item.Key] = item.Val.(string)
+		}
+	}
+	return localPaths
+}
+
+// State hold map of directory path vs flag indicating if it is being watched by file watchers
+type dirWatcher struct {
+	dirWatchersMap cmap.ConcurrentMap
+	fsWatcher      *fsnotify.Watcher
+	initError      error
+	debug          bool
+}
+
+func (dw dirWatcher) WatchDir(dirPath string) error {
+	if !dw.IsBeingWatched(dirPath) {
+		dw.dirWatchersMap.Set(dirPath, true)
+		return dw.fsWatcher.Add(dirPath)
+	}
+	return nil
+}
+
+func (dw dirWatcher) FsEvents() chan fsnotify.Event {
+	return dw.fsWatcher.Events
+}
+func (dw dirWatcher) FsErrors() chan error {
+	return dw.fsWatcher.Errors
+}
+func (dw dirWatcher) UnwatchDir(dirPath string) error {
+	if dw.IsBeingWatched(dirPath) {
+		dw.dirWatchersMap.Remove(dirPath)
+		return dw.fsWatcher.Remove(dirPath)
+	}
+	return nil
+}
+
+func (dw dirWatcher) IsBeingWatched(dirPath string) bool {
+	return dw.dirWatchersMap.Has(dirPath)
+}
+
+func (dw dirWatcher) Stop() error {
+	return dw.fsWatcher.Close()
+}
+
+func (dw dirWatcher) InitializedSuccessfully() bool {
+	return dw.initError == nil
+}
+
+func (dw dirWatcher) InitError() error {
+	return dw.initError
+}
+
+func NewDirWatcher(debug bool) *dirWatcher {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return &dirWatcher{initError: err}
+	}
+	return &dirWatcher{dirWatchersMap: cmap.New(), fsWatcher: watcher, initError: nil, debug: debug}
+}
@@ -0,0 +1,541 @@
+// Package synchronizer synchronizes S3 locations ("mounts") with local directories. Objects are downloaded from S3
+// once or periodically, and local changes in writeable mounts are uploaded back to S3.
+//
+// A Synchronizer is created from Options using New, started with Start and stopped with Stop:
+//
+//	s, err := synchronizer.New(synchronizer.Options{Session: sess, Mounts: mounts, Destination: "/data"})
+//	if err != nil {
+//		return err
+//	}
+//	s.Start()
+//	defer s.Stop()
+//
+// Use Shutdown instead of Stop to bound the time given to the in-flight downloads and uploads to complete, e.g.,
+// when the process receives SIGTERM.
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const defaultConcurrency = 20
+const defaultObjectConcurrency = 10
+const defaultMaxConcurrentObjects = 20
+const defaultPartSize = 100 * 1024 * 1024 // 100MB per part
+const defaultDownloadInterval = 60 * time.Second
+
+// Options to create a Synchronizer with
+type Options struct {
+	// The AWS session to use for all S3 calls. Required.
+	Session *session.Session
+	// The mounts to synchronize. Mounts can be added or removed after the synchronizer is started using SetMounts.
+	Mounts []Mount
+	// The directory to download to. Each mount is downloaded to a sub directory named after the mount's id.
+	// Defaults to the current directory.
+	Destination string
+	// The state used to keep track of the downloaded objects to avoid unnecessary re-downloads.
+	// Defaults to the state persisted in a file under the user's home directory, see NewPersistentSynchronizerState.
+	State SynchronizerState
+	// The logger to use. Defaults to a logger with the same output, prefix and flags as the standard logger.
+	Logger *log.Logger
+	// Whether to log debug information
+	Debug bool
+	// The number of concurrent parts to download per object. Defaults to 20.
+	Concurrency int
+	// The size of the parts to download objects in, in bytes. Downloads of objects larger than a part are resumed
+	// from the last completed part when interrupted. Defaults to 100MB.
+	PartSize int64
+	// The number of objects to download concurrently per mount. Defaults to 10.
+	ObjectConcurrency int
+	// The maximum number of objects to download concurrently across all mounts. Defaults to 20.
+	MaxConcurrentObjects int
+	// The number of concurrent listings per mount. When greater than 1, the prefix of a mount is partitioned into its
+	// sub-prefixes (as delimited by "/") which are listed concurrently, the objects are downloaded as they are listed.
+	// Defaults to 1, i.e., the prefix is listed with a single chain of paginated listings.
+	ListingConcurrency int
+	// Whether to periodically download changes from S3
+	RecurringDownloads bool
+	// The interval at which to re-download changes from S3, only applicable when RecurringDownloads is true.
+	// Note that this does not include the download time. Defaults to 60 seconds.
+	DownloadInterval time.Duration
+	// Stop recurring downloads after the given duration. ZERO or Negative value means continue indefinitely.
+	StopRecurringDownloadsAfter time.Duration
+	// Stop the file watchers of writeable mounts after the given duration. ZERO or Negative value means continue indefinitely.
+	StopUploadWatchersAfter time.Duration
+	// Whether to delete the local files of a mount when it is removed using SetMounts
+	DeleteRemovedMounts bool
+	// The maximum download and upload rates across all mounts in bytes per second. ZERO means unlimited.
+	// The limits can be changed after the synchronizer is started using SetRateLimits.
+	DownloadRateLimit int64
+	UploadRateLimit   int64
+	// The maximum number of attempts of an S3 call that fails with a throttling or transient error. The calls are
+	// retried with exponential backoff, calls that fail with a permanent error (e.g., AccessDenied) are not retried.
+	// The retries of the SDK are disabled on the sessions of the mounts, so this is the number of requests per call.
+	// Defaults to 5.
+	MaxAttempts int
+	// The low-disk watermark in bytes. Downloads pause rather than leave less free space than this on the disk of the
+	// destination and resume once space is freed up, for at most 30 minutes per sync. The objects beyond the capacity
+	// of the disk minus the watermark are not downloaded. Defaults to 0, i.e., the downloads pause when the disk is
+	// full.
+	MinFreeDiskSpace int64
+	// The Unicode normalization form ("NFC" or "NFD") of the local paths and of the keys compared with them, see
+	// UnicodeNormalizationNFC. Defaults to none, i.e., the keys are mapped to local paths as they are.
+	UnicodeNormalization string
+}
+
+// MountStatus describes a mount and the outcome of its last sync from S3
+type MountStatus struct {
+	Id          string
+	Bucket      string
+	Prefix      string
+	Destination string
+	Writeable   bool
+	// Whether the download and upload workers of the mount are running
+	Running bool
+	// The number of syncs from S3 completed for the mount
+	SyncCount               int
+	LastSyncStart           time.Time
+	LastSyncEnd             time.Time
+	LastSyncDownloadedFiles int
+	LastSyncDownloadedBytes int64
+	// The S3 keys of the objects that could not be downloaded during the last sync
+	LastSyncErrors []string
+	// The error that failed the last sync as a whole (e.g., access to the bucket is denied), empty if the objects
+	// were listed. The local files are left as is when the sync fails.
+	LastSyncError string
+	// The S3 keys of the objects whose downloaded data did not match the object in S3 during the last sync, once per
+	// failed attempt. The objects are downloaded again up to 3 times before they are reported in LastSyncErrors.
+	LastSyncIntegrityMismatches []string
+	// The number of bytes the last sync downloaded for the attempts reported in LastSyncIntegrityMismatches, they are
+	// not counted in LastSyncDownloadedBytes
+	LastSyncIntegrityMismatchBytes int64
+	// The estimated number of bytes the last sync needed to download, i.e., the total size of the listed objects that
+	// were missing locally or changed in S3
+	LastSyncBytesNeeded int64
+	// The number of objects the last sync did not download as they exceed the mount's maxBytes or maxObjects quota
+	LastSyncObjectsOverQuota int
+	// The S3 keys of the objects the last sync did not download for lack of disk space, i.e., the objects beyond the
+	// capacity of the disk minus the low-disk watermark and the objects whose downloads were still paused for disk space
+	// after the longest pause (30 minutes)
+	LastSyncObjectsOverDiskSpace []string
+	// Whether the downloads of the mount are paused as the disk is low on space, see Options.MinFreeDiskSpace
+	LowDiskSpace bool
+	// The number of files the last sync evicted from the mount's cache and hydrated, for mounts in cache mode
+	LastSyncEvictedFiles  int
+	LastSyncHydratedFiles int
+	// The total size of the files in the mount's cache, for mounts in cache mode
+	CachedBytes int64
+	// The S3 keys of the archived objects (GLACIER or DEEP_ARCHIVE) the last sync did not download as they are not
+	// restored, and the number of restores the last sync started for them (when the mount's restoreArchived is true)
+	LastSyncArchivedObjects []string
+	LastSyncRestoresStarted int
+	// The S3 keys of the objects the last sync did not download as they cannot be mapped to a file inside the mount's
+	// directory, e.g., keys with "../" segments, NUL bytes or names reserved for the synchronizer's own files
+	LastSyncRejectedKeys []string
+	// The S3 keys of the objects the last sync downloaded under a suffixed name (e.g., "data‛~2/a.csv") as their paths
+	// differ only in case from the paths of other keys, on case-insensitive file systems
+	LastSyncCollidingKeys []string
+}
+
+// Synchronizer keeps a set of mounts in sync with S3. Use New to create one.
+type Synchronizer struct {
+	sess              *session.Session
+	state             SynchronizerState
+	logger            *log.Logger
+	debug             bool
+	concurrency       int
+	objectConcurrency int
+	options           Options
+	// Bounds the number of objects downloaded concurrently across all mounts, a download holds a slot while in-flight
+	downloadSlots chan struct{}
+	// The context of the in-flight downloads and uploads. It is only cancelled when the synchronizer shuts down and
+	// the in-flight transfers do not complete in time, see Shutdown.
+	transfersCtx   context.Context
+	abortTransfers context.CancelFunc
+	// Limit the download and upload rates across all mounts
+	downloadLimiter *rateLimiter
+	uploadLimiter   *rateLimiter
+	retryPolicy     retryPolicy
+	// Keeps the low-disk watermark across all mounts
+	diskSpace *diskSpaceGuard
+
+	// Guards mounts, started and stopped
+	lock sync.Mutex
+	// Map of the string representation of the mount (see mountToString) vs the handle of the running mount
+	mounts  map[string]*mountHandle
+	started bool
+	stopped bool
+	// Serializes SetMounts calls, held while removed mounts are being stopped
+	setMountsLock sync.Mutex
+	// Keeps track of the running mounts so that Wait can wait for them to complete
+	wg sync.WaitGroup
+}
+
+// New creates a Synchronizer from the given options. The mounts in the options are validated using ValidateMounts.
+func New(options Options) (*Synchronizer, error) {
+	if options.Session == nil {
+		return nil, fmt.Errorf("a session is required to create the synchronizer")
+	}
+	setMountDefaults(options.Mounts)
+	if err := ValidateMounts(options.Mounts); err != nil {
+		return nil, err
+	}
+	if options.Destination == "" {
+		options.Destination = "./"
+	}
+	if err := validateUnicodeNormalization(options.UnicodeNormalization); err != nil {
+		return nil, err
+	}
+	if options.Logger == nil {
+		options.Logger = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	if options.State == nil {
+		options.State = NewPersistentSynchronizerState()
+	}
+	if state, ok := options.State.(loggingState); ok {
+		state.setLogger(options.Logger)
+	}
+	options.State = newNormalizedState(options.State, options.UnicodeNormalization)
+	if options.Concurrency <= 0 {
+		options.Concurrency = defaultConcurrency
+	}
+	if options.PartSize <= 0 {
+		options.PartSize = defaultPartSize
+	}
+	if options.ObjectConcurrency <= 0 {
+		options.ObjectConcurrency = defaultObjectConcurrency
+	}
+	if options.MaxConcurrentObjects <= 0 {
+		options.MaxConcurrentObjects = defaultMaxConcurrentObjects
+	}
+	if options.DownloadInterval <= 0 {
+		options.DownloadInterval = defaultDownloadInterval
+	}
+	retryPolicy := defaultRetryPolicy
+	if options.MaxAttempts > 0 {
+		retryPolicy.maxAttempts = options.MaxAttempts
+	}
+
+	transfersCtx, abortTransfers := context.WithCancel(context.Background())
+	s := &Synchronizer{
+		sess:              options.Session,
+		state:             options.State,
+		logger:            options.Logger,
+		debug:             options.Debug,
+		concurrency:       options.Concurrency,
+		objectConcurrency: options.ObjectConcurrency,
+		options:           options,
+		downloadSlots:     make(chan struct{}, options.MaxConcurrentObjects),
+		transfersCtx:      transfersCtx,
+		abortTransfers:    abortTransfers,
+		downloadLimiter:   newRateLimiter(options.DownloadRateLimit),
+		uploadLimiter:     newRateLimiter(options.UploadRateLimit),
+		retryPolicy:       retryPolicy,
+		diskSpace:         newDiskSpaceGuard(options.MinFreeDiskSpace),
+		mounts:            make(map[string]*mountHandle),
+	}
+	return s, nil
+}
+
+// Start starts synchronizing the mounts. It does not wait for the initial downloads to complete, use Wait to wait
+// for all mounts to complete (i.e., when recurring downloads and file watchers stop or the synchronizer is stopped).
+// A stopped synchronizer cannot be started again.
+func (s *Synchronizer) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started || s.stopped {
+		return
+	}
+	s.started = true
+	for _, mount := range s.options.Mounts {
+		s.startMount(mount)
+	}
+}
+
+// Wait blocks until all the mounts complete
+func (s *Synchronizer) Wait() {
+	s.wg.Wait()
+}
+
+// Stop stops all the mounts, letting the in-flight downloads and pending uploads complete, and waits for them to
+// complete. The local files of the mounts are left in place. Stop is the same as Shutdown without a deadline.
+func (s *Synchronizer) Stop() {
+	s.Shutdown(context.Background())
+}
+
+// Shutdown stops all the mounts and waits for the in-flight downloads and pending uploads to complete. No new
+// downloads are started. If ctx is done before the transfers complete, the transfers are aborted and Shutdown
+// returns ctx.Err() once they have returned. The synchronizer state is saved in either case. The local files of the
+// mounts are left in place.
+func (s *Synchronizer) Shutdown(ctx context.Context) error {
+	stoppedCh := make(chan struct{})
+	go func() {
+		s.stopMounts()
+		close(stoppedCh)
+	}()
+
+	var err error
+	select {
+	case <-stoppedCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.logger.Printf("In-flight transfers did not complete in time, aborting them: %v\n", err)
+		s.abortTransfers()
+		<-stoppedCh
+	}
+
+	if saveErr := s.state.Save(); saveErr != nil {
+		s.logger.Printf("Error saving the synchronizer state: %v\n", saveErr)
+		if err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// Stops all the mounts and waits for them to complete
+func (s *Synchronizer) stopMounts() {
+	s.setMountsLock.Lock()
+	defer s.setMountsLock.Unlock()
+
+	s.lock.Lock()
+	s.stopped = true
+	handles := make([]*mountHandle, 0, len(s.mounts))
+	for key, handle := range s.mounts {
+		handles = append(handles, handle)
+		delete(s.mounts, key)
+	}
+	s.lock.Unlock()
+
+	for _, handle := range handles {
+		handle.Stop(false, s.logger, s.debug)
+	}
+	s.wg.Wait()
+}
+
+// SetMounts brings the running mounts in line with the given mounts. Mounts that are no longer present are stopped
+// (see Options.DeleteRemovedMounts) and new mounts are started. A mount whose attributes changed is stopped and
+// started again, except for changed rate limits which are applied to the running mount. If the synchronizer is not
+// started yet, the given mounts replace the mounts from the options. The mounts are validated first and the running
+// mounts are left untouched if any of them is invalid. Returns an error if the synchronizer is stopped.
+func (s *Synchronizer) SetMounts(mounts []Mount) error {
+	setMountDefaults(mounts)
+	if err := ValidateMounts(mounts); err != nil {
+		return err
+	}
+
+	s.setMountsLock.Lock()
+	defer s.setMountsLock.Unlock()
+
+	newMounts := make(map[string]Mount, len(mounts))
+	for _, mount := range mounts {
+		newMounts[mountToString(&mount)] = mount
+	}
+
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return fmt.Errorf("the synchronizer is stopped")
+	}
+	if !s.started {
+		s.options.Mounts = mounts
+		s.lock.Unlock()
+		return nil
+	}
+	var removedHandles []*mountHandle
+	for key, handle := range s.mounts {
+		if _, exists := newMounts[key]; !exists {
+			removedHandles = append(removedHandles, handle)
+			delete(s.mounts, key)
+		}
+	}
+	s.lock.Unlock()
+
+	// Stop the removed mounts first so that a changed mount does not have two sets of workers for the same
+	// destination directory
+	for _, handle := range removedHandles {
+		if s.debug {
+			s.logger.Printf("Mount with destination %v removed, stopping it\n", handle.config.destination)
+		}
+		handle.Stop(s.options.DeleteRemovedMounts, s.logger, s.debug)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, mount := range newMounts {
+		handle, exists := s.mounts[key]
+		if s.debug {
+			s.logger.Printf("Mount: %v, Adding to mounts: %t\n", *mount.Id, !exists)
+		}
+		if !exists {
+			s.startMount(mount)
+		} else {
+			handle.config.downloadLimiter.setLimit(*mount.DownloadRateLimit)
+			handle.config.uploadLimiter.setLimit(*mount.UploadRateLimit)
+		}
+	}
+	return nil
+}
+
+// SetRateLimits changes the maximum download and upload rates across all mounts in bytes per second. ZERO means
+// unlimited. The in-flight transfers adapt to the new limits right away.
+func (s *Synchronizer) SetRateLimits(downloadRateLimit int64, uploadRateLimit int64) {
+	s.downloadLimiter.setLimit(downloadRateLimit)
+	s.uploadLimiter.setLimit(uploadRateLimit)
+}
+
+// SyncNow triggers an immediate sync from S3 for the mount with the given id. With recurring downloads the sync is
+// picked up by the mount's recurring download loop (without waiting for the download interval) and SyncNow returns
+// right away, otherwise the sync is performed before SyncNow returns.
+func (s *Synchronizer) SyncNow(mountId string) error {
+	handle := s.findMount(mountId)
+	if handle == nil {
+		return fmt.Errorf("mount %q not found", mountId)
+	}
+	if s.options.RecurringDownloads {
+		handle.requestSync()
+		return nil
+	}
+	if !handle.tryStart() {
+		return fmt.Errorf("mount %q is stopped", mountId)
+	}
+	defer handle.wg.Done()
+	s.downloadFiles(handle)
+	return nil
+}
+
+// MountStatus returns the status of the mount with the given id
+func (s *Synchronizer) MountStatus(mountId string) (MountStatus, error) {
+	handle := s.findMount(mountId)
+	if handle == nil {
+		return MountStatus{}, fmt.Errorf("mount %q not found", mountId)
+	}
+	return handle.Status(), nil
+}
+
+// MountStatuses returns the statuses of all the current mounts
+func (s *Synchronizer) MountStatuses() []MountStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	statuses := make([]MountStatus, 0, len(s.mounts))
+	for _, handle := range s.mounts {
+		statuses = append(statuses, handle.Status())
+	}
+	return statuses
+}
+
+func (s *Synchronizer) findMount(mountId string) *mountHandle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, handle := range s.mounts {
+		if handle.config.id == mountId {
+			return handle
+		}
+	}
+	return nil
+}
+
+// Returns the configuration of the running mount with the given id or, if the mount is not running, of the mount with
+// the given id in the options. Returns nil if there is no such mount.
+func (s *Synchronizer) findMountConfig(mountId string) *mountConfiguration {
+	if handle := s.findMount(mountId); handle != nil {
+		return handle.config
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, mount := range s.options.Mounts {
+		if *mount.Id == mountId {
+			return s.newMountConfig(mount)
+		}
+	}
+	return nil
+}
+
+// Starts the download and upload workers of the given mount in another go routine. Must be called with s.lock held.
+func (s *Synchronizer) startMount(mount Mount) {
+	config := s.newMountConfig(mount)
+	handle := newMountHandle(config)
+	s.mounts[mountToString(&mount)] = handle
+
+	s.wg.Add(1) // Increment wait group counter everytime we start a mount
+	go func() {
+		defer s.wg.Done()
+		s.runMount(handle)
+	}()
+}
+
+// Returns the configuration of the given validated mount
+func (s *Synchronizer) newMountConfig(mount Mount) *mountConfiguration {
+	destination := filepath.Join(s.options.Destination, *mount.Id)
+	config := newMountConfiguration(
+		*mount.Id,
+		*mount.Bucket,
+		*mount.Prefix,
+		destination,
+		*mount.Writeable,
+		*mount.KmsKeyId,
+	)
+	config.sess = s.sessionForMount(*mount.RequesterPays, *mount.ExpectedBucketOwner)
+	config.normalization = s.options.UnicodeNormalization
+	config.downloadLimiter = newRateLimiter(*mount.DownloadRateLimit)
+	config.uploadLimiter = newRateLimiter(*mount.UploadRateLimit)
+	config.maxBytes = *mount.MaxBytes
+	config.maxObjects = *mount.MaxObjects
+	if *mount.CacheBytes > 0 {
+		config.cache = newFileCache(*mount.CacheBytes)
+	}
+	config.restoreArchived = *mount.RestoreArchived
+	config.restoreDays = *mount.RestoreDays
+	config.restoreTier = *mount.RestoreTier
+	if *mount.AsOf != "" || *mount.Lockfile != "" {
+		// The time was validated by ValidateMounts
+		asOf, _ := parseAsOf(*mount.AsOf)
+		config.snapshot = newMountSnapshot(asOf, *mount.Lockfile)
+	}
+	return config
+}
+
+// Downloads the files of the mount and, if the mount is writeable, starts the file watchers. Waits until all the
+// go routines of the mount complete.
+func (s *Synchronizer) runMount(handle *mountHandle) {
+	mountConfig := handle.config
+	if s.debug {
+		s.logger.Printf("Starting mount: %+v\n", mountConfig)
+	}
+	if !handle.tryStart() {
+		if s.debug {
+			s.logger.Printf("Mount with destination %v was stopped before it started, skipping\n", mountConfig.destination)
+		}
+		return
+	}
+	handle.setRunning(true)
+	s.removeStaleTempFiles(mountConfig)
+	if mountConfig.cache != nil {
+		if err := s.loadCache(mountConfig); err != nil {
+			s.logger.Printf("Error loading the cache of mount %v: %v\n", mountConfig.id, err)
+		}
+	}
+	if s.options.RecurringDownloads {
+		// Trigger recurring download
+		s.setupRecurringDownloads(handle)
+	} else {
+		s.downloadFiles(handle)
+	}
+	if mountConfig.writeable {
+		err := s.setupUploadWatcher(handle)
+		if err != nil {
+			s.logger.Printf("Error setting up file watcher: " + err.Error())
+		}
+	}
+	handle.wg.Done() // Setup of the mount is complete, see handle.tryStart()
+
+	handle.wg.Wait()
+	handle.setRunning(false)
+}
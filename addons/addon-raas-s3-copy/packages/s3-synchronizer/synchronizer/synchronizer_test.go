@@ -0,0 +1,3189 @@
+package synchronizer
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRegion = "us-east-1"
+const testFakeBucketName = "test-bucket"
+const testFileContentTemplate = "test file content for file = %d"
+
+// ------------------------------- Test Cases -------------------------------/
+
+// Test that all problems with the mounts are reported at once along with the index of the offending mount
+func TestValidateMountsReportsAllProblems(t *testing.T) {
+	// ---- Data setup ----
+	testMounts := []Mount{
+		{Id: String("valid-id"), Bucket: String("valid-bucket"), Prefix: String("some/prefix"), KmsKeyId: String("arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab")},
+		{Bucket: String("valid-bucket"), Prefix: String("some/prefix")},
+		{Id: String("valid-id"), Bucket: String("valid-bucket"), Prefix: String("some/prefix")},
+		{Id: String("../escaped"), Bucket: String("Invalid_Bucket"), Prefix: String("some/prefix")},
+		{Id: String("no-prefix"), Bucket: String("192.168.1.1")},
+		{Id: String("bad-kms"), Bucket: String("valid-bucket"), Prefix: String(""), KmsKeyId: String("not-an-arn")},
+		{Id: String("bad-quota"), Bucket: String("valid-bucket"), Prefix: String(""), MaxBytes: Int64(-1), MaxObjects: Int64(10)},
+		{Id: String("writeable-cache"), Bucket: String("valid-bucket"), Prefix: String(""), Writeable: Bool(true), CacheBytes: Int64(1024)},
+		{Id: String("bad-restore"), Bucket: String("valid-bucket"), Prefix: String(""), RestoreArchived: Bool(true), RestoreDays: Int64(0), RestoreTier: String("Fast")},
+		{Id: String("bad-pin"), Bucket: String("valid-bucket"), Prefix: String(""), Writeable: Bool(true), AsOf: String("yesterday"), Lockfile: String("mount.lock.json")},
+		{Id: String("bad-owner"), Bucket: String("valid-bucket"), Prefix: String(""), ExpectedBucketOwner: String("not-an-account")},
+	}
+
+	// ---- Run code under test ----
+	err := ValidateMounts(testMounts)
+
+	// ---- Assertions ----
+	validationErr, ok := err.(*MountValidationError)
+	if !ok {
+		t.Fatalf("ASSERT_FAILURE: Expected: *MountValidationError | Actual: %v", err)
+	}
+	expectedProblems := []string{
+		"mount at index 1: id is missing",
+		`mount at index 2 (id "valid-id"): id is a duplicate of the id of the mount at index 0`,
+		`mount at index 3 (id "../escaped"): id must not contain path separators`,
+		`mount at index 3 (id "../escaped"): bucket name "Invalid_Bucket"`,
+		`mount at index 4 (id "no-prefix"): bucket name "192.168.1.1" must not be formatted as an IP address`,
+		`mount at index 4 (id "no-prefix"): prefix is missing`,
+		`mount at index 5 (id "bad-kms"): kmsKeyId "not-an-arn" is not a valid KMS key ARN`,
+		`mount at index 6 (id "bad-quota"): maxBytes -1 must not be negative`,
+		`mount at index 7 (id "writeable-cache"): cacheBytes is not supported for writeable mounts`,
+		`mount at index 8 (id "bad-restore"): restoreDays 0 must be at least 1`,
+		`mount at index 8 (id "bad-restore"): restoreTier "Fast" must be one of Standard, Bulk or Expedited`,
+		`mount at index 9 (id "bad-pin"): asOf "yesterday" is not a valid RFC 3339 time`,
+		`mount at index 9 (id "bad-pin"): asOf and lockfile cannot be used together`,
+		`mount at index 9 (id "bad-pin"): asOf and lockfile are not supported for writeable mounts`,
+		`mount at index 10 (id "bad-owner"): expectedBucketOwner "not-an-account" is not a valid 12-digit AWS account id`,
+	}
+	if len(validationErr.Problems) != len(expectedProblems) {
+		t.Errorf("ASSERT_FAILURE: Expected: %d problems | Actual: %d problems: %v", len(expectedProblems), len(validationErr.Problems), err)
+	}
+	for _, expectedProblem := range expectedProblems {
+		if !strings.Contains(err.Error(), expectedProblem) {
+			t.Errorf(`ASSERT_FAILURE: Expected: Error to contain "%v" | Actual: %v`, expectedProblem, err)
+		}
+	}
+}
+
+// Test that distinct mounts are identified by distinct strings, also when their attributes concatenate to the same text
+func TestMountToString(t *testing.T) {
+	// ---- Data setup ----
+	testMounts := []Mount{
+		{Id: String("id"), Bucket: String("ab"), Prefix: String("c/")},
+		{Id: String("id"), Bucket: String("a"), Prefix: String("bc/")},
+		{Id: String("c/id"), Bucket: String("ab"), Prefix: String("")},
+		{Id: String("id"), Bucket: String("ab"), Prefix: String("c/"), KmsKeyId: String("|")},
+	}
+	setMountDefaults(testMounts)
+
+	// ---- Run code under test ----
+	mountStrings := make(map[string]int)
+	for i := range testMounts {
+		mountStrings[mountToString(&testMounts[i])] = i
+	}
+
+	// ---- Assertions ----
+	if len(mountStrings) != len(testMounts) {
+		t.Errorf("ASSERT_FAILURE: Expected: %d distinct strings | Actual: %v", len(testMounts), mountStrings)
+	}
+}
+
+// Negative test: Test that a synchronizer cannot be created without a session or with invalid mounts
+func TestNewInvalidOptions(t *testing.T) {
+	// ---- Run code under test ----
+	_, errNoSession := New(Options{})
+	_, errInvalidMounts := New(Options{Session: session.Must(session.NewSession()), Mounts: []Mount{{Id: String("no-bucket")}}})
+
+	// ---- Assertions ----
+	if errNoSession == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: Error for missing session | Actual: nil")
+	}
+	if _, ok := errInvalidMounts.(*MountValidationError); !ok {
+		t.Errorf("ASSERT_FAILURE: Expected: *MountValidationError | Actual: %v", errInvalidMounts)
+	}
+}
+
+// Test the one time download of a mount followed by a sync triggered using SyncNow
+func TestSynchronizerSyncNow(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerSyncNow"
+	noOfFilesInMount := 3
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+		Concurrency: 2,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	assertMountStatus(t, s, testMountId, 1, noOfFilesInMount)
+
+	// ---- Data setup ----
+	// Add one more file to S3
+	putTestMountFiles(t, sess, testMountId, noOfFilesInMount, 1)
+
+	// ---- Run code under test ----
+	err = s.SyncNow(testMountId)
+	if err != nil {
+		t.Errorf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	// Only the new file should have been downloaded
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount+1)
+	assertMountStatus(t, s, testMountId, 2, 1)
+
+	// ---- Run code under test ----
+	s.Stop()
+	err = s.SyncNow(testMountId)
+
+	// ---- Assertions ----
+	if err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: Error syncing a stopped mount | Actual: nil")
+	}
+}
+
+// Test that SyncNow triggers a sync without waiting for the download interval with recurring downloads
+func TestSynchronizerSyncNowWithRecurringDownloads(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerSyncNowWithRecurringDownloads"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:            sess,
+		Mounts:             []Mount{*testMount},
+		Destination:        destinationBase,
+		State:              NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:              true,
+		RecurringDownloads: true,
+		DownloadInterval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	waitForSyncCount(t, s, testMountId, 1)
+
+	// Add one more file to S3 and sync right away
+	putTestMountFiles(t, sess, testMountId, noOfFilesInMount, 1)
+	err = s.SyncNow(testMountId)
+	if err != nil {
+		t.Errorf("Error syncing the mount: %v", err)
+	}
+	waitForSyncCount(t, s, testMountId, 2)
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount+1)
+	status, _ := s.MountStatus(testMountId)
+	if !status.Running {
+		t.Errorf("ASSERT_FAILURE: Expected: Mount to be running | Actual: Mount is not running")
+	}
+
+	// ---- Run code under test ----
+	s.Stop()
+
+	// ---- Assertions ----
+	if len(s.MountStatuses()) != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: No mounts after stop | Actual: %v", s.MountStatuses())
+	}
+	if _, err := s.MountStatus(testMountId); err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: Error getting status of a stopped mount | Actual: nil")
+	}
+}
+
+// Test that Shutdown aborts the in-flight downloads that do not complete before the deadline and saves the state
+func TestSynchronizerShutdownAbortsInFlightDownloads(t *testing.T) {
+	// ---- Data setup ----
+	// Block the download of the object named "x-stuck.txt" until the request is aborted
+	blockedCh := make(chan struct{}, 1)
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/x-stuck.txt") {
+				blockedCh <- struct{}{}
+				<-r.Context().Done()
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	testMountId := "TestSynchronizerShutdownAbortsInFlightDownloads"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	_, err := s3.New(sess).PutObject(&s3.PutObjectInput{
+		Body:   strings.NewReader("stuck"),
+		Bucket: aws.String(testFakeBucketName),
+		Key:    aws.String(*testMount.Prefix + "/x-stuck.txt"),
+	})
+	if err != nil {
+		t.Fatalf("Could not put test files to fake S3 server for testing: %v", err)
+	}
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	select {
+	case <-blockedCh:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Timed out waiting for the download to start")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+
+	// ---- Assertions ----
+	if err != context.DeadlineExceeded {
+		t.Errorf("ASSERT_FAILURE: Expected: %v | Actual: %v", context.DeadlineExceeded, err)
+	}
+	// The objects listed before "x-stuck.txt" are downloaded and recorded in the saved state, "x-stuck.txt" is not
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	savedState := NewPersistentSynchronizerStateIn(destinationBase)
+	for i := 0; i < noOfFilesInMount; i++ {
+		key := fmt.Sprintf("%s/test%d.txt", *testMount.Prefix, i)
+		if !savedState.IsFileDownloadedFromS3(key) {
+			t.Errorf("ASSERT_FAILURE: Expected: %s in the saved state | Actual: Not in the saved state", key)
+		}
+	}
+	if savedState.IsFileDownloadedFromS3(*testMount.Prefix + "/x-stuck.txt") {
+		t.Errorf("ASSERT_FAILURE: Expected: Aborted download not in the saved state | Actual: In the saved state")
+	}
+}
+
+// Test that objects are downloaded concurrently and the number of concurrent downloads across all mounts is bounded
+// by MaxConcurrentObjects
+func TestSynchronizerConcurrentObjectDownloads(t *testing.T) {
+	// ---- Data setup ----
+	// Keep track of the maximum number of concurrent object downloads, slowing them down so that they overlap
+	var lock sync.Mutex
+	inFlight := 0
+	maxInFlight := 0
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Object GETs have the key in the path after the bucket name, listings only have the bucket name
+			isObjectGet := r.Method == http.MethodGet && strings.Count(strings.Trim(r.URL.Path, "/"), "/") > 0
+			if isObjectGet {
+				lock.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				lock.Unlock()
+				time.Sleep(50 * time.Millisecond)
+				defer func() {
+					lock.Lock()
+					inFlight--
+					lock.Unlock()
+				}()
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	noOfFilesInMount := 10
+	testMount1 := putTestMountFiles(t, sess, "TestSynchronizerConcurrentObjectDownloads1", 0, noOfFilesInMount)
+	testMount2 := putTestMountFiles(t, sess, "TestSynchronizerConcurrentObjectDownloads2", 0, noOfFilesInMount)
+
+	// ---- Inputs ----
+	maxConcurrentObjects := 3
+	s, err := New(Options{
+		Session:              sess,
+		Mounts:               []Mount{*testMount1, *testMount2},
+		Destination:          destinationBase,
+		State:                NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:                true,
+		Concurrency:          1,
+		ObjectConcurrency:    2,
+		MaxConcurrentObjects: maxConcurrentObjects,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, *testMount1.Id, 0, noOfFilesInMount)
+	assertFilesDownloaded(t, destinationBase, *testMount2.Id, 0, noOfFilesInMount)
+	if maxInFlight < 2 || maxInFlight > maxConcurrentObjects {
+		t.Errorf("ASSERT_FAILURE: Expected: Between 2 and %d concurrent downloads | Actual: %d concurrent downloads", maxConcurrentObjects, maxInFlight)
+	}
+}
+
+// Test that the downloads are atomic
+// - Make sure a failed download of an updated object leaves the previously downloaded file intact
+// - Make sure no temporary files are left behind
+// - Make sure stale temporary files from previous runs are deleted when the mount starts
+func TestSynchronizerAtomicDownloads(t *testing.T) {
+	// ---- Data setup ----
+	// Fail the downloads of "test0.txt" once failDownloads is set
+	var failDownloads int32
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&failDownloads) == 1 && r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/test0.txt") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	testMountId := "TestSynchronizerAtomicDownloads"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+
+	// Simulate a temporary file left behind by an interrupted download
+	staleTempFile := filepath.Join(destinationBase, testMountId, "sub-dir", tempFilePrefix+"stale"+tempFileSuffix)
+	os.MkdirAll(filepath.Dir(staleTempFile), os.ModePerm)
+	if err := ioutil.WriteFile(staleTempFile, []byte("partial"), 0666); err != nil {
+		t.Fatalf("Could not create stale temporary file for testing: %v", err)
+	}
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	if _, err := os.Stat(staleTempFile); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: Stale temporary file to be deleted | Actual: %v", err)
+	}
+
+	// ---- Data setup ----
+	// Update the object in S3 and make its download fail
+	_, err = s3.New(sess).PutObject(&s3.PutObjectInput{
+		Body:   strings.NewReader("UPDATED"),
+		Bucket: aws.String(testFakeBucketName),
+		Key:    aws.String(*testMount.Prefix + "/test0.txt"),
+	})
+	if err != nil {
+		t.Fatalf("Could not put test files to fake S3 server for testing: %v", err)
+	}
+	atomic.StoreInt32(&failDownloads, 1)
+
+	// ---- Run code under test ----
+	err = s.SyncNow(testMountId)
+	if err != nil {
+		t.Errorf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	// The previously downloaded file is left as is
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	status, _ := s.MountStatus(testMountId)
+	if len(status.LastSyncErrors) != 1 || status.LastSyncErrors[0] != *testMount.Prefix+"/test0.txt" {
+		t.Errorf("ASSERT_FAILURE: Expected: Error for test0.txt | Actual: %v", status.LastSyncErrors)
+	}
+	filepath.Walk(destinationBase, func(path string, info os.FileInfo, err error) error {
+		if err == nil && isTempFile(path) {
+			t.Errorf("ASSERT_FAILURE: Expected: No temporary files | Actual: %s", path)
+		}
+		return nil
+	})
+	s.Stop()
+}
+
+// Test that an interrupted download of an object with multiple parts is resumed from the last completed part by the
+// next run, and is restarted from scratch if the object changed in S3 in the meantime
+func TestSynchronizerResumesInterruptedDownloads(t *testing.T) {
+	for _, objectChanged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("objectChanged=%v", objectChanged), func(t *testing.T) {
+			// ---- Data setup ----
+			// Fail the downloads of the parts from the 4th part on once failDownloads is set, and keep track of
+			// the requested ranges
+			partSize := int64(1024)
+			var failDownloads int32 = 1
+			var lock sync.Mutex
+			var requestedRanges []string
+			sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/large.bin") {
+						rangeHeader := r.Header.Get("Range")
+						lock.Lock()
+						requestedRanges = append(requestedRanges, rangeHeader)
+						lock.Unlock()
+						if atomic.LoadInt32(&failDownloads) == 1 && !strings.HasPrefix(rangeHeader, "bytes=0-") &&
+							!strings.HasPrefix(rangeHeader, fmt.Sprintf("bytes=%d-", partSize)) &&
+							!strings.HasPrefix(rangeHeader, fmt.Sprintf("bytes=%d-", 2*partSize)) {
+							w.WriteHeader(http.StatusForbidden)
+							return
+						}
+					}
+					h.ServeHTTP(w, r)
+				})
+			})
+			defer cleanup()
+			testMountId := "TestSynchronizerResumesInterruptedDownloads"
+			testMount := putTestMountFiles(t, sess, testMountId, 0, 0)
+			key := *testMount.Prefix + "/large.bin"
+			putTestObject(t, sess, key, strings.Repeat("0123456789", 500))
+
+			// ---- Inputs ----
+			options := Options{
+				Session:     sess,
+				Mounts:      []Mount{*testMount},
+				Destination: destinationBase,
+				Debug:       true,
+				Concurrency: 1,
+				PartSize:    partSize,
+			}
+
+			// ---- Run code under test ----
+			options.State = NewPersistentSynchronizerStateIn(destinationBase)
+			s, err := New(options)
+			if err != nil {
+				t.Fatalf("Error creating the synchronizer: %v", err)
+			}
+			s.Start()
+			s.Wait()
+
+			// ---- Assertions ----
+			partialDownload, exists := options.State.PartialDownload(mountStateKey(testFakeBucketName, testMountId, key))
+			if !exists || partialDownload.Offset != 3*partSize {
+				t.Fatalf("ASSERT_FAILURE: Expected: Partial download at offset %d | Actual: %+v", 3*partSize, partialDownload)
+			}
+			if _, err := os.Stat(filepath.Join(destinationBase, testMountId, "large.bin")); !os.IsNotExist(err) {
+				t.Errorf("ASSERT_FAILURE: Expected: No local file for the interrupted download | Actual: %v", err)
+			}
+
+			// ---- Data setup ----
+			expectedContent := strings.Repeat("0123456789", 500)
+			if objectChanged {
+				expectedContent = strings.Repeat("9876543210", 500)
+				putTestObject(t, sess, key, expectedContent)
+			}
+			atomic.StoreInt32(&failDownloads, 0)
+			requestedRanges = nil
+
+			// ---- Run code under test ----
+			// Simulate the next run of the program with the state loaded from disk
+			options.State = NewPersistentSynchronizerStateIn(destinationBase)
+			s, err = New(options)
+			if err != nil {
+				t.Fatalf("Error creating the synchronizer: %v", err)
+			}
+			s.Start()
+			s.Wait()
+
+			// ---- Assertions ----
+			content, err := ioutil.ReadFile(filepath.Join(destinationBase, testMountId, "large.bin"))
+			if err != nil || string(content) != expectedContent {
+				t.Errorf("ASSERT_FAILURE: Expected: Downloaded file with the object's content | Actual: %v", err)
+			}
+			expectedFirstRange := fmt.Sprintf("bytes=%d-%d", 3*partSize, 4*partSize-1)
+			if objectChanged {
+				expectedFirstRange = fmt.Sprintf("bytes=0-%d", partSize-1)
+			}
+			if len(requestedRanges) == 0 || requestedRanges[0] != expectedFirstRange {
+				t.Errorf("ASSERT_FAILURE: Expected: First requested range %s | Actual: %v", expectedFirstRange, requestedRanges)
+			}
+			if _, exists := options.State.PartialDownload(mountStateKey(testFakeBucketName, testMountId, key)); exists {
+				t.Errorf("ASSERT_FAILURE: Expected: Partial download removed from the state | Actual: Partial download in the state")
+			}
+			filepath.Walk(destinationBase, func(path string, info os.FileInfo, err error) error {
+				if err == nil && isTempFile(path) {
+					t.Errorf("ASSERT_FAILURE: Expected: No temporary files | Actual: %s", path)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// Test that the interrupted downloads of the same object by two mounts of the same prefix are resumed independently,
+// i.e., the mounts do not discard each other's progress
+func TestSynchronizerResumesInterruptedDownloadsPerMount(t *testing.T) {
+	// ---- Data setup ----
+	// Fail the downloads of the parts from the 4th part on
+	partSize := int64(1024)
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/large.bin") {
+				rangeHeader := r.Header.Get("Range")
+				if !strings.HasPrefix(rangeHeader, "bytes=0-") &&
+					!strings.HasPrefix(rangeHeader, fmt.Sprintf("bytes=%d-", partSize)) &&
+					!strings.HasPrefix(rangeHeader, fmt.Sprintf("bytes=%d-", 2*partSize)) {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	testMountId := "TestSynchronizerResumesInterruptedDownloadsPerMount"
+	testMount := putTestMountFiles(t, sess, testMountId, 0, 0)
+	key := *testMount.Prefix + "/large.bin"
+	putTestObject(t, sess, key, strings.Repeat("0123456789", 500))
+	otherMountId := testMountId + "-other"
+	otherMount := Mount{Id: String(otherMountId), Bucket: String(testFakeBucketName), Prefix: testMount.Prefix}
+
+	// ---- Inputs ----
+	options := Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount, otherMount},
+		Destination: destinationBase,
+		Debug:       true,
+		Concurrency: 2,
+		PartSize:    partSize,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+	}
+
+	// ---- Run code under test ----
+	s, err := New(options)
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	for _, mountId := range []string{testMountId, otherMountId} {
+		partialDownload, exists := options.State.PartialDownload(mountStateKey(testFakeBucketName, mountId, key))
+		if !exists || partialDownload.Offset != 3*partSize {
+			t.Errorf("ASSERT_FAILURE: Expected: Partial download of mount %s at offset %d | Actual: %+v", mountId, 3*partSize, partialDownload)
+			continue
+		}
+		if !strings.HasPrefix(partialDownload.TempFile, filepath.Join(destinationBase, mountId)+string(filepath.Separator)) {
+			t.Errorf("ASSERT_FAILURE: Expected: Temporary file in the directory of mount %s | Actual: %s", mountId, partialDownload.TempFile)
+		}
+		if _, err := os.Stat(partialDownload.TempFile); err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: Temporary file of mount %s kept | Actual: %v", mountId, err)
+		}
+	}
+}
+
+// Test that downloaded files get the modification time recorded in the object's "mtime" metadata or the object's
+// LastModified time, and that uploads record the local modification time in the "mtime" metadata
+func TestSynchronizerPreservesModificationTimes(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerPreservesModificationTimes"
+	testMount := putTestMountFiles(t, sess, testMountId, 0, 1)
+	s3Client := s3.New(sess)
+	for key, content := range map[string]string{"with-mtime.txt": "small", "large-with-mtime.bin": strings.Repeat("0123456789", 500)} {
+		_, err := s3Client.PutObject(&s3.PutObjectInput{
+			Body:     strings.NewReader(content),
+			Bucket:   aws.String(testFakeBucketName),
+			Key:      aws.String(*testMount.Prefix + "/" + key),
+			Metadata: map[string]*string{mtimeMetadataKey: aws.String("1500000000.5")},
+		})
+		if err != nil {
+			t.Fatalf("Could not put test files to fake S3 server for testing: %v", err)
+		}
+	}
+	// The downloads use the LastModified time from the listing, which may be more precise than the one HEAD returns
+	list, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(testFakeBucketName),
+		Prefix: aws.String(*testMount.Prefix + "/test0.txt"),
+	})
+	if err != nil || len(list.Contents) != 1 {
+		t.Fatalf("Could not list test object from fake S3 server: %v", err)
+	}
+
+	// ---- Inputs ----
+	// "large-with-mtime.bin" is larger than PartSize and downloaded with ranged GETs, "with-mtime.txt" is not
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+		PartSize:    1024,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	expectedMtimes := map[string]time.Time{
+		"test0.txt":            *list.Contents[0].LastModified,
+		"with-mtime.txt":       time.Unix(1500000000, 500000000),
+		"large-with-mtime.bin": time.Unix(1500000000, 500000000),
+	}
+	for name, expectedMtime := range expectedMtimes {
+		fi, err := os.Stat(filepath.Join(destinationBase, testMountId, name))
+		if err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: %s to be downloaded | Actual: %v", name, err)
+			continue
+		}
+		if !fi.ModTime().Equal(expectedMtime) {
+			t.Errorf("ASSERT_FAILURE: Expected: Modification time of %s to be %v | Actual: %v", name, expectedMtime, fi.ModTime())
+		}
+	}
+
+	// ---- Data setup ----
+	uploadDir := filepath.Join(destinationBase, "upload")
+	os.MkdirAll(uploadDir, os.ModePerm)
+	uploadFile := filepath.Join(uploadDir, "uploaded.txt")
+	if err := ioutil.WriteFile(uploadFile, []byte("uploaded"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	localMtime := time.Unix(1600000000, 123456789)
+	os.Chtimes(uploadFile, localMtime, localMtime)
+
+	// ---- Run code under test ----
+	err = s.uploadToS3(context.Background(), s.sess, uploadDir, uploadFile, testFakeBucketName, "uploads/", "", nil)
+	if err != nil {
+		t.Fatalf("Error uploading the file: %v", err)
+	}
+
+	// ---- Assertions ----
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(testFakeBucketName),
+		Key:    aws.String("uploads/uploaded.txt"),
+	})
+	if err != nil {
+		t.Fatalf("Could not get uploaded object from fake S3 server: %v", err)
+	}
+	// The SDK canonicalizes the metadata keys
+	if actual := aws.StringValue(head.Metadata["Mtime"]); actual != formatMtime(localMtime) {
+		t.Errorf("ASSERT_FAILURE: Expected: mtime metadata %s | Actual: %s", formatMtime(localMtime), actual)
+	}
+	if parsed, err := parseMtime(formatMtime(localMtime)); err != nil || !parsed.Equal(localMtime) {
+		t.Errorf("ASSERT_FAILURE: Expected: mtime %v | Actual: %v (%v)", localMtime, parsed, err)
+	}
+}
+
+// Test that downloads whose data does not match the object in S3 are retried and reported
+func TestSynchronizerVerifiesDownloads(t *testing.T) {
+	// ---- Data setup ----
+	// Corrupt the first response for "corrupt-once.txt" and all responses for "corrupt-always.txt"
+	var corruptOnce int32 = 1
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && (strings.HasSuffix(r.URL.Path, "/corrupt-always.txt") ||
+				(strings.HasSuffix(r.URL.Path, "/corrupt-once.txt") && atomic.CompareAndSwapInt32(&corruptOnce, 1, 0))) {
+				w = &corruptingResponseWriter{ResponseWriter: w}
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	testMountId := "TestSynchronizerVerifiesDownloads"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	corruptOnceKey := *testMount.Prefix + "/corrupt-once.txt"
+	corruptAlwaysKey := *testMount.Prefix + "/corrupt-always.txt"
+	putTestObject(t, sess, corruptOnceKey, "corrupt once")
+	putTestObject(t, sess, corruptAlwaysKey, "corrupt always")
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	content, err := ioutil.ReadFile(filepath.Join(destinationBase, testMountId, "corrupt-once.txt"))
+	if err != nil || string(content) != "corrupt once" {
+		t.Errorf("ASSERT_FAILURE: Expected: corrupt-once.txt to be downloaded again | Actual: %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(destinationBase, testMountId, "corrupt-always.txt")); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: corrupt-always.txt not to be downloaded | Actual: %v", err)
+	}
+	status, _ := s.MountStatus(testMountId)
+	if len(status.LastSyncErrors) != 1 || status.LastSyncErrors[0] != corruptAlwaysKey {
+		t.Errorf("ASSERT_FAILURE: Expected: Error for corrupt-always.txt | Actual: %v", status.LastSyncErrors)
+	}
+	mismatches := make(map[string]int)
+	for _, key := range status.LastSyncIntegrityMismatches {
+		mismatches[key]++
+	}
+	if len(mismatches) != 2 || mismatches[corruptOnceKey] != 1 || mismatches[corruptAlwaysKey] != maxIntegrityAttempts {
+		t.Errorf("ASSERT_FAILURE: Expected: 1 mismatch for corrupt-once.txt and %d for corrupt-always.txt | Actual: %v", maxIntegrityAttempts, status.LastSyncIntegrityMismatches)
+	}
+	// Only the bytes of the attempts that succeeded count as downloaded
+	expectedBytes := int64(noOfFilesInMount*len(fmt.Sprintf(testFileContentTemplate, 0)) + len("corrupt once"))
+	expectedMismatchBytes := int64(len("corrupt once") + maxIntegrityAttempts*len("corrupt always"))
+	if status.LastSyncDownloadedBytes != expectedBytes || status.LastSyncIntegrityMismatchBytes != expectedMismatchBytes {
+		t.Errorf("ASSERT_FAILURE: Expected: %d bytes downloaded and %d bytes of mismatches | Actual: %d and %d", expectedBytes, expectedMismatchBytes, status.LastSyncDownloadedBytes, status.LastSyncIntegrityMismatchBytes)
+	}
+	s.Stop()
+}
+
+// Test the verification of downloaded data against the ETag and the additional checksums
+func TestVerifyDownload(t *testing.T) {
+	// ---- Data setup ----
+	dir, err := ioutil.TempDir("", "s3-synchronizer-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte(strings.Repeat("0123456789", 1200000))
+	path := filepath.Join(dir, "data.bin")
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	const partSize = 5 * 1024 * 1024
+	var partDigests []byte
+	for start := 0; start < len(data); start += partSize {
+		end := start + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		digest := md5.Sum(data[start:end])
+		partDigests = append(partDigests, digest[:]...)
+	}
+	// A part size none of the guesses of multipartPartSizeCandidates match
+	const otherPartSize = 3000000
+	var otherPartDigests []byte
+	for start := 0; start < len(data); start += otherPartSize {
+		digest := md5.Sum(data[start : start+otherPartSize])
+		otherPartDigests = append(otherPartDigests, digest[:]...)
+	}
+	otherPartSizeETag := fmt.Sprintf(`"%x-%d"`, md5.Sum(otherPartDigests), len(otherPartDigests)/md5.Size)
+	md5Digest := md5.Sum(data)
+	sha256Digest := sha256.Sum256(data)
+	crc32cDigest := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc32cDigest, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	eTag := fmt.Sprintf(`"%x"`, md5Digest)
+	multipartETag := fmt.Sprintf(`"%x-%d"`, md5.Sum(partDigests), len(partDigests)/md5.Size)
+	otherETag := fmt.Sprintf(`"%x"`, md5.Sum([]byte("other")))
+	otherChecksum := base64.StdEncoding.EncodeToString([]byte("other"))
+
+	// ---- Inputs ----
+	tests := []struct {
+		name          string
+		eTag          string
+		headers       objectResponseHeaders
+		expectedValid bool
+	}{
+		{"matching ETag", eTag, objectResponseHeaders{}, true},
+		{"mismatching ETag", otherETag, objectResponseHeaders{}, false},
+		{"ETag of SSE-KMS object", otherETag, objectResponseHeaders{serverSideEncryption: "aws:kms"}, true},
+		{"matching multipart ETag", multipartETag, objectResponseHeaders{}, true},
+		{"mismatching multipart ETag", fmt.Sprintf(`"%x-3"`, md5.Sum([]byte("other"))), objectResponseHeaders{partSize: partSize}, false},
+		{"multipart ETag matching none of the guessed part sizes", fmt.Sprintf(`"%x-3"`, md5.Sum([]byte("other"))), objectResponseHeaders{}, true},
+		{"multipart ETag with unknown part size", fmt.Sprintf(`"%x-7"`, md5.Sum([]byte("other"))), objectResponseHeaders{}, true},
+		{"matching multipart ETag of a part size that is not guessed", otherPartSizeETag, objectResponseHeaders{partSize: otherPartSize}, true},
+		{"mismatching multipart ETag of a part size that is not guessed", fmt.Sprintf(`"%x-4"`, md5.Sum([]byte("other"))), objectResponseHeaders{partSize: otherPartSize}, false},
+		{"matching SHA-256", eTag, objectResponseHeaders{checksumSHA256: base64.StdEncoding.EncodeToString(sha256Digest[:])}, true},
+		{"mismatching SHA-256", eTag, objectResponseHeaders{checksumSHA256: otherChecksum}, false},
+		{"matching CRC32C", eTag, objectResponseHeaders{checksumCRC32C: base64.StdEncoding.EncodeToString(crc32cDigest)}, true},
+		{"mismatching CRC32C", eTag, objectResponseHeaders{checksumCRC32C: otherChecksum}, false},
+		{"composite checksum", eTag, objectResponseHeaders{checksumSHA256: otherChecksum + "-3"}, true},
+	}
+	s := &Synchronizer{logger: log.New(ioutil.Discard, "", 0)}
+	for _, test := range tests {
+		item := &s3.Object{Key: aws.String("data.bin"), ETag: aws.String(test.eTag), Size: aws.Int64(int64(len(data)))}
+
+		// ---- Run code under test ----
+		err := s.verifyDownload(path, item, test.headers)
+
+		// ---- Assertions ----
+		if test.expectedValid && err != nil {
+			t.Errorf("ASSERT_FAILURE: %s: Expected: No error | Actual: %v", test.name, err)
+		}
+		if !test.expectedValid && !isIntegrityError(err) {
+			t.Errorf("ASSERT_FAILURE: %s: Expected: Integrity error | Actual: %v", test.name, err)
+		}
+	}
+}
+
+// Test that the part size of objects uploaded in parts is found using the part number of HeadObject, retrying the
+// calls that fail
+func TestFirstPartSize(t *testing.T) {
+	// ---- Data setup ----
+	var throttled int32 = 1
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// gofakes3 ignores the part number, answer like S3 for the first part of "multipart.bin" once the first
+			// call is throttled
+			if r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/multipart.bin") && r.URL.Query().Get("partNumber") == "1" {
+				if atomic.CompareAndSwapInt32(&throttled, 1, 0) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Content-Length", "3000000")
+				w.Header().Set("X-Amz-Mp-Parts-Count", "4")
+				w.WriteHeader(http.StatusPartialContent)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	putTestObject(t, sess, "single.bin", "content")
+
+	// ---- Inputs ----
+	tests := []struct {
+		key              string
+		eTag             string
+		size             int64
+		expectedPartSize int64
+	}{
+		{"multipart.bin", `"0123456789abcdef0123456789abcdef-4"`, 12000000, 3000000},
+		// The part size must result in the number of parts of the ETag
+		{"multipart.bin", `"0123456789abcdef0123456789abcdef-3"`, 12000000, 0},
+		{"single.bin", `"0123456789abcdef0123456789abcdef"`, 7, 0},
+		// S3 ignores the part number, the whole object is not a part
+		{"single.bin", `"0123456789abcdef0123456789abcdef-2"`, 7, 0},
+	}
+	s, err := New(Options{Session: sess, State: NewPersistentSynchronizerStateIn(destinationBase), Logger: log.New(ioutil.Discard, "", 0)})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	s.retryPolicy.throttlingBaseDelay = 10 * time.Millisecond
+	// Like the sessions of the mounts, the calls are only retried by the synchronizer
+	svc := s3.New(sess.Copy(&aws.Config{MaxRetries: aws.Int(0)}))
+	for _, test := range tests {
+		item := &s3.Object{Key: aws.String(test.key), ETag: aws.String(test.eTag), Size: aws.Int64(test.size)}
+
+		// ---- Run code under test ----
+		partSize := s.firstPartSize(svc, testFakeBucketName, item, nil)
+
+		// ---- Assertions ----
+		if partSize != test.expectedPartSize {
+			t.Errorf("ASSERT_FAILURE: Expected: Part size %d of %s %s | Actual: %d", test.expectedPartSize, test.key, test.eTag, partSize)
+		}
+	}
+}
+
+// Test that downloads and uploads are throttled to the rate limits and that the limits can be changed at runtime
+func TestSynchronizerRateLimits(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerRateLimits"
+	testMount := putTestMountFiles(t, sess, testMountId, 0, 0)
+	putTestObject(t, sess, *testMount.Prefix+"/throttled.bin", strings.Repeat("0123456789", 3000))
+	testMount.DownloadRateLimit = Int64(10000)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:            sess,
+		Mounts:             []Mount{*testMount},
+		Destination:        destinationBase,
+		State:              NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:              true,
+		RecurringDownloads: true,
+		DownloadInterval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	start := time.Now()
+	s.Start()
+	waitForSyncCount(t, s, testMountId, 1)
+	elapsed := time.Since(start)
+
+	// ---- Assertions ----
+	// The first 10000 bytes are downloaded right away, the remaining 20000 bytes take 2 seconds
+	if elapsed < 1500*time.Millisecond {
+		t.Errorf("ASSERT_FAILURE: Expected: Download to take about 2 seconds | Actual: %v", elapsed)
+	}
+	assertMountStatus(t, s, testMountId, 1, 1)
+
+	// ---- Inputs ----
+	// Lift the mount's download limit without restarting the mount and limit the uploads globally instead
+	handle := s.findMount(testMountId)
+	testMount.DownloadRateLimit = Int64(0)
+	if err := s.SetMounts([]Mount{*testMount}); err != nil {
+		t.Fatalf("Error setting the mounts: %v", err)
+	}
+	s.SetRateLimits(0, 10000)
+	uploadDir := filepath.Join(destinationBase, "upload")
+	os.MkdirAll(uploadDir, os.ModePerm)
+	uploadFile := filepath.Join(uploadDir, "throttled.bin")
+	if err := ioutil.WriteFile(uploadFile, []byte(strings.Repeat("0123456789", 3000)), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+
+	// ---- Run code under test ----
+	start = time.Now()
+	err = s.uploadToS3(context.Background(), s.sess, uploadDir, uploadFile, testFakeBucketName, "uploads/", "", nil)
+	elapsed = time.Since(start)
+
+	// ---- Assertions ----
+	if err != nil {
+		t.Errorf("Error uploading the file: %v", err)
+	}
+	if elapsed < 1500*time.Millisecond {
+		t.Errorf("ASSERT_FAILURE: Expected: Upload to take about 2 seconds | Actual: %v", elapsed)
+	}
+	if s.findMount(testMountId) != handle {
+		t.Errorf("ASSERT_FAILURE: Expected: Mount not to be restarted when its rate limits change")
+	}
+	if limit := handle.config.downloadLimiter.limit; limit != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: Download rate limit of the mount to be lifted | Actual: %d", limit)
+	}
+	s.Stop()
+}
+
+// Test the token bucket of the rate limiter
+func TestRateLimiter(t *testing.T) {
+	// ---- Inputs ----
+	limiter := newRateLimiter(100000)
+
+	// ---- Run code under test ----
+	start := time.Now()
+	err1 := limiter.wait(context.Background(), 100000)
+	burst := time.Since(start)
+	err2 := limiter.wait(context.Background(), 50000)
+	throttled := time.Since(start) - burst
+	limiter.setLimit(0)
+	start = time.Now()
+	err3 := limiter.wait(context.Background(), 1000000)
+	unlimited := time.Since(start)
+	limiter.setLimit(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err4 := limiter.wait(ctx, 1000000)
+
+	// ---- Assertions ----
+	if err1 != nil || burst > 100*time.Millisecond {
+		t.Errorf("ASSERT_FAILURE: Expected: Burst of one second worth of bytes right away | Actual: %v (%v)", burst, err1)
+	}
+	if err2 != nil || throttled < 400*time.Millisecond {
+		t.Errorf("ASSERT_FAILURE: Expected: Wait of about 500ms | Actual: %v (%v)", throttled, err2)
+	}
+	if err3 != nil || unlimited > 100*time.Millisecond {
+		t.Errorf("ASSERT_FAILURE: Expected: No wait when unlimited | Actual: %v (%v)", unlimited, err3)
+	}
+	if err4 != context.Canceled {
+		t.Errorf("ASSERT_FAILURE: Expected: %v | Actual: %v", context.Canceled, err4)
+	}
+	var nilLimiter *rateLimiter
+	if err := nilLimiter.wait(context.Background(), 1000); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: nil limiter not to limit | Actual: %v", err)
+	}
+}
+
+// Test that failed S3 calls are retried as per their error class and that permanent errors fail the sync right away
+func TestSynchronizerRetries(t *testing.T) {
+	// ---- Data setup ----
+	// Throttle the first 2 listings of the mount and deny listing the "uploads/" prefix
+	var listings int32
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+				prefix := r.URL.Query().Get("prefix")
+				if strings.HasPrefix(prefix, "uploads/") {
+					writeTestErrorResponse(w, http.StatusForbidden, "AccessDenied")
+					return
+				}
+				if strings.HasSuffix(prefix, "/TestSynchronizerRetries") && atomic.AddInt32(&listings, 1) <= 2 {
+					writeTestErrorResponse(w, http.StatusServiceUnavailable, "SlowDown")
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	testMountId := "TestSynchronizerRetries"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	missingBucketMount := Mount{Id: String("missing-bucket"), Bucket: String("missing-bucket"), Prefix: String("studies/missing")}
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount, missingBucketMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+		MaxAttempts: 3,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	s.retryPolicy.baseDelay = 10 * time.Millisecond
+	s.retryPolicy.throttlingBaseDelay = 20 * time.Millisecond
+
+	// ---- Run code under test ----
+	start := time.Now()
+	s.Start()
+	s.Wait()
+	elapsed := time.Since(start)
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	assertMountStatus(t, s, testMountId, 1, noOfFilesInMount)
+	if actual := atomic.LoadInt32(&listings); actual != 3 {
+		t.Errorf("ASSERT_FAILURE: Expected: 3 listings of the mount | Actual: %d", actual)
+	}
+	status, _ := s.MountStatus("missing-bucket")
+	if !strings.Contains(status.LastSyncError, "NoSuchBucket") || status.SyncCount != 1 {
+		t.Errorf("ASSERT_FAILURE: Expected: Sync to fail with NoSuchBucket | Actual: %d syncs, error %q", status.SyncCount, status.LastSyncError)
+	}
+	if elapsed > 10*time.Second {
+		t.Errorf("ASSERT_FAILURE: Expected: Permanent errors not to be retried | Actual: Took %v", elapsed)
+	}
+
+	// ---- Data setup ----
+	uploadDir := filepath.Join(destinationBase, "upload")
+	os.MkdirAll(uploadDir, os.ModePerm)
+	uploadFile := filepath.Join(uploadDir, "uploaded.txt")
+	if err := ioutil.WriteFile(uploadFile, []byte("uploaded"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+
+	// ---- Run code under test ----
+	// The size of the object in S3 cannot be determined, the file is uploaded nonetheless
+	err = s.uploadToS3(context.Background(), s.sess, uploadDir, uploadFile, testFakeBucketName, "uploads/", "", nil)
+
+	// ---- Assertions ----
+	if err != nil {
+		t.Errorf("Error uploading the file: %v", err)
+	}
+	if _, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String("uploads/uploaded.txt")}); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: File to be uploaded | Actual: %v", err)
+	}
+	s.Stop()
+}
+
+// Test that a failed download is retried by the synchronizer only, i.e., the object is requested once per attempt of
+// the synchronizer rather than once per retry of the SDK within each attempt
+func TestSynchronizerRetriesWithoutSDKRetries(t *testing.T) {
+	// ---- Data setup ----
+	// Fail the downloads of the object with a server error and count them
+	var requests int32
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/failing.txt") {
+				atomic.AddInt32(&requests, 1)
+				writeTestErrorResponse(w, http.StatusInternalServerError, "InternalError")
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	testMountId := "TestSynchronizerRetriesWithoutSDKRetries"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	putTestObject(t, sess, *testMount.Prefix+"/failing.txt", "failing content")
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+		MaxAttempts: 3,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	s.retryPolicy.baseDelay = 10 * time.Millisecond
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	assertFileContent(t, filepath.Join(destinationBase, testMountId, "failing.txt"), "")
+	if actual := atomic.LoadInt32(&requests); actual != 3 {
+		t.Errorf("ASSERT_FAILURE: Expected: 3 requests for the failed download | Actual: %d", actual)
+	}
+	s.Stop()
+}
+
+// Test the classification of the errors of S3 calls and the backoff between the retries
+func TestRetryPolicy(t *testing.T) {
+	// ---- Inputs ----
+	tests := []struct {
+		err           error
+		expectedClass errorClass
+	}{
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, ""), errorClassThrottling},
+		{awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, ""), errorClassThrottling},
+		{awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), 429, ""), errorClassThrottling},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, ""), errorClassTransient},
+		{awserr.New(request.ErrCodeRequestError, "send request failed", fmt.Errorf("connection reset by peer")), errorClassTransient},
+		{fmt.Errorf("unexpected EOF"), errorClassTransient},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, ""), errorClassPermanent},
+		{awserr.NewRequestFailure(awserr.New("NoSuchBucket", "", nil), 404, ""), errorClassPermanent},
+		{awserr.NewRequestFailure(awserr.New("BadRequest", "", nil), 400, ""), errorClassPermanent},
+		{awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled), errorClassPermanent},
+		{context.Canceled, errorClassPermanent},
+	}
+
+	// ---- Run code under test ----
+	for _, test := range tests {
+		class := classifyError(test.err)
+
+		// ---- Assertions ----
+		if class != test.expectedClass {
+			t.Errorf("ASSERT_FAILURE: %v: Expected: %v | Actual: %v", test.err, test.expectedClass, class)
+		}
+	}
+
+	// ---- Inputs ----
+	policy := retryPolicy{maxAttempts: 10, baseDelay: time.Second, throttlingBaseDelay: 4 * time.Second, maxDelay: 30 * time.Second}
+	backoffTests := []struct {
+		class       errorClass
+		attempt     int
+		expectedMax time.Duration
+	}{
+		{errorClassTransient, 1, time.Second},
+		{errorClassTransient, 3, 4 * time.Second},
+		{errorClassThrottling, 1, 4 * time.Second},
+		{errorClassThrottling, 2, 8 * time.Second},
+		{errorClassTransient, 9, 30 * time.Second},
+	}
+
+	// ---- Run code under test ----
+	for _, test := range backoffTests {
+		delay := policy.backoff(test.class, test.attempt)
+
+		// ---- Assertions ----
+		if delay < test.expectedMax/2 || delay > test.expectedMax {
+			t.Errorf("ASSERT_FAILURE: %v error, attempt %d: Expected: Between %v and %v | Actual: %v", test.class, test.attempt, test.expectedMax/2, test.expectedMax, delay)
+		}
+	}
+}
+
+// Test the concurrent listing of the sub-prefixes of a mount
+// - Make sure all objects are downloaded and the sub-prefixes are listed concurrently
+// - Make sure the objects are downloaded while the sub-prefixes are still being listed
+// - Make sure a failed listing of a sub-prefix fails the sync without deleting local files
+func TestSynchronizerListingConcurrency(t *testing.T) {
+	// ---- Data setup ----
+	// Slow down the listings of the sub-prefixes so that they overlap with each other and with the downloads
+	var lock sync.Mutex
+	listingsInFlight := 0
+	maxListingsInFlight := 0
+	downloadsDuringListing := 0
+	var deniedPrefix atomic.Value
+	deniedPrefix.Store("")
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if r.URL.Query().Get("list-type") != "2" {
+				lock.Lock()
+				if listingsInFlight > 0 {
+					downloadsDuringListing++
+				}
+				lock.Unlock()
+				h.ServeHTTP(w, r)
+				return
+			}
+			prefix := r.URL.Query().Get("prefix")
+			if denied := deniedPrefix.Load().(string); denied != "" && prefix == denied {
+				writeTestErrorResponse(w, http.StatusForbidden, "AccessDenied")
+				return
+			}
+			if strings.HasSuffix(prefix, "/") {
+				lock.Lock()
+				listingsInFlight++
+				if listingsInFlight > maxListingsInFlight {
+					maxListingsInFlight = listingsInFlight
+				}
+				lock.Unlock()
+				time.Sleep(50 * time.Millisecond)
+				defer func() {
+					lock.Lock()
+					listingsInFlight--
+					lock.Unlock()
+				}()
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	testMountId := "TestSynchronizerListingConcurrency"
+	noOfFilesInMount := 3
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	var expectedFiles []string
+	for i := 0; i < 4; i++ {
+		for _, name := range []string{fmt.Sprintf("dir%d/test.txt", i), fmt.Sprintf("dir%d/sub/test.txt", i)} {
+			putTestObject(t, sess, *testMount.Prefix+"/"+name, name)
+			expectedFiles = append(expectedFiles, name)
+		}
+	}
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:            sess,
+		Mounts:             []Mount{*testMount},
+		Destination:        destinationBase,
+		State:              NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:              true,
+		ListingConcurrency: 4,
+		RecurringDownloads: true,
+		DownloadInterval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	defer s.Stop()
+	waitForSyncCount(t, s, testMountId, 1)
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	assertMountStatus(t, s, testMountId, 1, noOfFilesInMount+len(expectedFiles))
+	for _, name := range expectedFiles {
+		content, err := ioutil.ReadFile(filepath.Join(destinationBase, testMountId, filepath.FromSlash(name)))
+		if err != nil || string(content) != name {
+			t.Errorf("ASSERT_FAILURE: Expected: File %s to be downloaded | Actual: %q, %v", name, content, err)
+		}
+	}
+	lock.Lock()
+	if maxListingsInFlight < 2 {
+		t.Errorf("ASSERT_FAILURE: Expected: Concurrent listings of the sub-prefixes | Actual: %d listings at a time", maxListingsInFlight)
+	}
+	if downloadsDuringListing == 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: Objects to be downloaded while the sub-prefixes are listed | Actual: No downloads during the listing")
+	}
+	lock.Unlock()
+
+	// ---- Data setup ----
+	deniedPrefix.Store(*testMount.Prefix + "/dir2/sub/")
+	s3.New(sess).DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(*testMount.Prefix + "/dir0/test.txt")})
+
+	// ---- Run code under test ----
+	s.SyncNow(testMountId)
+	waitForSyncCount(t, s, testMountId, 2)
+
+	// ---- Assertions ----
+	status, _ := s.MountStatus(testMountId)
+	if !strings.Contains(status.LastSyncError, "AccessDenied") {
+		t.Errorf("ASSERT_FAILURE: Expected: Sync to fail with AccessDenied | Actual: %q", status.LastSyncError)
+	}
+	if _, err := os.Stat(filepath.Join(destinationBase, testMountId, "dir0", "test.txt")); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: Local files not to be deleted when the listing fails | Actual: %v", err)
+	}
+}
+
+// Test the quotas of the mounts and the low-disk watermark
+// - Make sure the objects beyond a mount's maxObjects or maxBytes are not downloaded and are reported
+// - Make sure the downloads pause while the disk is low on space and resume once space is freed up
+func TestSynchronizerDiskSpace(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	var freeBytes int64 = 1 << 40
+	defer func(f func(string) (int64, error)) { freeDiskSpace = f }(freeDiskSpace)
+	freeDiskSpace = func(string) (int64, error) { return atomic.LoadInt64(&freeBytes), nil }
+	defer func(interval time.Duration) { lowDiskSpaceCheckInterval = interval }(lowDiskSpaceCheckInterval)
+	lowDiskSpaceCheckInterval = 10 * time.Millisecond
+	noOfFilesInMount := 5
+	fileSize := int64(len(fmt.Sprintf(testFileContentTemplate, 0)))
+	maxObjectsMount := putTestMountFiles(t, sess, "TestSynchronizerDiskSpaceMaxObjects", 0, noOfFilesInMount)
+	maxObjectsMount.MaxObjects = Int64(3)
+	maxBytesMount := putTestMountFiles(t, sess, "TestSynchronizerDiskSpaceMaxBytes", 0, noOfFilesInMount)
+	maxBytesMount.MaxBytes = Int64(2*fileSize + 1)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*maxObjectsMount, *maxBytesMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, *maxObjectsMount.Id, 0, 3)
+	assertFilesDownloaded(t, destinationBase, *maxBytesMount.Id, 0, 2)
+	for _, test := range []struct {
+		mountId                  string
+		expectedDownloadedFiles  int
+		expectedObjectsOverQuota int
+	}{
+		{*maxObjectsMount.Id, 3, 2},
+		{*maxBytesMount.Id, 2, 3},
+	} {
+		assertMountStatus(t, s, test.mountId, 1, test.expectedDownloadedFiles)
+		status, _ := s.MountStatus(test.mountId)
+		if status.LastSyncObjectsOverQuota != test.expectedObjectsOverQuota {
+			t.Errorf("ASSERT_FAILURE: %s: Expected: %d objects over quota | Actual: %d", test.mountId, test.expectedObjectsOverQuota, status.LastSyncObjectsOverQuota)
+		}
+		if status.LastSyncBytesNeeded != int64(test.expectedDownloadedFiles)*fileSize {
+			t.Errorf("ASSERT_FAILURE: %s: Expected: %d bytes needed | Actual: %d", test.mountId, int64(test.expectedDownloadedFiles)*fileSize, status.LastSyncBytesNeeded)
+		}
+	}
+
+	// ---- Data setup ----
+	// Leave room for less than one object above the watermark
+	minFreeDiskSpace := int64(1000)
+	atomic.StoreInt64(&freeBytes, minFreeDiskSpace+fileSize-1)
+	testMountId := "TestSynchronizerDiskSpaceLow"
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+
+	// ---- Inputs ----
+	s, err = New(Options{
+		Session:            sess,
+		Mounts:             []Mount{*testMount},
+		Destination:        destinationBase,
+		State:              NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:              true,
+		MinFreeDiskSpace:   minFreeDiskSpace,
+		RecurringDownloads: true,
+		DownloadInterval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	defer s.Stop()
+	deadline := time.Now().Add(10 * time.Second)
+	for status, _ := s.MountStatus(testMountId); !status.LowDiskSpace && time.Now().Before(deadline); status, _ = s.MountStatus(testMountId) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// ---- Assertions ----
+	status, _ := s.MountStatus(testMountId)
+	if !status.LowDiskSpace || status.SyncCount != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: Downloads to be paused for disk space | Actual: Low disk space %v, %d syncs", status.LowDiskSpace, status.SyncCount)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(destinationBase, testMountId))
+	if len(files) != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: No files downloaded while the disk is low on space | Actual: %d files", len(files))
+	}
+
+	// ---- Run code under test ----
+	atomic.StoreInt64(&freeBytes, 1<<40)
+	waitForSyncCount(t, s, testMountId, 1)
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	assertMountStatus(t, s, testMountId, 1, noOfFilesInMount)
+	if status, _ := s.MountStatus(testMountId); status.LowDiskSpace {
+		t.Errorf("ASSERT_FAILURE: Expected: Downloads to be resumed | Actual: Low disk space reported")
+	}
+}
+
+// Test the downloads that cannot fit on the disk
+// - Make sure the objects beyond the capacity of the disk minus the watermark are not downloaded and are reported,
+// including an object larger than the disk on its own
+// - Make sure the downloads paused for disk space give up after the longest pause and are reported
+func TestSynchronizerDiskSpaceCapacity(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	fileSize := int64(len(fmt.Sprintf(testFileContentTemplate, 0)))
+	minFreeDiskSpace := int64(1000)
+	var freeBytes int64 = 1 << 40
+	defer func(f func(string) (int64, error)) { freeDiskSpace = f }(freeDiskSpace)
+	freeDiskSpace = func(string) (int64, error) { return atomic.LoadInt64(&freeBytes), nil }
+	var capacityBytes int64 = minFreeDiskSpace + 3*fileSize
+	defer func(f func(string) (int64, error)) { diskCapacity = f }(diskCapacity)
+	diskCapacity = func(string) (int64, error) { return atomic.LoadInt64(&capacityBytes), nil }
+	defer func(interval time.Duration) { lowDiskSpaceCheckInterval = interval }(lowDiskSpaceCheckInterval)
+	lowDiskSpaceCheckInterval = 10 * time.Millisecond
+	defer func(pause time.Duration) { lowDiskSpaceMaxPause = pause }(lowDiskSpaceMaxPause)
+	lowDiskSpaceMaxPause = 200 * time.Millisecond
+	noOfFilesInMount := 5
+	testMountId := "TestSynchronizerDiskSpaceCapacity"
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	// Listed before the other files
+	largeKey := *testMount.Prefix + "/large.bin"
+	putTestObject(t, sess, largeKey, strings.Repeat("0", int(4*fileSize)))
+
+	// ---- Inputs ----
+	newSynchronizer := func() *Synchronizer {
+		s, err := New(Options{
+			Session:          sess,
+			Mounts:           []Mount{*testMount},
+			Destination:      destinationBase,
+			State:            NewPersistentSynchronizerStateIn(destinationBase),
+			Debug:            true,
+			MinFreeDiskSpace: minFreeDiskSpace,
+		})
+		if err != nil {
+			t.Fatalf("Error creating the synchronizer: %v", err)
+		}
+		return s
+	}
+
+	// ---- Run code under test ----
+	s := newSynchronizer()
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, 3)
+	assertMountStatus(t, s, testMountId, 1, 3)
+	assertFileContent(t, filepath.Join(destinationBase, testMountId, "large.bin"), "")
+	status, _ := s.MountStatus(testMountId)
+	expectedKeys := []string{largeKey, *testMount.Prefix + "/test3.txt", *testMount.Prefix + "/test4.txt"}
+	if !reflect.DeepEqual(status.LastSyncObjectsOverDiskSpace, expectedKeys) {
+		t.Errorf("ASSERT_FAILURE: Expected: Objects over disk space %v | Actual: %v", expectedKeys, status.LastSyncObjectsOverDiskSpace)
+	}
+
+	// ---- Data setup ----
+	// Leave room for less than one object above the watermark on a disk large enough for the mount
+	atomic.StoreInt64(&capacityBytes, 1<<40)
+	atomic.StoreInt64(&freeBytes, minFreeDiskSpace+fileSize-1)
+	if _, err := s3.New(sess).DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(largeKey)}); err != nil {
+		t.Fatalf("Could not delete test object: %v", err)
+	}
+	os.RemoveAll(filepath.Join(destinationBase, testMountId))
+
+	// ---- Run code under test ----
+	s = newSynchronizer()
+	start := time.Now()
+	s.Start()
+	s.Wait()
+	elapsed := time.Since(start)
+
+	// ---- Assertions ----
+	assertMountStatus(t, s, testMountId, 1, 0)
+	for i := 0; i < noOfFilesInMount; i++ {
+		assertFileContent(t, filepath.Join(destinationBase, testMountId, fmt.Sprintf("test%d.txt", i)), "")
+	}
+	status, _ = s.MountStatus(testMountId)
+	sort.Strings(status.LastSyncObjectsOverDiskSpace)
+	expectedKeys = nil
+	for i := 0; i < noOfFilesInMount; i++ {
+		expectedKeys = append(expectedKeys, fmt.Sprintf("%s/test%d.txt", *testMount.Prefix, i))
+	}
+	if !reflect.DeepEqual(status.LastSyncObjectsOverDiskSpace, expectedKeys) {
+		t.Errorf("ASSERT_FAILURE: Expected: Objects over disk space %v | Actual: %v", expectedKeys, status.LastSyncObjectsOverDiskSpace)
+	}
+	if status.LowDiskSpace {
+		t.Errorf("ASSERT_FAILURE: Expected: Downloads not to be paused after the sync | Actual: Low disk space reported")
+	}
+	if elapsed > 10*time.Second {
+		t.Errorf("ASSERT_FAILURE: Expected: The downloads to stay paused for %v at most | Actual: Took %v", lowDiskSpaceMaxPause, elapsed)
+	}
+}
+
+// Test a mount in cache mode
+// - Make sure the objects that do not fit in the cache are left as empty placeholders
+// - Make sure a marked placeholder is hydrated and the least recently used file is evicted to make room for it
+// - Make sure the placeholders of objects deleted from S3 are deleted
+func TestSynchronizerCache(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerCache"
+	noOfFilesInMount := 5
+	fileSize := int64(len(fmt.Sprintf(testFileContentTemplate, 0)))
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	testMount.CacheBytes = Int64(2*fileSize + 1)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	var resident, placeholders []int
+	for i := 0; i < noOfFilesInMount; i++ {
+		info, err := os.Stat(filepath.Join(destinationBase, testMountId, fmt.Sprintf("test%d.txt", i)))
+		if err != nil {
+			t.Fatalf("ASSERT_FAILURE: Expected: File %d to exist | Actual: %v", i, err)
+		}
+		key := fmt.Sprintf("%s/test%d.txt", *testMount.Prefix, i)
+		if info.Size() == 0 {
+			placeholders = append(placeholders, i)
+			if !s.state.IsFileEvicted(key) {
+				t.Errorf("ASSERT_FAILURE: Expected: %s to be recorded as evicted | Actual: Not evicted", key)
+			}
+		} else {
+			resident = append(resident, i)
+		}
+	}
+	if len(resident) != 2 || len(placeholders) != 3 {
+		t.Fatalf("ASSERT_FAILURE: Expected: 2 resident files and 3 placeholders | Actual: %v resident, %v placeholders", resident, placeholders)
+	}
+	if status, _ := s.MountStatus(testMountId); status.CachedBytes != 2*fileSize {
+		t.Errorf("ASSERT_FAILURE: Expected: %d cached bytes | Actual: %d", 2*fileSize, status.CachedBytes)
+	}
+
+	// ---- Data setup ----
+	// Make the first resident file the least recently used one
+	now := time.Now()
+	for i, fileIdx := range resident {
+		path := filepath.Join(destinationBase, testMountId, fmt.Sprintf("test%d.txt", fileIdx))
+		accessed := now.Add(time.Duration(i-len(resident)) * time.Hour)
+		if err := os.Chtimes(path, accessed, accessed); err != nil {
+			t.Fatalf("Error setting the access time of %s: %v", path, err)
+		}
+	}
+	hydrated := placeholders[0]
+	marker := filepath.Join(destinationBase, testMountId, fmt.Sprintf("test%d.txt", hydrated)) + HydrationMarkerSuffix
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatalf("Error creating the hydration marker: %v", err)
+	}
+
+	// ---- Run code under test ----
+	if err := s.SyncNow(testMountId); err != nil {
+		t.Fatalf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, hydrated, 1)
+	assertFilesDownloaded(t, destinationBase, testMountId, resident[1], 1)
+	evicted := filepath.Join(destinationBase, testMountId, fmt.Sprintf("test%d.txt", resident[0]))
+	if info, err := os.Stat(evicted); err != nil || info.Size() != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: %s to be evicted to a placeholder | Actual: %v, %v", evicted, info, err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: The hydration marker to be deleted | Actual: %v", err)
+	}
+	status, _ := s.MountStatus(testMountId)
+	if status.LastSyncHydratedFiles != 1 || status.LastSyncEvictedFiles != 1 || status.CachedBytes != 2*fileSize {
+		t.Errorf("ASSERT_FAILURE: Expected: 1 hydrated file, 1 evicted file and %d cached bytes | Actual: %d, %d, %d", 2*fileSize, status.LastSyncHydratedFiles, status.LastSyncEvictedFiles, status.CachedBytes)
+	}
+
+	// ---- Data setup ----
+	deleted := placeholders[1]
+	_, err = s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(testFakeBucketName),
+		Key:    aws.String(fmt.Sprintf("%s/test%d.txt", *testMount.Prefix, deleted)),
+	})
+	if err != nil {
+		t.Fatalf("Error deleting the test object: %v", err)
+	}
+
+	// ---- Run code under test ----
+	if err := s.SyncNow(testMountId); err != nil {
+		t.Fatalf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	deletedPath := filepath.Join(destinationBase, testMountId, fmt.Sprintf("test%d.txt", deleted))
+	if _, err := os.Stat(deletedPath); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: The placeholder %s to be deleted | Actual: %v", deletedPath, err)
+	}
+	if status, _ := s.MountStatus(testMountId); status.LastSyncDownloadedFiles != 0 || len(status.LastSyncErrors) != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: No placeholders downloaded again | Actual: %d downloaded files, errors %v", status.LastSyncDownloadedFiles, status.LastSyncErrors)
+	}
+}
+
+// Test the objects in the GLACIER storage class
+// - Make sure archived objects are skipped and reported by default
+// - Make sure a restore is started for archived objects of mounts with restoreArchived, once only, and the object is
+// downloaded once the restore completes
+func TestSynchronizerArchivedObjects(t *testing.T) {
+	// ---- Data setup ----
+	const (
+		notRestored int32 = iota
+		restoring
+		restored
+	)
+	restoreState := notRestored
+	var restoreRequests int32
+	var restoreTier string
+	var lock sync.Mutex
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			isArchivedObject := strings.HasSuffix(r.URL.Path, "/archived.txt")
+			switch {
+			case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+				// Report the objects named "archived.txt" in the GLACIER storage class
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, r)
+				body := testContentsRegex.ReplaceAllStringFunc(recorder.Body.String(), func(contents string) string {
+					if !strings.Contains(contents, "/archived.txt<") {
+						return contents
+					}
+					return strings.Replace(contents, "</Contents>", "<StorageClass>GLACIER</StorageClass></Contents>", 1)
+				})
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(recorder.Code)
+				fmt.Fprint(w, body)
+			case isArchivedObject && r.Method == http.MethodPost && r.URL.Query()["restore"] != nil:
+				requestBody, _ := ioutil.ReadAll(r.Body)
+				lock.Lock()
+				restoreTier = string(requestBody)
+				lock.Unlock()
+				atomic.AddInt32(&restoreRequests, 1)
+				atomic.CompareAndSwapInt32(&restoreState, notRestored, restoring)
+				w.WriteHeader(http.StatusAccepted)
+			case isArchivedObject && r.Method == http.MethodHead:
+				switch atomic.LoadInt32(&restoreState) {
+				case restoring:
+					w.Header().Set("x-amz-restore", `ongoing-request="true"`)
+				case restored:
+					w.Header().Set("x-amz-restore", `ongoing-request="false", expiry-date="Fri, 23 Dec 2050 00:00:00 GMT"`)
+				}
+				h.ServeHTTP(w, r)
+			case isArchivedObject && r.Method == http.MethodGet && atomic.LoadInt32(&restoreState) != restored:
+				writeTestErrorResponse(w, http.StatusForbidden, "InvalidObjectState")
+			default:
+				h.ServeHTTP(w, r)
+			}
+		})
+	})
+	defer cleanup()
+	noOfFilesInMount := 2
+	skippingMount := putTestMountFiles(t, sess, "TestSynchronizerArchivedObjectsSkipped", 0, noOfFilesInMount)
+	putTestObject(t, sess, *skippingMount.Prefix+"/archived.txt", "archived content")
+	restoringMount := putTestMountFiles(t, sess, "TestSynchronizerArchivedObjectsRestored", 0, noOfFilesInMount)
+	restoringMount.RestoreArchived = Bool(true)
+	restoringMount.RestoreTier = String("Bulk")
+	putTestObject(t, sess, *restoringMount.Prefix+"/archived.txt", "archived content")
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*skippingMount, *restoringMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	for _, mount := range []*Mount{skippingMount, restoringMount} {
+		assertFilesDownloaded(t, destinationBase, *mount.Id, 0, noOfFilesInMount)
+		assertMountStatus(t, s, *mount.Id, 1, noOfFilesInMount)
+		assertArchivedObjects(t, s, *mount.Id, []string{*mount.Prefix + "/archived.txt"})
+		if _, err := os.Stat(filepath.Join(destinationBase, *mount.Id, "archived.txt")); !os.IsNotExist(err) {
+			t.Errorf("ASSERT_FAILURE: Expected: The archived object of %s not to be downloaded | Actual: %v", *mount.Id, err)
+		}
+	}
+	if status, _ := s.MountStatus(*restoringMount.Id); status.LastSyncRestoresStarted != 1 {
+		t.Errorf("ASSERT_FAILURE: Expected: 1 restore started | Actual: %d", status.LastSyncRestoresStarted)
+	}
+	lock.Lock()
+	if !strings.Contains(restoreTier, "<Tier>Bulk</Tier>") {
+		t.Errorf("ASSERT_FAILURE: Expected: A restore using the Bulk tier | Actual: %s", restoreTier)
+	}
+	lock.Unlock()
+
+	// ---- Run code under test ----
+	// The restore is in progress, no restore is started again
+	if err := s.SyncNow(*restoringMount.Id); err != nil {
+		t.Fatalf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertArchivedObjects(t, s, *restoringMount.Id, []string{*restoringMount.Prefix + "/archived.txt"})
+	if restoreRequests := atomic.LoadInt32(&restoreRequests); restoreRequests != 1 {
+		t.Errorf("ASSERT_FAILURE: Expected: 1 restore request | Actual: %d", restoreRequests)
+	}
+
+	// ---- Run code under test ----
+	atomic.StoreInt32(&restoreState, restored)
+	if err := s.SyncNow(*restoringMount.Id); err != nil {
+		t.Fatalf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertArchivedObjects(t, s, *restoringMount.Id, nil)
+	content, err := ioutil.ReadFile(filepath.Join(destinationBase, *restoringMount.Id, "archived.txt"))
+	if err != nil || string(content) != "archived content" {
+		t.Errorf("ASSERT_FAILURE: Expected: The restored object to be downloaded | Actual: %q, %v", string(content), err)
+	}
+}
+
+// Test mounts pinned to a snapshot of a versioned bucket
+// - Make sure a mount pinned to a point in time materializes the versions current at that time
+// - Make sure the lockfile written for the mount pins another mount to the same versions
+func TestSynchronizerPinnedMounts(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	_, err := s3.New(sess).PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket:                  aws.String(testFakeBucketName),
+		VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+	})
+	if err != nil {
+		t.Fatalf("Could not enable versioning of the fake S3 bucket: %v", err)
+	}
+	noOfFilesInMount := 3
+	prefix := *putTestMountFiles(t, sess, "TestSynchronizerPinnedMounts", 0, noOfFilesInMount).Prefix
+	// The versions after the snapshot are at least a second later as asOf has a precision of seconds
+	time.Sleep(1100 * time.Millisecond)
+	asOf := time.Now().UTC().Format(time.RFC3339)
+	time.Sleep(1100 * time.Millisecond)
+	putTestObject(t, sess, prefix+"/test0.txt", "updated after the snapshot")
+	putTestObject(t, sess, prefix+"/test3.txt", "created after the snapshot")
+	_, err = s3.New(sess).DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(prefix + "/test1.txt")})
+	if err != nil {
+		t.Fatalf("Error deleting the test object: %v", err)
+	}
+	asOfMount := &Mount{Id: String("TestSynchronizerPinnedMountsAsOf"), Bucket: String(testFakeBucketName), Prefix: String(prefix), AsOf: String(asOf)}
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*asOfMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, *asOfMount.Id, 0, noOfFilesInMount)
+	assertMountStatus(t, s, *asOfMount.Id, 1, noOfFilesInMount)
+	assertFileContent(t, filepath.Join(destinationBase, *asOfMount.Id, "test3.txt"), "")
+
+	// ---- Run code under test ----
+	lockfile := filepath.Join(destinationBase, "TestSynchronizerPinnedMounts.lock.json")
+	if err := s.WriteLockfile(*asOfMount.Id, lockfile); err != nil {
+		t.Fatalf("Error writing the lockfile: %v", err)
+	}
+	lockedMount := &Mount{Id: String("TestSynchronizerPinnedMountsLocked"), Bucket: String(testFakeBucketName), Prefix: String(prefix), Lockfile: String(lockfile)}
+	s, err = New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*lockedMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	versions, err := readLockfile(lockfile)
+	if err != nil || len(versions) != noOfFilesInMount {
+		t.Errorf("ASSERT_FAILURE: Expected: The versions of %d objects in the lockfile | Actual: %v, %v", noOfFilesInMount, versions, err)
+	}
+	assertFilesDownloaded(t, destinationBase, *lockedMount.Id, 0, noOfFilesInMount)
+	assertMountStatus(t, s, *lockedMount.Id, 1, noOfFilesInMount)
+	assertFileContent(t, filepath.Join(destinationBase, *lockedMount.Id, "test3.txt"), "")
+}
+
+// Test that the requester-pays and expected-bucket-owner settings of a mount are sent with every S3 call made for the
+// mount, including the uploads, and only for that mount
+func TestSynchronizerRequesterPaysAndBucketOwner(t *testing.T) {
+	// ---- Data setup ----
+	const accountId = "111122223333"
+	const settingsMountId = "TestSynchronizerBucketAccessSettings"
+	const defaultMountId = "TestSynchronizerBucketAccessDefault"
+	var lock sync.Mutex
+	var requestsWithout, requestsWith []string
+	// Only the requests of the synchronizer are checked, not the ones putting the test files
+	var recording int32
+	sess, destinationBase, cleanup := setupTestWithHandler(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request := r.Method + " " + r.URL.String()
+			hasSettings := r.Header.Get("x-amz-request-payer") == "requester" && r.Header.Get("x-amz-expected-bucket-owner") == accountId
+			hasAnySetting := r.Header.Get("x-amz-request-payer") != "" || r.Header.Get("x-amz-expected-bucket-owner") != ""
+			lock.Lock()
+			switch {
+			case atomic.LoadInt32(&recording) == 0:
+			case strings.Contains(request, settingsMountId) && !hasSettings:
+				requestsWithout = append(requestsWithout, request)
+			case strings.Contains(request, defaultMountId) && hasAnySetting:
+				requestsWith = append(requestsWith, request)
+			}
+			lock.Unlock()
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	noOfFilesInMount := 3
+	settingsMount := putTestMountFiles(t, sess, settingsMountId, 0, noOfFilesInMount)
+	settingsMount.RequesterPays = Bool(true)
+	settingsMount.ExpectedBucketOwner = String(accountId)
+	defaultMount := putTestMountFiles(t, sess, defaultMountId, 0, noOfFilesInMount)
+	atomic.StoreInt32(&recording, 1)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*settingsMount, *defaultMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	uploadDir := filepath.Join(destinationBase, settingsMountId)
+	uploadFile := filepath.Join(uploadDir, "uploaded.txt")
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+	if err := ioutil.WriteFile(uploadFile, []byte("uploaded content"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	config := s.findMountConfig(settingsMountId)
+	err = s.uploadToS3(context.Background(), config.sess, uploadDir, uploadFile, testFakeBucketName, *settingsMount.Prefix+"/", "", nil)
+
+	// ---- Assertions ----
+	if err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: No upload error | Actual: %v", err)
+	}
+	for _, mount := range []*Mount{settingsMount, defaultMount} {
+		assertFilesDownloaded(t, destinationBase, *mount.Id, 0, noOfFilesInMount)
+		assertMountStatus(t, s, *mount.Id, 1, noOfFilesInMount)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(requestsWithout) > 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: All requests of %s to carry its settings | Actual: %v", settingsMountId, requestsWithout)
+	}
+	if len(requestsWith) > 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: No requests of %s to carry any settings | Actual: %v", defaultMountId, requestsWith)
+	}
+}
+
+// Test that the directory markers in S3 are created as local directories and that the directories that no longer exist
+// in S3 are pruned
+func TestSynchronizerDirectoryMarkers(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTestWithHandler(t, withTestDirectoryMarkers)
+	defer cleanup()
+	testMountId := "TestSynchronizerDirectoryMarkers"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	putTestObject(t, sess, *testMount.Prefix+"/", "")
+	putTestObject(t, sess, *testMount.Prefix+"/empty/", "")
+	putTestObject(t, sess, *testMount.Prefix+"/nested/deep/", "")
+	putTestObject(t, sess, *testMount.Prefix+"/gone/file.txt", "gone content")
+	mountDir := filepath.Join(destinationBase, testMountId)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	assertMountStatus(t, s, testMountId, 1, noOfFilesInMount+1)
+	assertFileContent(t, filepath.Join(mountDir, "gone", "file.txt"), "gone content")
+	for _, dir := range []string{"empty", filepath.Join("nested", "deep")} {
+		if info, err := os.Stat(filepath.Join(mountDir, dir)); err != nil || !info.IsDir() {
+			t.Errorf("ASSERT_FAILURE: Expected: Directory %s to be created | Actual: %v", dir, err)
+		}
+	}
+
+	// ---- Data setup ----
+	// Delete the marker of "empty" and the only file of "gone" from S3
+	for _, key := range []string{*testMount.Prefix + "/empty/", *testMount.Prefix + "/gone/file.txt"} {
+		if _, err := s3.New(sess).DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(key)}); err != nil {
+			t.Fatalf("Could not delete test object from fake S3 server: %v", err)
+		}
+	}
+	// Empty directories created locally are not kept in read-only mounts
+	if err := os.Mkdir(filepath.Join(mountDir, "local-only"), 0777); err != nil {
+		t.Fatalf("Could not create directory for testing: %v", err)
+	}
+
+	// ---- Run code under test ----
+	if err := s.SyncNow(testMountId); err != nil {
+		t.Errorf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	for _, dir := range []string{"empty", "gone", "local-only"} {
+		if _, err := os.Stat(filepath.Join(mountDir, dir)); !os.IsNotExist(err) {
+			t.Errorf("ASSERT_FAILURE: Expected: Directory %s to be pruned | Actual: %v", dir, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(mountDir, "nested", "deep")); err != nil || !info.IsDir() {
+		t.Errorf("ASSERT_FAILURE: Expected: Directory nested/deep to be kept | Actual: %v", err)
+	}
+}
+
+// Test that the empty directories of writeable mounts are uploaded as directory markers and only pruned if they came
+// from S3
+func TestSynchronizerUploadsDirectoryMarkers(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTestWithHandler(t, withTestDirectoryMarkers)
+	defer cleanup()
+	uploadDir := filepath.Join(destinationBase, "TestSynchronizerUploadsDirectoryMarkers")
+	for _, dir := range []string{"new-dir", "existing", "local-only", "pruned"} {
+		if err := os.MkdirAll(filepath.Join(uploadDir, dir), 0777); err != nil {
+			t.Fatalf("Could not create directory for testing: %v", err)
+		}
+	}
+	putTestObject(t, sess, "uploads/existing/file.txt", "existing content")
+	state := NewPersistentSynchronizerStateIn(destinationBase)
+	state.RecordFileDownloadToLocal(&s3.Object{Key: aws.String("uploads/pruned/"), ETag: aws.String("marker-etag")})
+
+	// ---- Inputs ----
+	s, err := New(Options{Session: sess, State: state})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	config := newMountConfiguration("TestSynchronizerUploadsDirectoryMarkers", testFakeBucketName, "uploads", uploadDir, true, "")
+	pathsInS3 := newPathSpill()
+	defer pathsInS3.close()
+	for _, path := range []string{"new-dir/", "existing/file.txt"} {
+		if err := pathsInS3.add(path); err != nil {
+			t.Fatalf("Could not add the path for testing: %v", err)
+		}
+	}
+
+	// ---- Run code under test ----
+	errNewDir := s.uploadDirMarkerToS3(context.Background(), s.sess, uploadDir, filepath.Join(uploadDir, "new-dir"), testFakeBucketName, "uploads/", "")
+	errExisting := s.uploadDirMarkerToS3(context.Background(), s.sess, uploadDir, filepath.Join(uploadDir, "existing"), testFakeBucketName, "uploads/", "")
+	_, errPrune := s.deleteLocalFilesNotInS3(pathsInS3, config)
+
+	// ---- Assertions ----
+	if errNewDir != nil || errExisting != nil || errPrune != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: No errors | Actual: %v, %v, %v", errNewDir, errExisting, errPrune)
+	}
+	if _, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String("uploads/new-dir/")}); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: Directory marker of new-dir to be uploaded | Actual: %v", err)
+	}
+	if _, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String("uploads/existing/")}); err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: No directory marker for existing | Actual: Directory marker uploaded")
+	}
+	for dir, expectedToExist := range map[string]bool{"new-dir": true, "existing": true, "local-only": true, "pruned": false} {
+		if _, err := os.Stat(filepath.Join(uploadDir, dir)); expectedToExist != (err == nil) {
+			t.Errorf("ASSERT_FAILURE: Expected: Directory %s to exist: %v | Actual: %v", dir, expectedToExist, err)
+		}
+	}
+}
+
+// Test that the keys that cannot be mapped to a file inside the mount's directory are rejected
+func TestRelativePathForKey(t *testing.T) {
+	// ---- Inputs ----
+	prefix := "studies/Organization/TestRelativePathForKey"
+	acceptedKeys := map[string]string{
+		prefix + "/file.txt":           "file.txt",
+		prefix + "/dir/file.txt":       "dir/file.txt",
+		prefix + "/..file":             "..file",
+		prefix + "/dir/.../file":       "dir/.../file",
+		prefix + "/dir.hydrate/x":      "dir.hydrate/x",
+		prefix + "/with space.txt":     "with space.txt",
+		prefix + "/unicode-\u00e9.txt": "unicode-\u00e9.txt",
+	}
+	rejectedKeys := []string{
+		prefix,
+		prefix + "/../escaped.txt",
+		prefix + "/dir/../../escaped.txt",
+		prefix + "/dir/..",
+		prefix + "/./file.txt",
+		prefix + `/dir\..\..\escaped.txt`,
+		prefix + "//etc/passwd",
+		prefix + `/\\server\share`,
+		prefix + "/C:/Windows/file.txt",
+		prefix + "/dir//file.txt",
+		prefix + "/nul\x00.txt",
+		prefix + "/file.txt" + HydrationMarkerSuffix,
+		prefix + "/dir/" + tempFilePrefix + "123" + tempFileSuffix,
+	}
+
+	// ---- Run code under test & Assertions ----
+	for key, expectedRelPath := range acceptedKeys {
+		relPath, err := relativePathForKey(key, prefix, "")
+		if err != nil || relPath != expectedRelPath {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to map to %q | Actual: %q, %v", key, expectedRelPath, relPath, err)
+		}
+	}
+	for _, key := range rejectedKeys {
+		if relPath, err := relativePathForKey(key, prefix, ""); err == nil {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to be rejected | Actual: %q", key, relPath)
+		}
+	}
+	if relDir, err := relativeDirForMarker(prefix+"/", prefix, ""); err != nil || relDir != "" {
+		t.Errorf("ASSERT_FAILURE: Expected: The marker of the prefix to map to the mount's directory | Actual: %q, %v", relDir, err)
+	}
+	if relDir, err := relativeDirForMarker(prefix+"/../", prefix, ""); err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: The marker of the parent of the prefix to be rejected | Actual: %q", relDir)
+	}
+}
+
+// Test that the objects whose keys would escape the mount's directory are not downloaded and are reported
+func TestSynchronizerRejectsUnsafeKeys(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerRejectsUnsafeKeys"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	// Keep the "../" segments of the keys, the SDK removes them from the request paths by default
+	uncleanedSess := sess.Copy(&aws.Config{DisableRestProtocolURICleaning: aws.Bool(true)})
+	unsafeKeys := []string{
+		*testMount.Prefix + "/../escaped.txt",
+		*testMount.Prefix + "/dir/../../../escaped.txt",
+		*testMount.Prefix + "/file.txt" + HydrationMarkerSuffix,
+	}
+	for _, key := range unsafeKeys {
+		putTestObject(t, uncleanedSess, key, "escaped content")
+	}
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	assertMountStatus(t, s, testMountId, 1, noOfFilesInMount)
+	assertFileContent(t, filepath.Join(destinationBase, "escaped.txt"), "")
+	assertFileContent(t, filepath.Join(filepath.Dir(destinationBase), "escaped.txt"), "")
+	assertFileContent(t, filepath.Join(destinationBase, testMountId, "file.txt"+HydrationMarkerSuffix), "")
+	status, _ := s.MountStatus(testMountId)
+	sort.Strings(unsafeKeys)
+	sort.Strings(status.LastSyncRejectedKeys)
+	if !reflect.DeepEqual(status.LastSyncRejectedKeys, unsafeKeys) {
+		t.Errorf("ASSERT_FAILURE: Expected: Rejected keys %v | Actual: %v", unsafeKeys, status.LastSyncRejectedKeys)
+	}
+}
+
+// Test that the keys are encoded into valid local filenames on each platform and decoded back into the same keys
+func TestKeyEncoding(t *testing.T) {
+	defer func(windows bool) { encodeForWindows = windows }(encodeForWindows)
+
+	// ---- Inputs ----
+	longName := strings.Repeat("a", 600) + ".txt"
+	longMultiByteName := strings.Repeat("\u00e9", 200) + ":.txt"
+	testCases := []struct {
+		windows      bool
+		relPath      string
+		expectedPath string
+	}{
+		{false, "dir/file.txt", "dir/file.txt"},
+		{true, "dir/file.txt", "dir/file.txt"},
+		{false, "2020-10-01T00:00:00.csv", "2020-10-01T00:00:00.csv"},
+		{true, "2020-10-01T00:00:00.csv", "2020-10-01T00\u201b\uff1a00\u201b\uff1a00.csv"},
+		{true, `what?/a*b|c"d<e>f\g`, "what\u201b\uff1f/a\u201b\uff0ab\u201b\uff5cc\u201b\uff02d\u201b\uff1ce\u201b\uff1ef\u201b\uff3cg"},
+		{false, `a\b`, `a\b`},
+		{true, "tab\tchar", "tab\u201b\u2409char"},
+		{true, "trailing./dots.../space ", "trailing\u201b\uff0e/dots..\u201b\uff0e/space\u201b\u2420"},
+		{true, "CON/con.txt/LPT1.log/CONSOLE", "\u201bCON/\u201bcon.txt/\u201bLPT1.log/CONSOLE"},
+		{false, "CON", "CON"},
+		{true, "full\uff1awidth.", "full\uff1awidth\u201b\uff0e"},
+		{false, "full\uff1awidth", "full\uff1awidth"},
+		{false, "quote\u201bchar", "quote\u201bchar"},
+		{true, "quote\u201bchar", "quote\u201bchar"},
+		{false, "quote\u201b", "quote\u201b\u201b"},
+		{true, "quote\u201b\uff1a/\u201b:", "quote\u201b\u201b\uff1a/\u201b\u201b\u201b\uff1a"},
+		{true, "\u201bCON/\u201b\u201bNUL", "\u201b\u201bCON/\u201b\u201b\u201b\u201bNUL"},
+		{false, "quote\u201b~2", "quote\u201b~2"},
+		{false, "dir/" + longName, ""},
+		{true, "dir/" + longName, ""},
+		{true, longMultiByteName, ""},
+		{true, strings.Repeat("\u201b", 300) + ":", ""},
+	}
+
+	for _, testCase := range testCases {
+		encodeForWindows = testCase.windows
+
+		// ---- Run code under test ----
+		localPath := encodeRelativePath(testCase.relPath)
+		decodedPath := decodeRelativePath(localPath)
+
+		// ---- Assertions ----
+		if testCase.expectedPath != "" && localPath != testCase.expectedPath {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to be encoded as %q (windows: %v) | Actual: %q", testCase.relPath, testCase.expectedPath, testCase.windows, localPath)
+		}
+		if decodedPath != testCase.relPath {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to be decoded as %q (windows: %v) | Actual: %q", localPath, testCase.relPath, testCase.windows, decodedPath)
+		}
+		for _, name := range strings.Split(localPath, "/") {
+			if len(name) > maxNameBytes {
+				t.Errorf("ASSERT_FAILURE: Expected: Names of at most %d bytes | Actual: %d bytes in %q", maxNameBytes, len(name), localPath)
+			}
+			if testCase.windows && (strings.ContainsAny(name, `<>:"|?*\`) || strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") || isWindowsReservedName(name)) {
+				t.Errorf("ASSERT_FAILURE: Expected: Valid Windows names | Actual: %q in %q", name, localPath)
+			}
+		}
+	}
+	// The long names are split into chains of directories
+	encodeForWindows = false
+	if names := strings.Split(encodeRelativePath(longName), "/"); len(names) != 3 {
+		t.Errorf("ASSERT_FAILURE: Expected: %d bytes to be split into 3 names | Actual: %d names", len(longName), len(names))
+	}
+}
+
+// Test that the objects whose keys are not valid filenames are downloaded to encoded filenames, which map back to the
+// same keys when the files are reconciled or uploaded
+func TestSynchronizerEncodesKeys(t *testing.T) {
+	defer func(windows bool) { encodeForWindows = windows }(encodeForWindows)
+	encodeForWindows = true
+
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerEncodesKeys"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	longName := strings.Repeat("long", 100) + ".txt"
+	putTestObject(t, sess, *testMount.Prefix+"/times/00:00.csv", "time content")
+	putTestObject(t, sess, *testMount.Prefix+"/"+longName, "long content")
+	mountDir := filepath.Join(destinationBase, testMountId)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+	syncErr := s.SyncNow(testMountId)
+	uploadFile := filepath.Join(mountDir, "times", "01\u201b\uff1a00.csv")
+	if err := ioutil.WriteFile(uploadFile, []byte("uploaded content"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	uploadErr := s.uploadToS3(context.Background(), s.sess, mountDir, uploadFile, testFakeBucketName, *testMount.Prefix, "", nil)
+
+	// ---- Assertions ----
+	if syncErr != nil || uploadErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: No errors | Actual: %v, %v", syncErr, uploadErr)
+	}
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	// The second sync finds the encoded files up-to-date
+	assertMountStatus(t, s, testMountId, 2, 0)
+	assertFileContent(t, filepath.Join(mountDir, "times", "00\u201b\uff1a00.csv"), "time content")
+	assertFileContent(t, filepath.Join(mountDir, filepath.FromSlash(encodeRelativePath(longName))), "long content")
+	if _, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(*testMount.Prefix + "/times/01:00.csv")}); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: The file to be uploaded to its decoded key | Actual: %v", err)
+	}
+}
+
+// Test that the files created locally whose names contain the characters of the encoding of the keys (the quote
+// character, the look-alikes and the case-collision suffix) are uploaded to the keys of their names, which map back to
+// the same files
+func TestSynchronizerKeepsLocalNames(t *testing.T) {
+	defer func(windows bool) { encodeForWindows = windows }(encodeForWindows)
+	defer func(insensitive bool) { caseInsensitiveFileNames = insensitive }(caseInsensitiveFileNames)
+	encodeForWindows = true
+	caseInsensitiveFileNames = true
+
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerKeepsLocalNames"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	mountDir := filepath.Join(destinationBase, testMountId)
+	localName := "notes\u201b draft\uff1a \u2409v2\uff0e\u201b~2.txt"
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+	uploadFile := filepath.Join(mountDir, localName)
+	if err := ioutil.WriteFile(uploadFile, []byte("local content"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	uploadErr := s.uploadToS3(context.Background(), s.sess, mountDir, uploadFile, testFakeBucketName, *testMount.Prefix, "", nil)
+	syncErr := s.SyncNow(testMountId)
+
+	// ---- Assertions ----
+	if syncErr != nil || uploadErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: No errors | Actual: %v, %v", syncErr, uploadErr)
+	}
+	if _, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(*testMount.Prefix + "/" + localName)}); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: The file to be uploaded to the key of its name | Actual: %v", err)
+	}
+	if localPath := encodeRelativePath(localName); localPath != localName {
+		t.Errorf("ASSERT_FAILURE: Expected: The key to be encoded as %q | Actual: %q", localName, localPath)
+	}
+	// The second sync downloads the key to the file it was uploaded from rather than to another name
+	assertMountStatus(t, s, testMountId, 2, 1)
+	assertFileContent(t, uploadFile, "local content")
+	if files, err := ioutil.ReadDir(mountDir); err != nil || len(files) != noOfFilesInMount+1 {
+		t.Errorf("ASSERT_FAILURE: Expected: %d files | Actual: %d files, %v", noOfFilesInMount+1, len(files), err)
+	}
+}
+
+// Test that the local paths that differ only in case are suffixed in the order they are listed and decoded back into
+// the same keys
+func TestCaseCollisions(t *testing.T) {
+	defer func(insensitive bool) { caseInsensitiveFileNames = insensitive }(caseInsensitiveFileNames)
+	caseInsensitiveFileNames = true
+
+	// ---- Inputs ----
+	testCases := []struct {
+		relPath          string
+		expectedPath     string
+		expectedSuffixed bool
+	}{
+		{"Data/a.csv", "Data/a.csv", false},
+		{"data/a.csv", "data\u201b~2/a.csv", true},
+		{"data/b.csv", "data\u201b~2/b.csv", true},
+		{"Data/A.csv", "Data/A\u201b~2.csv", true},
+		{"DATA/a.csv", "DATA\u201b~3/a.csv", true},
+		{"Data/a.csv", "Data/a.csv", false},
+		{"readme", "readme", false},
+		{"README", "README\u201b~2", true},
+		{".Profile", ".Profile", false},
+		{".profile", ".profile\u201b~2", true},
+		{"quote\u201b~2", "quote\u201b~2", false},
+	}
+
+	// ---- Run code under test ----
+	collisions := newCaseCollisions()
+	for _, testCase := range testCases {
+		localPath, suffixed := collisions.resolve(encodeRelativePath(testCase.relPath))
+		// The suffixes are dropped from the recorded local paths only, see Synchronizer.fileKey
+		names := strings.Split(localPath, "/")
+		for i := range names {
+			if suffixed {
+				names[i], _ = splitCaseSuffix(names[i])
+			}
+		}
+		decodedPath := decodeRelativePath(strings.Join(names, "/"))
+
+		// ---- Assertions ----
+		if localPath != testCase.expectedPath || suffixed != testCase.expectedSuffixed {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to be resolved as %q (suffixed: %v) | Actual: %q (suffixed: %v)", testCase.relPath, testCase.expectedPath, testCase.expectedSuffixed, localPath, suffixed)
+		}
+		if decodedPath != testCase.relPath {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to be decoded as %q | Actual: %q", localPath, testCase.relPath, decodedPath)
+		}
+	}
+	// The claimed names keep their spelling and number whatever the order of the keys, new spellings get the next number
+	collisions = newCaseCollisions()
+	collisions.claim("data/a.csv", true)
+	collisions.claim("DATA\u201b~3/a.csv", true)
+	for relPath, expectedPath := range map[string]string{
+		"Data/a.csv": "Data\u201b~4/a.csv",
+		"data/a.csv": "data/a.csv",
+		"DATA/a.csv": "DATA\u201b~3/a.csv",
+	} {
+		if localPath, _ := collisions.resolve(relPath); localPath != expectedPath {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to be resolved as %q | Actual: %q", relPath, expectedPath, localPath)
+		}
+	}
+	// The paths are not resolved on case-sensitive file systems
+	caseInsensitiveFileNames = false
+	if localPath, suffixed := newCaseCollisions().resolve("data/a.csv"); localPath != "data/a.csv" || suffixed {
+		t.Errorf("ASSERT_FAILURE: Expected: The path to be unchanged | Actual: %q (suffixed: %v)", localPath, suffixed)
+	}
+}
+
+// Test that the objects whose keys differ only in case are downloaded to distinct files on case-insensitive file
+// systems, the files are found up-to-date by the next sync and map back to the same keys when they are uploaded
+func TestSynchronizerCaseCollisions(t *testing.T) {
+	defer func(insensitive bool) { caseInsensitiveFileNames = insensitive }(caseInsensitiveFileNames)
+	caseInsensitiveFileNames = true
+
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerCaseCollisions"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	putTestObject(t, sess, *testMount.Prefix+"/Data/a.csv", "upper content")
+	putTestObject(t, sess, *testMount.Prefix+"/data/a.csv", "lower content")
+	putTestObject(t, sess, *testMount.Prefix+"/Data/A.csv", "upper name content")
+	mountDir := filepath.Join(destinationBase, testMountId)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount},
+		Destination: destinationBase,
+		State:       NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+	syncErr := s.SyncNow(testMountId)
+	uploadFile := filepath.Join(mountDir, "data\u201b~2", "b.csv")
+	if err := ioutil.WriteFile(uploadFile, []byte("uploaded content"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	uploadErr := s.uploadToS3(context.Background(), s.sess, mountDir, uploadFile, testFakeBucketName, *testMount.Prefix, "", nil)
+
+	// ---- Assertions ----
+	if syncErr != nil || uploadErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: No errors | Actual: %v, %v", syncErr, uploadErr)
+	}
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	// The second sync finds the suffixed files up-to-date
+	assertMountStatus(t, s, testMountId, 2, 0)
+	// The keys are listed in byte order, "Data/A.csv" < "Data/a.csv" < "data/a.csv"
+	assertFileContent(t, filepath.Join(mountDir, "Data", "A.csv"), "upper name content")
+	assertFileContent(t, filepath.Join(mountDir, "Data", "a\u201b~2.csv"), "upper content")
+	assertFileContent(t, filepath.Join(mountDir, "data\u201b~2", "a.csv"), "lower content")
+	status, _ := s.MountStatus(testMountId)
+	expectedKeys := []string{*testMount.Prefix + "/Data/a.csv", *testMount.Prefix + "/data/a.csv"}
+	sort.Strings(status.LastSyncCollidingKeys)
+	if !reflect.DeepEqual(status.LastSyncCollidingKeys, expectedKeys) {
+		t.Errorf("ASSERT_FAILURE: Expected: Colliding keys %v | Actual: %v", expectedKeys, status.LastSyncCollidingKeys)
+	}
+	if _, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(*testMount.Prefix + "/data/b.csv")}); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: The file to be uploaded to its decoded key | Actual: %v", err)
+	}
+}
+
+// Test that a downloaded file keeps its name when a key that differs only in case and sorts before its key shows up in
+// a later sync, also after a restart, and that the local files are found up-to-date by the following syncs
+func TestSynchronizerCaseCollisionsInLaterSync(t *testing.T) {
+	defer func(insensitive bool) { caseInsensitiveFileNames = insensitive }(caseInsensitiveFileNames)
+	caseInsensitiveFileNames = true
+
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerCaseCollisionsInLaterSync"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	putTestObject(t, sess, *testMount.Prefix+"/data/a.csv", "lower content")
+	mountDir := filepath.Join(destinationBase, testMountId)
+	newSynchronizer := func() *Synchronizer {
+		s, err := New(Options{
+			Session:     sess,
+			Mounts:      []Mount{*testMount},
+			Destination: destinationBase,
+			State:       NewPersistentSynchronizerStateIn(destinationBase),
+			Debug:       true,
+		})
+		if err != nil {
+			t.Fatalf("Error creating the synchronizer: %v", err)
+		}
+		return s
+	}
+
+	// ---- Run code under test ----
+	s := newSynchronizer()
+	s.Start()
+	s.Wait()
+	// "Data/a.csv" is listed before "data/a.csv"
+	putTestObject(t, sess, *testMount.Prefix+"/Data/a.csv", "upper content")
+	if err := s.SyncNow(testMountId); err != nil {
+		t.Fatalf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertMountStatus(t, s, testMountId, 2, 1)
+	assertFileContent(t, filepath.Join(mountDir, "data", "a.csv"), "lower content")
+	assertFileContent(t, filepath.Join(mountDir, "Data\u201b~2", "a.csv"), "upper content")
+	assertFileContent(t, filepath.Join(mountDir, "Data", "a.csv"), "")
+	if err := s.SyncNow(testMountId); err != nil {
+		t.Fatalf("Error syncing the mount: %v", err)
+	}
+	assertMountStatus(t, s, testMountId, 3, 0)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Error shutting down the synchronizer: %v", err)
+	}
+
+	// The local paths are recorded in the state
+	s = newSynchronizer()
+	s.Start()
+	s.Wait()
+	assertMountStatus(t, s, testMountId, 1, 0)
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	assertFileContent(t, filepath.Join(mountDir, "data", "a.csv"), "lower content")
+	assertFileContent(t, filepath.Join(mountDir, "Data\u201b~2", "a.csv"), "upper content")
+}
+
+// Test that the local paths of the colliding keys are recorded per mount when the same keys are mounted by a mount of
+// their prefix and by a mount of the bucket root, i.e., the mounts neither take over nor remove each other's records
+func TestSynchronizerCaseCollisionsPerMount(t *testing.T) {
+	defer func(insensitive bool) { caseInsensitiveFileNames = insensitive }(caseInsensitiveFileNames)
+	caseInsensitiveFileNames = true
+
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerCaseCollisionsPerMount"
+	testMount := putTestMountFiles(t, sess, testMountId, 0, 0)
+	rootMountId := testMountId + "-root"
+	rootMount := Mount{Id: String(rootMountId), Bucket: String(testFakeBucketName), Prefix: String("/")}
+	putTestObject(t, sess, *testMount.Prefix+"/data/a.csv", "lower content")
+	state := NewPersistentSynchronizerStateIn(destinationBase)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:     sess,
+		Mounts:      []Mount{*testMount, rootMount},
+		Destination: destinationBase,
+		State:       state,
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+	// "Data/a.csv" is listed before "data/a.csv"
+	putTestObject(t, sess, *testMount.Prefix+"/Data/a.csv", "upper content")
+	for _, mountId := range []string{testMountId, rootMountId, testMountId, rootMountId} {
+		if err := s.SyncNow(mountId); err != nil {
+			t.Fatalf("Error syncing mount %s: %v", mountId, err)
+		}
+	}
+
+	// ---- Assertions ----
+	assertMountStatus(t, s, testMountId, 3, 0)
+	assertMountStatus(t, s, rootMountId, 3, 0)
+	assertFileContent(t, filepath.Join(destinationBase, testMountId, "data", "a.csv"), "lower content")
+	assertFileContent(t, filepath.Join(destinationBase, testMountId, "Data\u201b~2", "a.csv"), "upper content")
+	rootMountPrefixDir := filepath.Join(destinationBase, rootMountId, filepath.FromSlash(*testMount.Prefix))
+	assertFileContent(t, filepath.Join(rootMountPrefixDir, "data", "a.csv"), "lower content")
+	assertFileContent(t, filepath.Join(rootMountPrefixDir, "Data\u201b~2", "a.csv"), "upper content")
+	upperKey := *testMount.Prefix + "/Data/a.csv"
+	for mountId, expectedPath := range map[string]string{
+		testMountId: "Data\u201b~2/a.csv",
+		rootMountId: *testMount.Prefix + "/Data\u201b~2/a.csv",
+	} {
+		expectedLocalPaths := map[string]string{mountStateKey(testFakeBucketName, mountId, upperKey): expectedPath}
+		localPaths := state.LocalPaths(mountStateKey(testFakeBucketName, mountId, ""))
+		if !reflect.DeepEqual(localPaths, expectedLocalPaths) {
+			t.Errorf("ASSERT_FAILURE: Expected: Local paths of mount %s %v | Actual: %v", mountId, expectedLocalPaths, localPaths)
+		}
+	}
+}
+
+// Test that the keys and the local paths are normalized to the Unicode normalization form of the policy when they are
+// mapped to each other and compared
+func TestUnicodeNormalization(t *testing.T) {
+	// ---- Data setup ----
+	destinationBase, err := ioutil.TempDir("", "s3-synchronizer-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(destinationBase)
+	prefix := "studies/Organization/TestUnicodeNormalization"
+	composed := "caf\u00e9.txt"
+	decomposed := "cafe\u0301.txt"
+	// The file system stored the name of the downloaded file decomposed
+	if err := ioutil.WriteFile(filepath.Join(destinationBase, decomposed), []byte("content"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	deletedFile := filepath.Join(destinationBase, "deleted.txt")
+	if err := ioutil.WriteFile(deletedFile, []byte("content"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	pathsInS3 := newPathSpill()
+	defer pathsInS3.close()
+
+	// ---- Inputs ----
+	testCases := []struct {
+		normalization string
+		relPath       string
+		expectedPath  string
+	}{
+		{"", decomposed, decomposed},
+		{"", composed, composed},
+		{UnicodeNormalizationNFC, decomposed, composed},
+		{UnicodeNormalizationNFC, composed, composed},
+		{UnicodeNormalizationNFD, composed, decomposed},
+		{UnicodeNormalizationNFD, "dir\u00e9/" + decomposed, "dire\u0301/" + decomposed},
+	}
+	s, err := New(Options{Session: session.Must(session.NewSession()), State: NewPersistentSynchronizerStateIn(destinationBase)})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	config := newMountConfiguration("TestUnicodeNormalization", testFakeBucketName, prefix, destinationBase, false, "")
+	config.normalization = UnicodeNormalizationNFC
+
+	// ---- Run code under test ----
+	for _, testCase := range testCases {
+		relPath, err := relativePathForKey(prefix+"/"+testCase.relPath, prefix, testCase.normalization)
+		key := ToS3KeyForFile(filepath.Join(destinationBase, filepath.FromSlash(testCase.relPath)), prefix, destinationBase, testCase.normalization)
+
+		// ---- Assertions ----
+		if err != nil || relPath != testCase.expectedPath {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to be mapped to %q (%q) | Actual: %q, %v", testCase.relPath, testCase.expectedPath, testCase.normalization, relPath, err)
+		}
+		if key != prefix+"/"+testCase.expectedPath {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to be mapped to the key %q (%q) | Actual: %q", testCase.relPath, prefix+"/"+testCase.expectedPath, testCase.normalization, key)
+		}
+	}
+	if err := pathsInS3.add(composed); err != nil {
+		t.Fatalf("Error spilling the paths: %v", err)
+	}
+	_, deleteErr := s.deleteLocalFilesNotInS3(pathsInS3, config)
+	_, newErr := New(Options{Session: session.Must(session.NewSession()), UnicodeNormalization: "NFKC"})
+
+	// ---- Assertions ----
+	if deleteErr != nil {
+		t.Errorf("Error deleting local files: %v", deleteErr)
+	}
+	// The decomposed name matches the composed path of the key
+	assertFileContent(t, filepath.Join(destinationBase, decomposed), "content")
+	assertFileContent(t, deletedFile, "")
+	if newErr == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: The unsupported normalization to be rejected | Actual: No error")
+	}
+}
+
+// Test that the objects are downloaded to normalized paths, that the files are found up-to-date by the next sync, that
+// only the first of the keys that differ only in their normalization is downloaded and that the files are uploaded to
+// normalized keys
+func TestSynchronizerUnicodeNormalization(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerUnicodeNormalization"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	putTestObject(t, sess, *testMount.Prefix+"/cafe\u0301.txt", "decomposed content")
+	putTestObject(t, sess, *testMount.Prefix+"/caf\u00e9.txt", "composed content")
+	putTestObject(t, sess, *testMount.Prefix+"/re\u0301sume\u0301/a.txt", "directory content")
+	mountDir := filepath.Join(destinationBase, testMountId)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:              sess,
+		Mounts:               []Mount{*testMount},
+		Destination:          destinationBase,
+		State:                NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:                true,
+		UnicodeNormalization: UnicodeNormalizationNFC,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+	syncErr := s.SyncNow(testMountId)
+	uploadFile := filepath.Join(mountDir, "nai\u0308ve.txt")
+	if err := ioutil.WriteFile(uploadFile, []byte("uploaded content"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	uploadErr := s.uploadToS3(context.Background(), s.sess, mountDir, uploadFile, testFakeBucketName, *testMount.Prefix, "", nil)
+
+	// ---- Assertions ----
+	if syncErr != nil || uploadErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: No errors | Actual: %v, %v", syncErr, uploadErr)
+	}
+	assertFilesDownloaded(t, destinationBase, testMountId, 0, noOfFilesInMount)
+	// The second sync finds the normalized files up-to-date
+	assertMountStatus(t, s, testMountId, 2, 0)
+	// The decomposed key sorts first, "e" < "\u00e9"
+	assertFileContent(t, filepath.Join(mountDir, "caf\u00e9.txt"), "decomposed content")
+	assertFileContent(t, filepath.Join(mountDir, "cafe\u0301.txt"), "")
+	assertFileContent(t, filepath.Join(mountDir, "r\u00e9sum\u00e9", "a.txt"), "directory content")
+	// The state knows the files by the keys of their normalized paths
+	if !s.state.IsFileDownloadedFromS3(ToS3Key(filepath.Join(mountDir, "caf\u00e9.txt"), s.findMountConfig(testMountId))) {
+		t.Errorf("ASSERT_FAILURE: Expected: The normalized key to be recorded in the state | Actual: Not recorded")
+	}
+	status, _ := s.MountStatus(testMountId)
+	expectedKeys := []string{*testMount.Prefix + "/caf\u00e9.txt"}
+	if !reflect.DeepEqual(status.LastSyncRejectedKeys, expectedKeys) {
+		t.Errorf("ASSERT_FAILURE: Expected: Rejected keys %v | Actual: %v", expectedKeys, status.LastSyncRejectedKeys)
+	}
+	if _, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(*testMount.Prefix + "/na\u00efve.txt")}); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: The file to be uploaded to its normalized key | Actual: %v", err)
+	}
+}
+
+// Test that a file downloaded from a key in another normalization form than the policy's is uploaded back to its key
+// when it is modified, without creating the normalized key
+func TestSynchronizerUnicodeNormalizationRoundTrip(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerUnicodeNormalizationRoundTrip"
+	noOfFilesInMount := 2
+	testMount := putTestMountFiles(t, sess, testMountId, 0, noOfFilesInMount)
+	decomposedKey := *testMount.Prefix + "/cafe\u0301.txt"
+	putTestObject(t, sess, decomposedKey, "decomposed content")
+	mountDir := filepath.Join(destinationBase, testMountId)
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:              sess,
+		Mounts:               []Mount{*testMount},
+		Destination:          destinationBase,
+		State:                NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:                true,
+		UnicodeNormalization: UnicodeNormalizationNFC,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+	uploadFile := filepath.Join(mountDir, "caf\u00e9.txt")
+	if err := ioutil.WriteFile(uploadFile, []byte("modified decomposed content"), 0666); err != nil {
+		t.Fatalf("Could not modify file for testing: %v", err)
+	}
+	uploadErr := s.uploadToS3(context.Background(), s.sess, mountDir, uploadFile, testFakeBucketName, *testMount.Prefix, "", nil)
+
+	// ---- Assertions ----
+	if uploadErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: No errors | Actual: %v", uploadErr)
+	}
+	s3Client := s3.New(sess)
+	object, err := s3Client.GetObject(&s3.GetObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(decomposedKey)})
+	if err != nil {
+		t.Fatalf("Could not get test object from fake S3 server: %v", err)
+	}
+	content, err := ioutil.ReadAll(object.Body)
+	object.Body.Close()
+	if err != nil || string(content) != "modified decomposed content" {
+		t.Errorf("ASSERT_FAILURE: Expected: The file to be uploaded to its original key | Actual: %q, %v", content, err)
+	}
+	list, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(testFakeBucketName), Prefix: aws.String(*testMount.Prefix + "/caf")})
+	if err != nil {
+		t.Fatalf("Could not list test objects from fake S3 server: %v", err)
+	}
+	if len(list.Contents) != 1 || *list.Contents[0].Key != decomposedKey {
+		t.Errorf("ASSERT_FAILURE: Expected: Only the key %q | Actual: %v", decomposedKey, list.Contents)
+	}
+}
+
+// Test that the placeholder of a file downloaded from a key in another normalization form than the policy's is hydrated
+// from its key
+func TestSynchronizerUnicodeNormalizationHydration(t *testing.T) {
+	// ---- Data setup ----
+	sess, destinationBase, cleanup := setupTest(t)
+	defer cleanup()
+	testMountId := "TestSynchronizerUnicodeNormalizationHydration"
+	testMount := putTestMountFiles(t, sess, testMountId, 0, 0)
+	content := "decomposed content"
+	testMount.CacheBytes = Int64(int64(len(content)))
+	// "a.txt" is listed first and fills up the cache
+	putTestObject(t, sess, *testMount.Prefix+"/a.txt", strings.Repeat("a", len(content)))
+	putTestObject(t, sess, *testMount.Prefix+"/cafe\u0301.txt", content)
+	placeholder := filepath.Join(destinationBase, testMountId, "caf\u00e9.txt")
+
+	// ---- Inputs ----
+	s, err := New(Options{
+		Session:              sess,
+		Mounts:               []Mount{*testMount},
+		Destination:          destinationBase,
+		State:                NewPersistentSynchronizerStateIn(destinationBase),
+		Debug:                true,
+		ObjectConcurrency:    1,
+		UnicodeNormalization: UnicodeNormalizationNFC,
+	})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	s.Start()
+	s.Wait()
+	if info, err := os.Stat(placeholder); err != nil || info.Size() != 0 {
+		t.Fatalf("Expected a placeholder for %s: %v, %v", placeholder, info, err)
+	}
+	if err := ioutil.WriteFile(placeholder+HydrationMarkerSuffix, nil, 0644); err != nil {
+		t.Fatalf("Error creating the hydration marker: %v", err)
+	}
+	if err := s.SyncNow(testMountId); err != nil {
+		t.Fatalf("Error syncing the mount: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFileContent(t, placeholder, content)
+	status, _ := s.MountStatus(testMountId)
+	if status.LastSyncHydratedFiles != 1 || len(status.LastSyncErrors) != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: 1 hydrated file and no errors | Actual: %d, %v", status.LastSyncHydratedFiles, status.LastSyncErrors)
+	}
+}
+
+// Test that the errors of the background saves of the state are logged through the synchronizer's logger
+func TestStateSaveErrorsAreLogged(t *testing.T) {
+	// ---- Data setup ----
+	destinationBase, err := ioutil.TempDir("", "s3-synchronizer-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(destinationBase)
+	stateDir := filepath.Join(destinationBase, "state")
+	state := NewPersistentSynchronizerStateIn(stateDir)
+	// The state cannot be saved once its directory is gone
+	os.RemoveAll(stateDir)
+	logPath := filepath.Join(destinationBase, "log.txt")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+	defer logFile.Close()
+
+	// ---- Inputs ----
+	_, err = New(Options{Session: session.Must(session.NewSession()), State: state, Logger: log.New(logFile, "", 0)})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+
+	// ---- Run code under test ----
+	state.RecordFileDownloadToLocal(&s3.Object{Key: aws.String("key"), ETag: aws.String(`"etag"`)})
+
+	// ---- Assertions ----
+	var logged []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if logged, _ = ioutil.ReadFile(logPath); strings.Contains(string(logged), "Error saving the synchronizer state") {
+			return
+		}
+	}
+	t.Errorf("ASSERT_FAILURE: Expected: The save error to be logged | Actual: %q", logged)
+}
+
+// Test that the local files that are no longer in S3 are deleted by merge-joining the spilled listing with the local
+// files
+func TestDeleteLocalFilesNotInS3(t *testing.T) {
+	// ---- Data setup ----
+	destinationBase, err := ioutil.TempDir("", "s3-synchronizer-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(destinationBase)
+	// Spill the paths in several runs
+	defer func(chunkSize int) { spillChunkSize = chunkSize }(spillChunkSize)
+	spillChunkSize = 300
+	prefix := "studies/Organization/TestDeleteLocalFilesNotInS3/"
+	noOfFiles := 2000
+	state := NewPersistentSynchronizerStateIn(destinationBase)
+	pathsInS3 := newPathSpill()
+	defer pathsInS3.close()
+	// The names sort around the directory names, e.g., "dir4-x.txt" < "dir4.txt" < "dir4/..." < "dir40-x.txt"
+	names := func(i int) string {
+		switch i % 3 {
+		case 0:
+			return fmt.Sprintf("dir%d/test%d.txt", i%10, i)
+		case 1:
+			return fmt.Sprintf("dir%d-x.txt", i)
+		default:
+			return fmt.Sprintf("dir%d.txt", i)
+		}
+	}
+	// List the objects in reverse order so that the runs are not sorted already
+	for i := noOfFiles - 1; i >= 0; i-- {
+		key := prefix + names(i)
+		item := &s3.Object{Key: aws.String(key), ETag: aws.String(fmt.Sprintf(`"%d"`, i))}
+		// Every 4th file is deleted from S3 after it was downloaded
+		if i%4 != 0 {
+			relPath, err := relativePathForKey(key, prefix, "")
+			if err != nil {
+				t.Fatalf("Error mapping the key %s: %v", key, err)
+			}
+			if err := pathsInS3.add(relPath); err != nil {
+				t.Fatalf("Error spilling the paths: %v", err)
+			}
+		}
+		path := filepath.Join(destinationBase, strings.TrimPrefix(key, prefix))
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err := ioutil.WriteFile(path, []byte(key), 0666); err != nil {
+			t.Fatalf("Could not create file for testing: %v", err)
+		}
+		state.RecordFileDownloadToLocal(item)
+	}
+	// A file created locally in a writeable mount is kept
+	localOnlyFile := filepath.Join(destinationBase, "dir0", "local-only.txt")
+	if err := ioutil.WriteFile(localOnlyFile, []byte("local"), 0666); err != nil {
+		t.Fatalf("Could not create file for testing: %v", err)
+	}
+
+	// ---- Inputs ----
+	s, err := New(Options{Session: session.Must(session.NewSession()), State: state})
+	if err != nil {
+		t.Fatalf("Error creating the synchronizer: %v", err)
+	}
+	config := newMountConfiguration("TestDeleteLocalFilesNotInS3", testFakeBucketName, prefix, destinationBase, true, "")
+
+	// ---- Run code under test ----
+	_, err = s.deleteLocalFilesNotInS3(pathsInS3, config)
+
+	// ---- Assertions ----
+	if err != nil {
+		t.Errorf("Error deleting local files: %v", err)
+	}
+	for i := 0; i < noOfFiles; i++ {
+		path := filepath.Join(destinationBase, names(i))
+		_, err := os.Stat(path)
+		if i%4 == 0 && !os.IsNotExist(err) {
+			t.Errorf("ASSERT_FAILURE: Expected: %s to be deleted | Actual: %v", path, err)
+		}
+		if i%4 != 0 && err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: %s to be kept | Actual: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(localOnlyFile); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: Local only file to be kept | Actual: %v", err)
+	}
+}
+
+// Test that the spilled paths are read back sorted and without duplicates
+func TestPathSpill(t *testing.T) {
+	// ---- Data setup ----
+	defer func(chunkSize int) { spillChunkSize = chunkSize }(spillChunkSize)
+	spillChunkSize = 2
+
+	// ---- Inputs ----
+	inputs := []string{"c", "a\nwith new line", "b", "a", "c", "a/b", "a-b"}
+	spill := newPathSpill()
+	defer spill.close()
+
+	// ---- Run code under test ----
+	var actual []string
+	for _, path := range inputs {
+		if err := spill.add(path); err != nil {
+			t.Fatalf("Error spilling the paths: %v", err)
+		}
+	}
+	paths, err := spill.sortedPaths()
+	if err != nil {
+		t.Fatalf("Error reading the spilled paths: %v", err)
+	}
+	defer paths.close()
+	for {
+		path, more, err := paths.next()
+		if err != nil {
+			t.Fatalf("Error reading the spilled paths: %v", err)
+		}
+		if !more {
+			break
+		}
+		actual = append(actual, path)
+	}
+
+	// ---- Assertions ----
+	expected := []string{"a", "a\nwith new line", "a-b", "a/b", "b", "c"}
+	if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", expected) {
+		t.Errorf("ASSERT_FAILURE: Expected: %q | Actual: %q", expected, actual)
+	}
+}
+
+// ------------------------------- Setup code -------------------------------/
+
+// Starts a fake S3 server with an empty test bucket and creates a temporary destination directory. The returned
+// function stops the server and deletes the directory.
+func setupTest(t *testing.T) (*session.Session, string, func()) {
+	return setupTestWithHandler(t, nil)
+}
+
+// Same as setupTest but lets the test wrap the handler of the fake S3 server, e.g., to simulate slow requests
+func setupTestWithHandler(t *testing.T, wrapHandler func(h http.Handler) http.Handler) (*session.Session, string, func()) {
+	backend := s3mem.New()
+	faker := gofakes3.New(backend)
+	handler := faker.Server()
+	if wrapHandler != nil {
+		handler = wrapHandler(handler)
+	}
+	fakeS3Server := httptest.NewServer(handler)
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Credentials:      credentials.NewStaticCredentials("FAKE-ACCESSKEYID", "FAKE-SECRETACCESSKEY", ""),
+			Endpoint:         aws.String(fakeS3Server.URL),
+			Region:           aws.String(testRegion),
+			DisableSSL:       aws.Bool(true),
+			S3ForcePathStyle: aws.Bool(true),
+		},
+	}))
+
+	_, err := s3.New(sess).CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(testFakeBucketName)})
+	if err != nil {
+		fakeS3Server.Close()
+		t.Fatalf("Could not create bucket using fake S3 server for testing: %v", err)
+	}
+
+	destinationBase, err := ioutil.TempDir("", "s3-synchronizer-test")
+	if err != nil {
+		fakeS3Server.Close()
+		t.Fatalf("Could not create temporary output directory for testing: %v", err)
+	}
+
+	return sess, destinationBase, func() {
+		fakeS3Server.Close()
+		os.RemoveAll(destinationBase)
+	}
+}
+
+// Puts the files with index from firstFileIdx to firstFileIdx + noOfFiles - 1 to the test mount in the fake S3 server
+func putTestMountFiles(t *testing.T, sess *session.Session, testMountId string, firstFileIdx int, noOfFiles int) *Mount {
+	s3Client := s3.New(sess)
+
+	mountPrefix := fmt.Sprintf("studies/Organization/%s", testMountId)
+	for i := firstFileIdx; i < firstFileIdx+noOfFiles; i++ {
+		_, err := s3Client.PutObject(&s3.PutObjectInput{
+			Body:   strings.NewReader(fmt.Sprintf(testFileContentTemplate, i)),
+			Bucket: aws.String(testFakeBucketName),
+			Key:    aws.String(fmt.Sprintf("%s/test%d.txt", mountPrefix, i)),
+		})
+		if err != nil {
+			// Fail test in case of any errors
+			t.Errorf("Could not put test files to fake S3 server for testing: %v", err)
+		}
+	}
+	return &Mount{Id: String(testMountId), Bucket: String(testFakeBucketName), Prefix: String(mountPrefix)}
+}
+
+func putTestObject(t *testing.T, sess *session.Session, key string, content string) {
+	_, err := s3.New(sess).PutObject(&s3.PutObjectInput{
+		Body:   strings.NewReader(content),
+		Bucket: aws.String(testFakeBucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		// Fail test in case of any errors
+		t.Errorf("Could not put test object to fake S3 server for testing: %v", err)
+	}
+}
+
+// Writes an S3 error response with the given status and error code
+func writeTestErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// Flips the bits of the first byte of the response body
+type corruptingResponseWriter struct {
+	http.ResponseWriter
+	corrupted bool
+}
+
+func (w *corruptingResponseWriter) Write(p []byte) (int, error) {
+	if !w.corrupted && len(p) > 0 {
+		p = append([]byte(nil), p...)
+		p[0] ^= 0xff
+		w.corrupted = true
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Matches the objects of a listing response
+var testContentsRegex = regexp.MustCompile(`(?s)<Contents>.*?</Contents>`)
+
+func assertArchivedObjects(t *testing.T, s *Synchronizer, testMountId string, expectedKeys []string) {
+	status, _ := s.MountStatus(testMountId)
+	if strings.Join(status.LastSyncArchivedObjects, ",") != strings.Join(expectedKeys, ",") {
+		t.Errorf("ASSERT_FAILURE: %s: Expected: Archived objects %v | Actual: %v", testMountId, expectedKeys, status.LastSyncArchivedObjects)
+	}
+}
+
+// Asserts the content of the given file, an empty expected content means the file must not exist
+func assertFileContent(t *testing.T, path string, expectedContent string) {
+	content, err := ioutil.ReadFile(path)
+	if expectedContent == "" {
+		if !os.IsNotExist(err) {
+			t.Errorf("ASSERT_FAILURE: Expected: File %s not to exist | Actual: %q, %v", path, string(content), err)
+		}
+		return
+	}
+	if err != nil || string(content) != expectedContent {
+		t.Errorf("ASSERT_FAILURE: Expected: File %s to contain %q | Actual: %q, %v", path, expectedContent, string(content), err)
+	}
+}
+
+// The suffix the fake S3 server stores the directory markers with, the server drops the trailing "/" of the keys
+const testDirMarkerSuffix = ".test-dir-marker"
+
+// Wraps the handler of the fake S3 server to keep the trailing "/" of the keys of directory markers
+func withTestDirectoryMarkers(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Object keys (as opposed to bucket names) ending in "/", i.e., "/bucket/key/"
+		if strings.HasSuffix(r.URL.Path, "/") && strings.Count(r.URL.Path, "/") > 2 {
+			r.URL.Path += testDirMarkerSuffix
+			if r.URL.RawPath != "" {
+				r.URL.RawPath += testDirMarkerSuffix
+			}
+		}
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, r)
+		body := strings.Replace(recorder.Body.String(), "/"+testDirMarkerSuffix+"</Key>", "/</Key>", -1)
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(recorder.Code)
+		fmt.Fprint(w, body)
+	})
+}
+
+// Waits until the mount has completed the given number of syncs from S3
+func waitForSyncCount(t *testing.T, s *Synchronizer, testMountId string, syncCount int) {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		status, err := s.MountStatus(testMountId)
+		if err == nil && status.SyncCount >= syncCount {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("ASSERT_FAILURE: Expected: %d syncs of mount %s | Actual: Timed out waiting for the syncs", syncCount, testMountId)
+}
+
+func assertMountStatus(t *testing.T, s *Synchronizer, testMountId string, expectedSyncCount int, expectedDownloadedFiles int) {
+	status, err := s.MountStatus(testMountId)
+	if err != nil {
+		t.Fatalf("Error getting the mount status: %v", err)
+	}
+	if status.SyncCount != expectedSyncCount {
+		t.Errorf("ASSERT_FAILURE: Expected: %d syncs | Actual: %d syncs", expectedSyncCount, status.SyncCount)
+	}
+	if status.LastSyncDownloadedFiles != expectedDownloadedFiles {
+		t.Errorf("ASSERT_FAILURE: Expected: %d downloaded files | Actual: %d downloaded files", expectedDownloadedFiles, status.LastSyncDownloadedFiles)
+	}
+	if len(status.LastSyncErrors) != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: No errors | Actual: %v", status.LastSyncErrors)
+	}
+}
+
+func assertFilesDownloaded(t *testing.T, destinationBase string, testMountId string, firstFileIdx int, noOfFiles int) {
+	for i := firstFileIdx; i < firstFileIdx+noOfFiles; i++ {
+		localFile := filepath.Join(destinationBase, testMountId, fmt.Sprintf("test%d.txt", i))
+		content, err := ioutil.ReadFile(localFile)
+		if err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: File %s to be downloaded | Actual: %v", localFile, err)
+			continue
+		}
+		expectedContent := fmt.Sprintf(testFileContentTemplate, i)
+		if string(content) != expectedContent {
+			t.Errorf("ASSERT_FAILURE: Expected: %s | Actual: %s", expectedContent, string(content))
+		}
+	}
+}